@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/gin-gonic/gin"
+)
+
+func (app *application) registerAddressRoutes(router *gin.Engine) {
+	v1 := router.Group("/api/v1/addresses", app.authenticateUser())
+	v1.POST("", app.createAddressHandler)
+	v1.GET("", app.listAddressesHandler)
+	v1.GET("/:id", app.getAddressHandler)
+	v1.PATCH("/:id", app.updateAddressHandler)
+	v1.DELETE("/:id", app.deleteAddressHandler)
+	v1.POST("/:id/default", app.setDefaultAddressHandler)
+}
+
+// readOwnedAddress reads the address of the :id param from the address book of the user.
+// It returns false if it can't, in which case a response has already been sent.
+func (app *application) readOwnedAddress(c *gin.Context) (*models.SavedAddress, bool) {
+	id := ReadIdParam(c)
+	if id.IsZero() {
+		app.badRequestError(c, models.ErrInvalidID)
+		return nil, false
+	}
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return nil, false
+	}
+
+	address, err := app.models.Address.Get(id, user.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return nil, false
+	}
+	return address, true
+}
+
+func (app *application) createAddressHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	var payload models.SavedAddressPayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	address := &models.SavedAddress{UserId: user.UserID}
+	payload.Apply(address)
+	address.IsDefault = payload.IsDefault != nil && *payload.IsDefault
+
+	v := validator.NewValidator()
+	if models.ValidateSavedAddress(v, *address); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	if err := app.models.Address.Insert(address); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"address": address})
+}
+
+func (app *application) listAddressesHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	addresses, err := app.models.Address.GetForUser(user.UserID)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"addresses": addresses})
+}
+
+func (app *application) getAddressHandler(c *gin.Context) {
+	address, ok := app.readOwnedAddress(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"address": address})
+}
+
+func (app *application) updateAddressHandler(c *gin.Context) {
+	address, ok := app.readOwnedAddress(c)
+	if !ok {
+		return
+	}
+
+	var payload models.SavedAddressPayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	payload.Apply(address)
+	v := validator.NewValidator()
+	if models.ValidateSavedAddress(v, *address); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	if err := app.models.Address.Update(address); err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+	if payload.IsDefault != nil && *payload.IsDefault && !address.IsDefault {
+		if err := app.models.Address.SetDefault(address); err != nil {
+			app.internalServerError(c, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"address": address})
+}
+
+func (app *application) deleteAddressHandler(c *gin.Context) {
+	address, ok := app.readOwnedAddress(c)
+	if !ok {
+		return
+	}
+
+	if err := app.models.Address.Delete(address.ID, address.UserId); err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+func (app *application) setDefaultAddressHandler(c *gin.Context) {
+	address, ok := app.readOwnedAddress(c)
+	if !ok {
+		return
+	}
+
+	if err := app.models.Address.SetDefault(address); err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"address": address})
+}
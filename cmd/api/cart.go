@@ -4,23 +4,125 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/GiorgosMarga/ecom_go/internal/tax"
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
 	"github.com/GiorgosMarga/ecom_go/models"
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func (app *application) registerCartRoutes(router *gin.Engine) {
 	v1 := router.Group("/api/v1/cart")
 	v1.POST("", app.authenticateUser(), app.createCartHandler)
-	v1.GET("/:id", app.authenticateUser(), app.getCartHandler)
+	v1.GET("/me", app.optionalAuthentication(), app.getCurrentCartHandler)
+	v1.GET("/recover", app.recoverCartHandler)
+	v1.GET("/:id", app.optionalAuthentication(), app.getCartHandler)
 	v1.DELETE("/:id", app.authenticateUser(), app.deleteCartHandler)
-	v1.PATCH("/:id", app.authenticateUser(), app.updateCartHandler)
+	v1.PATCH("/:id", app.optionalAuthentication(), app.updateCartHandler)
+	v1.POST("/:id/items", app.optionalAuthentication(), app.addCartItemHandler)
+	v1.PATCH("/:id/items/:lineId", app.optionalAuthentication(), app.updateCartItemHandler)
+	v1.DELETE("/:id/items/:lineId", app.optionalAuthentication(), app.removeCartItemHandler)
+	v1.POST("/:id/items/:lineId/wishlist", app.authenticateUser(), app.moveCartItemToWishlistHandler)
+	v1.GET("/:id/shipping-rates", app.optionalAuthentication(), app.cartShippingRatesHandler)
 	// v1.GET("/:id", app.getUserByIdHandler)
 }
 
+// readOwnedCart reads the cart of the id param and makes sure that it belongs to the user
+// of the request, or to the guest cookie for anonymous carts. It returns false if it doesn't,
+// in which case a response has already been sent.
+func (app *application) readOwnedCart(c *gin.Context) (*models.Cart, bool) {
+	id := ReadIdParam(c)
+	if id.IsZero() {
+		app.badRequestError(c, models.ErrInvalidID)
+		return nil, false
+	}
+
+	cart, err := app.models.Cart.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return nil, false
+	}
+
+	if cart.IsGuest() {
+		if cart.ID != app.readGuestCartId(c) {
+			app.notAuthorizedError(c)
+			return nil, false
+		}
+		return cart, true
+	}
+
+	user, err := GetUser(c)
+	if err != nil {
+		app.notAuthenticatedError(c)
+		return nil, false
+	}
+	if cart.UserId != user.UserID {
+		app.notAuthorizedError(c)
+		return nil, false
+	}
+	return cart, true
+}
+
+// readActiveCart is readOwnedCart for the requests that change the cart. A cart that
+// was checked out or closed can't be changed anymore.
+func (app *application) readActiveCart(c *gin.Context) (*models.Cart, bool) {
+	cart, ok := app.readOwnedCart(c)
+	if !ok {
+		return nil, false
+	}
+	if cart.Active != 1 {
+		app.conflictError(c, models.ErrCartClosed)
+		return nil, false
+	}
+	return cart, true
+}
+
+// priceCart recomputes line prices, availability and the total of the cart
+// from the current catalog
+func (app *application) priceCart(cart *models.Cart) error {
+	catalog, err := app.models.Variant.GetCatalog(cart.VariantIds())
+	if err != nil {
+		return err
+	}
+	cart.Price(catalog)
+	return nil
+}
+
+// setCartItems replaces the items of the cart with the ones of the payload.
+// It returns false if the payload is invalid, in which case a response has already been sent.
+func (app *application) setCartItems(c *gin.Context, cart *models.Cart, payload models.CartPayload) bool {
+	catalog, err := app.models.Variant.GetCatalog(payload.VariantIds())
+	if err != nil {
+		app.internalServerError(c, err)
+		return false
+	}
+
+	v := validator.NewValidator()
+	if models.ValidateCartPayload(v, payload, catalog); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return false
+	}
+
+	cart.SetItems(payload.Items, catalog)
+	cart.Price(catalog)
+
+	if models.ValidateCartAvailability(v, cart); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return false
+	}
+	return true
+}
+
 func (app *application) createCartHandler(c *gin.Context) {
-	cart := &models.Cart{}
-	if err := c.BindJSON(&cart); err != nil {
+	var payload models.CartPayload
+	if err := c.BindJSON(&payload); err != nil {
 		app.badRequestError(c, err)
 		return
 	}
@@ -30,105 +132,424 @@ func (app *application) createCartHandler(c *gin.Context) {
 		app.internalServerError(c, err)
 		return
 	}
-	cart.UserId = user.UserID
+	cart := &models.Cart{UserId: user.UserID}
+
+	if ok := app.setCartItems(c, cart, payload); !ok {
+		return
+	}
 
 	if err := app.models.Cart.Insert(cart); err != nil {
-		app.internalServerError(c, err)
+		switch {
+		case errors.Is(err, models.ErrActiveCartExists):
+			app.conflictError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
 		return
 	}
 
 	c.JSON(http.StatusCreated, gin.H{"cart": cart})
 }
-func (app *application) getCartHandler(c *gin.Context) {
-	id := ReadIdParam(c)
-	if id.IsZero() {
-		app.badRequestError(c, models.ErrInvalidID)
+
+// getCurrentCartHandler returns the active cart of the user, a new empty cart
+// is created the first time it is requested. Anonymous shoppers get a guest cart
+// that is identified by a signed cookie.
+func (app *application) getCurrentCartHandler(c *gin.Context) {
+	var cart *models.Cart
+
+	user, err := GetUser(c)
+	if err == nil {
+		cart, err = app.models.Cart.GetActiveForUser(user.UserID)
+	} else {
+		cart, err = app.getGuestCart(c)
+	}
+	if err != nil {
+		app.internalServerError(c, err)
 		return
 	}
 
-	cart, err := app.models.Cart.Get(id)
+	if err := app.priceCart(cart); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	if err := app.taxCart(c, cart); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"cart": cart})
+}
+
+// taxCart computes the tax of a priced cart when it is read. The destination is taken
+// from the country and region query params or from the default address of the user.
+// Without a destination the cart is left untaxed.
+func (app *application) taxCart(c *gin.Context, cart *models.Cart) error {
+	qs := c.Request.URL.Query()
+	country, region := readString(qs, "country", ""), readString(qs, "region", "")
+	if country == "" {
+		user, err := GetUser(c)
+		if err != nil {
+			return nil
+		}
+		address, err := app.models.Address.GetDefault(user.UserID)
+		if err != nil {
+			if errors.Is(err, models.ErrNotFound) {
+				return nil
+			}
+			return err
+		}
+		country, region = address.Country, address.Region
+	}
+
+	taxes, err := app.tax.Calculate(country, region, tax.CartLines(cart))
 	if err != nil {
-		switch {
-		case errors.Is(err, models.ErrNotFound):
-			app.notFoundError(c)
-		default:
-			app.internalServerError(c, err)
+		return err
+	}
+	taxes.ApplyToCart(cart)
+	return nil
+}
+
+// getGuestCart returns the active guest cart of the cookie or creates a new one
+func (app *application) getGuestCart(c *gin.Context) (*models.Cart, error) {
+	if id := app.readGuestCartId(c); !id.IsZero() {
+		cart, err := app.models.Cart.Get(id)
+		if err == nil && cart.IsGuest() && cart.Active == 1 {
+			return cart, nil
+		}
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			return nil, err
 		}
+	}
+
+	cart := &models.Cart{}
+	if err := app.models.Cart.Insert(cart); err != nil {
+		return nil, err
+	}
+	if err := app.setGuestCartCookie(c, cart.ID); err != nil {
+		return nil, err
+	}
+	return cart, nil
+}
+
+// mergeGuestCart moves the guest cart of the request into the active cart of the user
+// that just logged in. Failing to merge must not fail the login so errors are only logged.
+func (app *application) mergeGuestCart(c *gin.Context, userId primitive.ObjectID) {
+	guestId := app.readGuestCartId(c)
+	if guestId.IsZero() {
 		return
 	}
+	app.clearGuestCartCookie(c)
 
-	user, err := GetUser(c)
+	guest, err := app.models.Cart.Get(guestId)
 	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) {
+			app.logError(c, err)
+		}
+		return
+	}
+	if !guest.IsGuest() || guest.Active != 1 || len(guest.Items) == 0 {
+		return
+	}
+
+	// the user cart may be changed from another session while merging, start over
+	// from a fresh copy when that happens
+	for attempt := 0; ; attempt++ {
+		cart, err := app.models.Cart.GetActiveForUser(userId)
+		if err != nil {
+			app.logError(c, err)
+			return
+		}
+		cart.Merge(guest, app.cfg.cartMergeStrategy)
+
+		err = app.models.Cart.Update(cart)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, models.ErrCartChanged) || attempt == 2 {
+			app.logError(c, err)
+			return
+		}
+	}
+	if err := app.models.Cart.Deactivate(guest.ID); err != nil {
+		app.logError(c, err)
+	}
+}
+
+func (app *application) getCartHandler(c *gin.Context) {
+	cart, ok := app.readOwnedCart(c)
+	if !ok {
+		return
+	}
+
+	if err := app.priceCart(cart); err != nil {
 		app.internalServerError(c, err)
 		return
 	}
-	if cart.UserId != user.UserID {
-		app.notAuthorizedError(c)
+	if err := app.taxCart(c, cart); err != nil {
+		app.internalServerError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"cart": cart})
+	c.JSON(http.StatusOK, gin.H{"cart": cart})
 }
 func (app *application) updateCartHandler(c *gin.Context) {
+	cart, ok := app.readActiveCart(c)
+	if !ok {
+		return
+	}
+
+	var payload models.CartPayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	if ok := app.setCartItems(c, cart, payload); !ok {
+		return
+	}
+
+	if err := app.models.Cart.Update(cart); err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		case errors.Is(err, models.ErrCartChanged), errors.Is(err, models.ErrCartClosed):
+			app.conflictError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"cart": cart})
+}
+
+func (app *application) deleteCartHandler(c *gin.Context) {
 	id := ReadIdParam(c)
 	if id.IsZero() {
 		app.badRequestError(c, fmt.Errorf("bad id"))
 		return
 	}
 
-	cart, err := app.models.Cart.Get(id)
+	user, err := GetUser(c)
 	if err != nil {
+		app.notAuthenticatedError(c)
+		return
+	}
+	if err := app.models.Cart.Delete(id, user.UserID); err != nil {
 		switch {
 		case errors.Is(err, models.ErrNotFound):
 			app.notFoundError(c)
+		case errors.Is(err, models.ErrCartClosed):
+			app.conflictError(c, err)
 		default:
 			app.internalServerError(c, err)
 		}
 		return
 	}
 
-	user, err := GetUser(c)
+	c.JSON(http.StatusCreated, gin.H{"msg": "success"})
+}
+
+func (app *application) addCartItemHandler(c *gin.Context) {
+	cart, ok := app.readActiveCart(c)
+	if !ok {
+		return
+	}
+
+	var payload models.CartItemPayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	cart, ok = app.addCartItem(c, cart, payload)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"cart": cart})
+}
+
+// addCartItem validates the item against the catalog and adds it to the cart.
+// It returns the priced cart, or false if a response has already been sent.
+func (app *application) addCartItem(c *gin.Context, cart *models.Cart, payload models.CartItemPayload) (*models.Cart, bool) {
+	catalog, err := app.models.Variant.GetCatalog([]primitive.ObjectID{payload.VariantId})
+	if err != nil {
+		app.internalServerError(c, err)
+		return nil, false
+	}
+
+	v := validator.NewValidator()
+	if models.ValidateCartItem(v, payload, catalog); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return nil, false
+	}
+
+	// the stock must cover the quantity that is already in the cart as well
+	quantity := payload.Quantity
+	if existing := cart.FindItem(payload.VariantId, payload.Size); existing != nil {
+		quantity += existing.Quantity
+	}
+	size := catalog[payload.VariantId].GetSize(payload.Size)
+	if v.Validate(size.Stock >= quantity, "quantity", "not enough items in stock"); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return nil, false
+	}
+
+	item := models.CartItem{
+		ID:         primitive.NewObjectID(),
+		VariantId:  payload.VariantId,
+		Size:       payload.Size,
+		Quantity:   payload.Quantity,
+		AddedPrice: catalog[payload.VariantId].Price,
+		AddedAt:    time.Now(),
+	}
+	cart, err = app.models.Cart.AddItem(cart.ID, item)
 	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		case errors.Is(err, models.ErrCartClosed):
+			app.conflictError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
+		return nil, false
+	}
+
+	if err := app.priceCart(cart); err != nil {
 		app.internalServerError(c, err)
+		return nil, false
+	}
+	return cart, true
+}
+
+func (app *application) updateCartItemHandler(c *gin.Context) {
+	cart, ok := app.readActiveCart(c)
+	if !ok {
 		return
 	}
-	if cart.UserId != user.UserID {
-		app.notAuthorizedError(c)
+
+	lineId := ReadObjectIdParam(c, "lineId")
+	item := cart.GetItem(lineId)
+	if item == nil {
+		app.notFoundError(c)
 		return
 	}
 
-	payload := &models.Cart{}
+	var payload models.CartItemUpdatePayload
 	if err := c.BindJSON(&payload); err != nil {
 		app.badRequestError(c, err)
 		return
 	}
 
-	cart.Products = payload.Products
+	catalog, err := app.models.Variant.GetCatalog([]primitive.ObjectID{item.VariantId})
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
 
-	if err := app.models.Cart.Update(cart); err != nil {
+	v := validator.NewValidator()
+	models.ValidateCartItem(v, models.CartItemPayload{
+		VariantId: item.VariantId,
+		Size:      item.Size,
+		Quantity:  payload.Quantity,
+	}, catalog)
+	if v.IsValid() {
+		size := catalog[item.VariantId].GetSize(item.Size)
+		v.Validate(size.Stock >= payload.Quantity, "quantity", "not enough items in stock")
+	}
+	if !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	cart, err = app.models.Cart.UpdateItemQuantity(cart.ID, lineId, payload.Quantity)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		case errors.Is(err, models.ErrCartClosed):
+			app.conflictError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	if err := app.priceCart(cart); err != nil {
 		app.internalServerError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"cart": cart})
+	c.JSON(http.StatusOK, gin.H{"cart": cart})
 }
 
-func (app *application) deleteCartHandler(c *gin.Context) {
-	id := ReadIdParam(c)
-	if id.IsZero() {
-		app.badRequestError(c, fmt.Errorf("bad id"))
+func (app *application) removeCartItemHandler(c *gin.Context) {
+	cart, ok := app.readActiveCart(c)
+	if !ok {
 		return
 	}
 
-	user, err := GetUser(c)
+	lineId := ReadObjectIdParam(c, "lineId")
+	if lineId.IsZero() {
+		app.badRequestError(c, models.ErrInvalidID)
+		return
+	}
+
+	cart, err := app.models.Cart.RemoveItem(cart.ID, lineId)
 	if err != nil {
-		app.notAuthenticatedError(c)
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		case errors.Is(err, models.ErrCartClosed):
+			app.conflictError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
 		return
 	}
-	if err := app.models.Cart.Delete(id, user.UserID); err != nil {
+
+	if err := app.priceCart(cart); err != nil {
 		app.internalServerError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"msg": "success"})
+	c.JSON(http.StatusOK, gin.H{"cart": cart})
+}
+
+// recoverCartHandler follows the link of an abandoned cart event and reopens the cart
+func (app *application) recoverCartHandler(c *gin.Context) {
+	id, err := app.readCartRecoveryToken(c.Query("token"))
+	if err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	cart, err := app.models.Cart.Reopen(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		case errors.Is(err, models.ErrActiveCartExists):
+			app.conflictError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	if cart.IsGuest() {
+		if err := app.setGuestCartCookie(c, cart.ID); err != nil {
+			app.internalServerError(c, err)
+			return
+		}
+	}
+
+	if err := app.priceCart(cart); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"cart": cart})
 }
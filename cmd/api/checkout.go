@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/GiorgosMarga/ecom_go/internal/payment"
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (app *application) registerCheckoutRoutes(router *gin.Engine) {
+	v1 := router.Group("/api/v1/checkout")
+	v1.POST("", app.authenticateUser(), app.checkoutHandler)
+}
+
+// checkoutHandler converts the active cart of the user into an order. The cart is
+// priced again on the server, the stock is reserved, the order and the payment intent
+// are created and the cart is closed. Checking out the same cart again returns the
+// order that was created the first time, resuming any step that didn't complete.
+func (app *application) checkoutHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	var payload models.CheckoutPayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	if payload.ShippingAddress != nil {
+		payload.ShippingAddress.Normalize()
+	}
+	if payload.BillingAddress != nil {
+		payload.BillingAddress.Normalize()
+	}
+	v := validator.NewValidator()
+	if models.ValidateCheckoutPayload(v, payload); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	order, err := app.models.Order.GetByCartId(payload.CartId)
+	switch {
+	case err == nil:
+		if order.UserId != user.UserID {
+			app.notAuthorizedError(c)
+			return
+		}
+		if order.Status == models.StatusCanceled {
+			app.conflictError(c, errors.New("the order of this cart was canceled"))
+			return
+		}
+		app.completeCheckout(c, order)
+		return
+	case !errors.Is(err, models.ErrNotFound):
+		app.internalServerError(c, err)
+		return
+	}
+
+	cart, err := app.models.Cart.Get(payload.CartId)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+	if cart.UserId != user.UserID {
+		app.notAuthorizedError(c)
+		return
+	}
+	if cart.Active != 1 {
+		app.conflictError(c, models.ErrCartClosed)
+		return
+	}
+
+	catalog, err := app.models.Variant.GetCatalog(cart.VariantIds())
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	cart.Price(catalog)
+	v.Validate(len(cart.Items) > 0, "items", "cart is empty")
+	if models.ValidateCartAvailability(v, cart); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	address, err := app.checkoutAddress(user.UserID, payload.AddressId, payload.ShippingAddress)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound) && payload.AddressId.IsZero():
+			app.failedValidationError(c, gin.H{"shipping_address": "must be provided"})
+		case errors.Is(err, models.ErrNotFound):
+			app.failedValidationError(c, gin.H{"address_id": "address not found"})
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+	// the order is billed to the address it ships to unless the payload sets another one
+	billing := address
+	if payload.BillingAddress != nil || !payload.BillingAddressId.IsZero() {
+		billing, err = app.checkoutAddress(user.UserID, payload.BillingAddressId, payload.BillingAddress)
+		if err != nil {
+			switch {
+			case errors.Is(err, models.ErrNotFound):
+				app.failedValidationError(c, gin.H{"billing_address_id": "address not found"})
+			default:
+				app.internalServerError(c, err)
+			}
+			return
+		}
+	}
+
+	order = &models.Order{
+		UserId:          user.UserID,
+		CartId:          cart.ID,
+		ShippingAddress: address,
+		BillingAddress:  billing,
+	}
+	quote, err := app.priceOrder(order, cart.OrderLines())
+	if err != nil {
+		app.pricingError(c, err)
+		return
+	}
+
+	zone, err := app.models.ShippingZone.GetForCountry(address.Country)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.failedValidationError(c, gin.H{"shipping_address": "we don't ship to " + address.Country})
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+	rate, ok := zone.Rate(payload.ShippingMethod, quote.Subtotal, quote.Weight)
+	if !ok {
+		app.failedValidationError(c, gin.H{"shipping_method": "not available for this order"})
+		return
+	}
+	order.ShippingMethod = rate.Code
+	order.ShippingCost = rate.Cost
+
+	if err := app.taxOrder(order); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	variants, err := app.models.Order.Place(order)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrOutOfStock):
+			app.conflictError(c, err)
+		case errors.Is(err, models.ErrDuplicateOrder):
+			// a concurrent checkout of the same cart won the race
+			order, err = app.models.Order.GetByCartId(cart.ID)
+			if err != nil {
+				app.internalServerError(c, err)
+				return
+			}
+			app.completeCheckout(c, order)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+	for i, line := range order.Products {
+		if size := variants[i].GetSize(line.Size); size != nil {
+			app.alertLowStock(variants[i].ID, *size, size.Stock+line.Quantity)
+		}
+	}
+	app.recordOrderCreated(order, user)
+
+	app.completeCheckout(c, order)
+}
+
+// checkoutAddress returns an address of the order: the given address, the address of
+// the address book with addressId or the default address of the user.
+// The address is copied so that later edits of the address book don't change the order.
+func (app *application) checkoutAddress(userId, addressId primitive.ObjectID, given *models.Address) (*models.Address, error) {
+	if given != nil {
+		address := *given
+		return &address, nil
+	}
+
+	var saved *models.SavedAddress
+	var err error
+	if addressId.IsZero() {
+		saved, err = app.models.Address.GetDefault(userId)
+	} else {
+		saved, err = app.models.Address.Get(addressId, userId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	address := saved.Address
+	return &address, nil
+}
+
+// completeCheckout creates the payment intent of the order, if it doesn't have one yet,
+// and closes the cart. Every step is idempotent so it can be retried.
+func (app *application) completeCheckout(c *gin.Context, order *models.Order) {
+	var pi *payment.Intent
+	var err error
+
+	if order.PaymentIntentId == "" {
+		pi, err = app.payments.CreateIntent(payment.IntentParams{
+			Amount:   int64(order.Total),
+			Currency: "usd",
+			Metadata: map[string]string{"order_id": order.ID.Hex()},
+			// the provider returns the same intent if the request is retried for the same order
+			IdempotencyKey: "checkout-" + order.ID.Hex(),
+		})
+		if err != nil {
+			app.internalServerError(c, err)
+			return
+		}
+		if err := app.models.Order.SetPaymentIntent(order.ID, pi.ID); err != nil {
+			app.internalServerError(c, err)
+			return
+		}
+		order.PaymentIntentId = pi.ID
+		app.recordOrderEvent(order.ID, nil, models.OrderEvent{
+			Type:    models.OrderEventPaymentStarted,
+			Message: "Payment started",
+			Data:    map[string]any{"payment_intent_id": pi.ID, "amount": pi.Amount},
+		})
+	} else {
+		pi, err = app.payments.GetIntent(order.PaymentIntentId)
+		if err != nil {
+			app.internalServerError(c, err)
+			return
+		}
+	}
+
+	if err := app.models.Cart.Deactivate(order.CartId); err != nil && !errors.Is(err, models.ErrNotFound) {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"order": order, "client_secret": pi.ClientSecret})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckout(t *testing.T) {
+	app, _ := newTestDBApp(t)
+	shop := newTestShop(t, app)
+
+	order := shop.checkout(t, app, 2)
+	if order.Status != models.StatusPending {
+		t.Errorf("status = %d, want %d", order.Status, models.StatusPending)
+	}
+	if order.PaymentIntentId == "" {
+		t.Error("the order has no payment intent")
+	}
+	if want := 2*testPrice + testShipping; order.Total != want {
+		t.Errorf("total = %d, want %d", order.Total, want)
+	}
+
+	variant, err := app.models.Variant.GetById(shop.variant.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stock := variant.Sizes[0].Stock; stock != 8 {
+		t.Errorf("stock = %d, want 8", stock)
+	}
+
+	// checking out the same cart again returns the same order
+	var res checkoutResponse
+	payload := gin.H{"cart_id": order.CartId, "shipping_method": "standard", "shipping_address": testAddress}
+	if status := sendRequest(t, app, http.MethodPost, "/api/v1/checkout", &shop.customer, payload, &res); status != http.StatusCreated {
+		t.Fatalf("second checkout status = %d, want %d", status, http.StatusCreated)
+	}
+	if res.Order.ID != order.ID {
+		t.Errorf("second checkout order = %s, want %s", res.Order.ID.Hex(), order.ID.Hex())
+	}
+	if variant, err = app.models.Variant.GetById(shop.variant.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if stock := variant.Sizes[0].Stock; stock != 8 {
+		t.Errorf("stock after the second checkout = %d, want 8", stock)
+	}
+}
+
+func TestCheckoutOfAnotherUsersCart(t *testing.T) {
+	app, _ := newTestDBApp(t)
+	shop := newTestShop(t, app)
+
+	order := shop.checkout(t, app, 1)
+	payload := gin.H{"cart_id": order.CartId, "shipping_method": "standard", "shipping_address": testAddress}
+	if status := sendRequest(t, app, http.MethodPost, "/api/v1/checkout", &shop.admin, payload, nil); status != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestCheckedOutCartCantBeChanged(t *testing.T) {
+	app, _ := newTestDBApp(t)
+	shop := newTestShop(t, app)
+
+	order := shop.checkout(t, app, 1)
+	cart, err := app.models.Cart.Get(order.CartId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/v1/cart/" + cart.ID.Hex() + "/items"
+	payload := gin.H{"variant_id": shop.variant.ID, "size": "42", "quantity": 1}
+	if status := sendRequest(t, app, http.MethodPost, path, &shop.customer, payload, nil); status != http.StatusConflict {
+		t.Errorf("add item status = %d, want %d", status, http.StatusConflict)
+	}
+	path += "/" + cart.Items[0].ID.Hex()
+	if status := sendRequest(t, app, http.MethodDelete, path, &shop.customer, nil, nil); status != http.StatusConflict {
+		t.Errorf("remove item status = %d, want %d", status, http.StatusConflict)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 )
 
 type config struct {
@@ -14,18 +16,52 @@ type config struct {
 	s3SecretKey string
 	bucket      string
 	stripeKey   string
+	adminEmail  string
+	// one of models.MergeSum, MergeMax, MergeKeepUser, MergeKeepGuest
+	cartMergeStrategy string
+	cartTTL           time.Duration
+	abandonedCartTime time.Duration
+	frontendURL       string
+	returnWindow      time.Duration
+	// true when catalog prices include the tax
+	pricesIncludeTax bool
+	// printed on invoices and credit notes
+	sellerName      string
+	sellerAddress   string
+	sellerVATNumber string
+	// signs the events sent to the Stripe webhook
+	webhookSecret string
+	// stripe, or fake to run without a payment provider
+	paymentProvider string
+	idempotencyTTL  time.Duration
+	// unpaid orders are canceled after this long and their stock put back
+	pendingOrderTTL time.Duration
 }
 
 func NewConfig() *config {
 	return &config{
-		port:        readENV("PORT", "8080"),
-		mongoURI:    readENV("ECOMGO_URI", ""),
-		jwtSecret:   []byte(readENV("JWT_SECRET", "secret")),
-		ginMode:     readENV("GIN_MODE", "debug"),
-		s3AccessKey: readENV("S3_ACCESS_KEY", ""),
-		s3SecretKey: readENV("S3_SECRET_KEY", ""),
-		bucket:      readENV("BUCKET_NAME", "shoewiz"),
-		stripeKey:   readENV("STRIPE_KEY", ""),
+		port:              readENV("PORT", "8080"),
+		mongoURI:          readENV("ECOMGO_URI", ""),
+		jwtSecret:         []byte(readENV("JWT_SECRET", "secret")),
+		ginMode:           readENV("GIN_MODE", "debug"),
+		s3AccessKey:       readENV("S3_ACCESS_KEY", ""),
+		s3SecretKey:       readENV("S3_SECRET_KEY", ""),
+		bucket:            readENV("BUCKET_NAME", "shoewiz"),
+		stripeKey:         readENV("STRIPE_KEY", ""),
+		webhookSecret:     readENV("STRIPE_WEBHOOK_SECRET", ""),
+		paymentProvider:   readENV("PAYMENT_PROVIDER", "stripe"),
+		idempotencyTTL:    time.Duration(readIntENV("IDEMPOTENCY_TTL_HOURS", 24)) * time.Hour,
+		pendingOrderTTL:   time.Duration(readIntENV("PENDING_ORDER_MINUTES", 60)) * time.Minute,
+		adminEmail:        readENV("ADMIN_EMAIL", "admin@shoewiz.com"),
+		cartMergeStrategy: readENV("CART_MERGE_STRATEGY", "sum"),
+		cartTTL:           time.Duration(readIntENV("CART_TTL_HOURS", 24*30)) * time.Hour,
+		abandonedCartTime: time.Duration(readIntENV("ABANDONED_CART_HOURS", 24)) * time.Hour,
+		frontendURL:       readENV("FRONTEND_URL", "http://localhost:3000"),
+		returnWindow:      time.Duration(readIntENV("RETURN_WINDOW_DAYS", 30)) * 24 * time.Hour,
+		pricesIncludeTax:  readBoolENV("PRICES_INCLUDE_TAX", false),
+		sellerName:        readENV("SELLER_NAME", "ShoeWiz"),
+		sellerAddress:     readENV("SELLER_ADDRESS", ""),
+		sellerVATNumber:   readENV("SELLER_VAT_NUMBER", ""),
 	}
 }
 
@@ -37,3 +73,21 @@ func readENV(key, defaultVal string) string {
 	fmt.Printf("Read successfully: %s\n", key)
 	return value
 }
+
+func readIntENV(key string, defaultVal int) int {
+	value, err := strconv.Atoi(readENV(key, strconv.Itoa(defaultVal)))
+	if err != nil {
+		fmt.Printf("Invalid value for %s, using %d\n", key, defaultVal)
+		return defaultVal
+	}
+	return value
+}
+
+func readBoolENV(key string, defaultVal bool) bool {
+	value, err := strconv.ParseBool(readENV(key, strconv.FormatBool(defaultVal)))
+	if err != nil {
+		fmt.Printf("Invalid value for %s, using %t\n", key, defaultVal)
+		return defaultVal
+	}
+	return value
+}
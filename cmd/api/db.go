@@ -2,12 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"time"
 
+	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
+var errNoReplicaSet = errors.New("mongo must run as a replica set or a sharded cluster, checkouts and invoices run in transactions: start mongod with --replSet")
+
+// connectDB connects to mongo and checks that it supports transactions, which need a
+// replica set or a sharded cluster. A single node replica set is enough.
 func connectDB(cfg config) (*mongo.Database, error) {
 	client, err := mongo.Connect(options.Client().ApplyURI(cfg.mongoURI))
 	if err != nil {
@@ -20,5 +26,18 @@ func connectDB(cfg config) (*mongo.Database, error) {
 		return nil, err
 	}
 
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err = client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return nil, err
+	}
+	// mongos answers with isdbgrid
+	if hello.SetName == "" && hello.Msg != "isdbgrid" {
+		return nil, errNoReplicaSet
+	}
+
 	return client.Database("ecomgo_catbreathe", nil), err
 }
@@ -51,3 +51,12 @@ func (app *application) wrongCredentialsError(c *gin.Context) {
 	msg := "wrong credentials"
 	app.sendError(c, http.StatusUnauthorized, msg)
 }
+
+func (app *application) conflictError(c *gin.Context, err error) {
+	app.sendError(c, http.StatusConflict, err.Error())
+}
+
+func (app *application) requestTooLargeError(c *gin.Context, limit int64) {
+	msg := fmt.Sprintf("the request body must not be larger than %d bytes", limit)
+	app.sendError(c, http.StatusRequestEntityTooLarge, msg)
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/url"
+	"strconv"
 	"time"
 
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
 	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -90,6 +98,89 @@ func (app *application) verifyToken(token string) (*jwt.Token, error) {
 	return t, nil
 }
 
+const (
+	guestCartCookie   = "guest_cart"
+	guestCartAudience = "guest_cart"
+	guestCartTTL      = 30 * 24 * time.Hour
+)
+
+// createGuestCartToken signs the id of a guest cart so that it can be stored
+// in a cookie without letting anyone guess the carts of other shoppers
+func (app *application) createGuestCartToken(cartId primitive.ObjectID) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(guestCartTTL)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		Issuer:    "goecom",
+		Audience:  jwt.ClaimStrings{guestCartAudience},
+		Subject:   cartId.Hex(),
+	})
+	return token.SignedString(app.cfg.jwtSecret)
+}
+
+func (app *application) setGuestCartCookie(c *gin.Context, cartId primitive.ObjectID) error {
+	token, err := app.createGuestCartToken(cartId)
+	if err != nil {
+		return err
+	}
+	c.SetCookie(guestCartCookie, token, int(guestCartTTL.Seconds()), "/", "localhost", false, true)
+	return nil
+}
+
+func (app *application) clearGuestCartCookie(c *gin.Context) {
+	c.SetCookie(guestCartCookie, "", -1, "/", "localhost", false, true)
+}
+
+// readGuestCartId returns the id of the guest cart of the request or NilObjectID
+// if there is no cookie or its signature is invalid
+func (app *application) readGuestCartId(c *gin.Context) primitive.ObjectID {
+	cookie, err := c.Cookie(guestCartCookie)
+	if err != nil || cookie == "" {
+		return primitive.NilObjectID
+	}
+	claims := &jwt.RegisteredClaims{}
+	t, err := jwt.ParseWithClaims(cookie, claims, func(t *jwt.Token) (interface{}, error) {
+		return app.cfg.jwtSecret, nil
+	}, jwt.WithAudience(guestCartAudience), jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !t.Valid {
+		return primitive.NilObjectID
+	}
+	id, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return primitive.NilObjectID
+	}
+	return id
+}
+
+const cartRecoveryAudience = "cart_recovery"
+
+// createCartRecoveryToken signs the id of an abandoned cart for the recovery link.
+// The token lives as long as the cart itself.
+func (app *application) createCartRecoveryToken(cartId primitive.ObjectID) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(app.cfg.cartTTL)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		Issuer:    "goecom",
+		Audience:  jwt.ClaimStrings{cartRecoveryAudience},
+		Subject:   cartId.Hex(),
+	})
+	return token.SignedString(app.cfg.jwtSecret)
+}
+
+func (app *application) readCartRecoveryToken(token string) (primitive.ObjectID, error) {
+	claims := &jwt.RegisteredClaims{}
+	t, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		return app.cfg.jwtSecret, nil
+	}, jwt.WithAudience(cartRecoveryAudience), jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !t.Valid {
+		return primitive.NilObjectID, ErrInvalidJWT
+	}
+	id, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return primitive.NilObjectID, ErrInvalidJWT
+	}
+	return id, nil
+}
+
 func GetUser(c *gin.Context) (*models.UserInfo, error) {
 	val, ok := c.Get("user")
 	if !ok {
@@ -100,7 +191,11 @@ func GetUser(c *gin.Context) (*models.UserInfo, error) {
 }
 
 func ReadIdParam(c *gin.Context) primitive.ObjectID {
-	val := c.Param("id")
+	return ReadObjectIdParam(c, "id")
+}
+
+func ReadObjectIdParam(c *gin.Context, key string) primitive.ObjectID {
+	val := c.Param(key)
 	if val == "" {
 		return primitive.NilObjectID
 	}
@@ -110,3 +205,120 @@ func ReadIdParam(c *gin.Context) primitive.ObjectID {
 	}
 	return id
 }
+
+// runs fn in a separate goroutine and recovers from any panic so that
+// a failing background job doesn't bring the server down
+func (app *application) background(fn func()) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Println(fmt.Errorf("background job panicked: %v", err))
+			}
+		}()
+		fn()
+	}()
+}
+
+func readString(qs url.Values, key string, defaultValue string) string {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	return s
+}
+
+func readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return defaultValue
+	}
+	return i
+}
+
+// readOptionalInt returns nil if the key is missing from the query string
+func readOptionalInt(qs url.Values, key string, v *validator.Validator) *int {
+	if qs.Get(key) == "" {
+		return nil
+	}
+	i := readInt(qs, key, 0, v)
+	return &i
+}
+
+// readTime accepts either a RFC3339 timestamp or a plain date
+func readTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return &t
+		}
+	}
+	v.AddError(key, "must be a date (YYYY-MM-DD) or a RFC3339 timestamp")
+	return nil
+}
+
+// readEndTime reads the end of a time range like readTime. A plain date covers the
+// whole day, so it is returned as the start of the next day and exclusive is true.
+func readEndTime(qs url.Values, key string, v *validator.Validator) (t *time.Time, exclusive bool) {
+	if d, err := time.Parse(time.DateOnly, qs.Get(key)); err == nil {
+		end := d.AddDate(0, 0, 1)
+		return &end, true
+	}
+	return readTime(qs, key, v), false
+}
+
+func readObjectId(qs url.Values, key string, v *validator.Validator) primitive.ObjectID {
+	s := qs.Get(key)
+	if s == "" {
+		return primitive.NilObjectID
+	}
+	id, err := primitive.ObjectIDFromHex(s)
+	if err != nil {
+		v.AddError(key, "invalid id")
+	}
+	return id
+}
+
+// readOrderRef reads an order ObjectID or order number.
+func readOrderRef(qs url.Values, key string, v *validator.Validator) *models.OrderRef {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+	ref, err := models.ParseOrderRef(s)
+	if err != nil {
+		v.AddError(key, "must be an order id or number")
+		return nil
+	}
+	return &ref
+}
+
+// uploadFile stores the file in the bucket under key and returns its location.
+func (app *application) uploadFile(file *multipart.FileHeader, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	f, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	result, err := app.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:      &app.cfg.bucket,
+		Key:         aws.String(key),
+		Body:        f,
+		ContentType: aws.String(file.Header.Get("Content-Type")),
+	})
+	if err != nil {
+		return "", err
+	}
+	return result.Location, nil
+}
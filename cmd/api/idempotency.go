@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/gin-gonic/gin"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotentBodyBytes bounds the bodies the idempotency middleware reads before the
+// handlers do, it leaves room for the photo of a return.
+const maxIdempotentBodyBytes = maxReturnPhotoSize + 1<<20
+
+var errIdempotencyKeyTooLong = errors.New("the idempotency key must not be more than 255 bytes long")
+
+// replayedHeaders are the headers of a response that are stored and replayed with it,
+// the ones the client acts on besides the body.
+var replayedHeaders = []string{"Location", "Set-Cookie"}
+
+// responseRecorder keeps a copy of the body of the response it writes.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotency makes POST and PATCH requests that come with an Idempotency-Key header
+// safe to retry. The first request with a key is handled and its response stored,
+// retries get the stored response back without the request being handled again. A
+// key is scoped to the user that sent it, or to the guest cart of a guest, and reusing
+// it for a different request is rejected. Guests without a guest cart have nothing to
+// scope the key to, so their keys are ignored. Server errors aren't stored, so those
+// requests can be retried for real.
+func (app *application) idempotency() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyKeyHeader)
+		method := c.Request.Method
+		if key == "" || (method != http.MethodPost && method != http.MethodPatch) {
+			c.Next()
+			return
+		}
+		if len(key) > 255 {
+			app.badRequestError(c, errIdempotencyKeyTooLong)
+			c.Abort()
+			return
+		}
+
+		var scope string
+		if user, err := app.userFromRequest(c); err == nil {
+			scope = user.UserID.Hex()
+		} else if guestCartId := app.readGuestCartId(c); !guestCartId.IsZero() {
+			scope = "guest:" + guestCartId.Hex()
+		} else {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxIdempotentBodyBytes))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				app.requestTooLargeError(c, tooLarge.Limit)
+			} else {
+				app.badRequestError(c, err)
+			}
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		id := hash([]byte(scope), []byte(key))
+		fingerprint := hash([]byte(method), []byte(c.Request.URL.RequestURI()), body)
+
+		prev, err := app.models.Idempotency.Begin(id, fingerprint)
+		if err != nil {
+			switch {
+			case errors.Is(err, models.ErrIdempotencyKeyReused):
+				app.failedValidationError(c, gin.H{"idempotency_key": err.Error()})
+			case errors.Is(err, models.ErrIdempotencyKeyInProgress):
+				app.conflictError(c, err)
+			default:
+				app.internalServerError(c, err)
+			}
+			c.Abort()
+			return
+		}
+		if prev != nil {
+			for name, values := range prev.Headers {
+				for _, value := range values {
+					c.Writer.Header().Add(name, value)
+				}
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(prev.Status, prev.ContentType, prev.Body)
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		completed := false
+		// a request that panics or fails can be retried
+		defer func() {
+			if completed {
+				return
+			}
+			if err := app.models.Idempotency.Release(id); err != nil {
+				app.logError(c, err)
+			}
+		}()
+
+		c.Next()
+
+		status := recorder.Status()
+		if status >= http.StatusInternalServerError {
+			return
+		}
+		headers := make(map[string][]string)
+		for _, name := range replayedHeaders {
+			if values := recorder.Header().Values(name); len(values) > 0 {
+				headers[name] = values
+			}
+		}
+		if err := app.models.Idempotency.Complete(id, status, recorder.Header().Get("Content-Type"), headers, recorder.body.Bytes()); err != nil {
+			app.logError(c, err)
+			return
+		}
+		completed = true
+	}
+}
+
+// hash returns the hex SHA-256 of the parts, separated so that moving bytes from one
+// part to the next changes the hash.
+func hash(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GiorgosMarga/ecom_go/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestIdempotencyRejectsLargeBody(t *testing.T) {
+	app, _ := newTestApp(t)
+	token, err := app.createAccessToken(models.User{ID: primitive.NewObjectID(), Role: models.GetRole(models.UserRole)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := bytes.Repeat([]byte(" "), maxIdempotentBodyBytes+1)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/checkout", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(idempotencyKeyHeader, "key-1")
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
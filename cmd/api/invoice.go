@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/GiorgosMarga/ecom_go/internal/invoice"
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var errOrderNotPaid = errors.New("the order hasn't been paid yet")
+
+func (app *application) registerInvoiceRoutes(router *gin.Engine) {
+	orders := router.Group("/api/v1/orders", app.authenticateUser())
+	orders.GET("/:id/invoice", app.getInvoiceHandler)
+	orders.GET("/:id/credit-notes", app.listCreditNotesHandler)
+	orders.GET("/:id/credit-notes/:noteId", app.getCreditNoteHandler)
+}
+
+// issueInvoice issues the invoice of a paid order and stores its PDF. An order has one
+// invoice, issuing it again returns the one that exists.
+func (app *application) issueInvoice(order *models.Order) (*models.Invoice, error) {
+	inv := models.NewInvoice(order)
+	if err := app.models.Invoice.Insert(inv); err != nil {
+		if !errors.Is(err, models.ErrDuplicateInvoice) {
+			return nil, err
+		}
+		if inv, err = app.models.Invoice.GetForOrder(order.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := app.storeInvoicePDF(inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// issueCreditNote issues the credit note of a refund of the order. quantities are the
+// refunded quantities per order line, nil when the refund isn't tied to lines. A refund
+// has one credit note, issuing it again returns the one that exists.
+func (app *application) issueCreditNote(order *models.Order, refundId string, amount int, quantities map[primitive.ObjectID]int) (*models.Invoice, error) {
+	note := models.NewCreditNote(order, refundId, amount, quantities)
+	if err := app.models.Invoice.Insert(note); err != nil {
+		if !errors.Is(err, models.ErrDuplicateInvoice) {
+			return nil, err
+		}
+		if note, err = app.models.Invoice.GetByRefund(refundId); err != nil {
+			return nil, err
+		}
+	}
+	if err := app.storeInvoicePDF(note); err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+// issueInBackground issues the document off the request. A failure only delays it: an
+// invoice is issued when it is first downloaded and a credit note by the credit note job.
+func (app *application) issueInBackground(issue func() (*models.Invoice, error)) {
+	app.background(func() {
+		if _, err := issue(); err != nil {
+			app.logger.Println(fmt.Errorf("issuing invoice: %w", err))
+		}
+	})
+}
+
+// storeInvoicePDF renders the document and uploads it, unless that was done already.
+func (app *application) storeInvoicePDF(inv *models.Invoice) error {
+	if inv.PDFKey != "" {
+		return nil
+	}
+	seller := invoice.Seller{
+		Name:      app.cfg.sellerName,
+		Address:   app.cfg.sellerAddress,
+		VATNumber: app.cfg.sellerVATNumber,
+	}
+	pdf, err := invoice.Render(inv, seller)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	key := "invoices/" + inv.DisplayNumber + ".pdf"
+	_, err = app.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:      &app.cfg.bucket,
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(pdf),
+		ContentType: aws.String("application/pdf"),
+	})
+	if err != nil {
+		return err
+	}
+	if err := app.models.Invoice.SetPDF(inv.ID, key); err != nil {
+		return err
+	}
+	inv.PDFKey = key
+	return nil
+}
+
+// sendInvoicePDF streams the PDF of the document from the bucket.
+func (app *application) sendInvoicePDF(c *gin.Context, inv *models.Invoice) {
+	if err := app.storeInvoicePDF(inv); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	obj, err := app.storage.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &app.cfg.bucket,
+		Key:    aws.String(inv.PDFKey),
+	})
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	defer obj.Body.Close()
+
+	headers := map[string]string{
+		"Content-Disposition": fmt.Sprintf(`attachment; filename="%s.pdf"`, inv.DisplayNumber),
+	}
+	c.DataFromReader(http.StatusOK, aws.ToInt64(obj.ContentLength), "application/pdf", obj.Body, headers)
+}
+
+// getInvoiceHandler returns the PDF invoice of the order to its owner or to an admin.
+func (app *application) getInvoiceHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	order := app.readOwnedOrder(c, user)
+	if order == nil {
+		return
+	}
+	if !order.IsPaid() {
+		app.conflictError(c, errOrderNotPaid)
+		return
+	}
+
+	inv, err := app.models.Invoice.GetForOrder(order.ID)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) {
+			app.internalServerError(c, err)
+			return
+		}
+		// the invoice failed to be issued when the order was paid
+		if inv, err = app.issueInvoice(order); err != nil {
+			app.internalServerError(c, err)
+			return
+		}
+	}
+
+	app.sendInvoicePDF(c, inv)
+}
+
+func (app *application) listCreditNotesHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	order := app.readOwnedOrder(c, user)
+	if order == nil {
+		return
+	}
+
+	notes, err := app.models.Invoice.GetCreditNotes(order.ID)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"credit_notes": notes})
+}
+
+// getCreditNoteHandler returns the PDF of a credit note of the order.
+func (app *application) getCreditNoteHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	order := app.readOwnedOrder(c, user)
+	if order == nil {
+		return
+	}
+
+	noteId := ReadObjectIdParam(c, "noteId")
+	if noteId.IsZero() {
+		app.badRequestError(c, models.ErrInvalidID)
+		return
+	}
+	note, err := app.models.Invoice.Get(noteId)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+	if note.OrderId != order.ID || note.Type != models.InvoiceTypeCreditNote {
+		app.notFoundError(c)
+		return
+	}
+
+	app.sendInvoicePDF(c, note)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/GiorgosMarga/ecom_go/internal/payment"
+	"github.com/GiorgosMarga/ecom_go/models"
+)
+
+const (
+	abandonedCartJobInterval = 15 * time.Minute
+	pendingOrderJobInterval  = 5 * time.Minute
+	creditNoteJobInterval    = 15 * time.Minute
+	stuckRefundJobInterval   = 15 * time.Minute
+)
+
+// pendingOrderRetryInterval is how long the pending order job waits before it looks
+// again at an order it had to leave as it was.
+const pendingOrderRetryInterval = 30 * time.Minute
+
+// startAbandonedCartJob periodically looks for carts that haven't been touched for
+// cfg.abandonedCartTime and still contain items that can be bought, and emits an
+// abandoned cart event with a link that reopens the cart. Carts that stay untouched
+// for cfg.cartTTL are deactivated so that they expire.
+func (app *application) startAbandonedCartJob() {
+	app.background(func() {
+		ticker := time.NewTicker(abandonedCartJobInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			app.reportAbandonedCarts()
+			if err := app.models.Cart.DeactivateIdle(time.Now().Add(-app.cfg.cartTTL)); err != nil {
+				app.logger.Println(err)
+			}
+		}
+	})
+}
+
+// reportAbandonedCarts goes through the abandoned carts one batch at a time. Carts
+// with nothing in stock and carts of users that are gone are marked as reported so
+// that they are skipped until they are updated again, carts that failed for other
+// reasons are retried on the next run.
+func (app *application) reportAbandonedCarts() {
+	const batch = 100
+	before := time.Now().Add(-app.cfg.abandonedCartTime)
+	var after *models.Cart
+	for {
+		carts, err := app.models.Cart.GetAbandoned(before, after, batch)
+		if err != nil {
+			app.logger.Println(err)
+			return
+		}
+		for i := range carts {
+			app.reportAbandonedCart(&carts[i])
+		}
+		if len(carts) < batch {
+			return
+		}
+		after = &carts[len(carts)-1]
+	}
+}
+
+func (app *application) reportAbandonedCart(cart *models.Cart) {
+	if err := app.priceCart(cart); err != nil {
+		app.logger.Println(err)
+		return
+	}
+	inStock := false
+	for _, item := range cart.Items {
+		if item.Available && !item.OutOfStock {
+			inStock = true
+			break
+		}
+	}
+	if !inStock {
+		app.skipAbandonedCart(cart)
+		return
+	}
+
+	user, err := app.models.User.GetByID(cart.UserId.Hex())
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			app.skipAbandonedCart(cart)
+			return
+		}
+		app.logger.Println(err)
+		return
+	}
+	token, err := app.createCartRecoveryToken(cart.ID)
+	if err != nil {
+		app.logger.Println(err)
+		return
+	}
+	// another instance may have reported the cart or the user may have just updated it
+	if err := app.models.Cart.MarkAbandoned(cart); err != nil {
+		return
+	}
+
+	link := fmt.Sprintf("%s/cart/recover?token=%s", app.cfg.frontendURL, url.QueryEscape(token))
+	app.notify(notification{
+		Kind:    notificationAbandoned,
+		To:      user.Email,
+		Subject: "You left something in your cart",
+		Body:    fmt.Sprintf("your cart is waiting for you, total %d: %s", cart.Total, link),
+	})
+}
+
+// skipAbandonedCart marks a cart that can't be reported as reported, without notifying
+// anyone, so that the job doesn't look at it again until it is updated.
+func (app *application) skipAbandonedCart(cart *models.Cart) {
+	if err := app.models.Cart.MarkAbandoned(cart); err != nil && !errors.Is(err, models.ErrNotFound) {
+		app.logger.Println(err)
+	}
+}
+
+// startPendingOrderJob periodically cancels the orders that haven't been paid within
+// cfg.pendingOrderTTL and puts back the stock they reserved at checkout.
+func (app *application) startPendingOrderJob() {
+	app.background(func() {
+		ticker := time.NewTicker(pendingOrderJobInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			app.expirePendingOrders()
+		}
+	})
+}
+
+func (app *application) expirePendingOrders() {
+	now := time.Now()
+	orders, err := app.models.Order.GetHoldingStock(now.Add(-app.cfg.pendingOrderTTL), now.Add(-pendingOrderRetryInterval), 100)
+	if err != nil {
+		app.logger.Println(err)
+		return
+	}
+
+	for i := range orders {
+		order := &orders[i]
+		if !app.expireOrder(order) {
+			// payments under way and failures are looked at again after the retry
+			// interval, the other orders go first
+			if err := app.models.Order.SetExpiryChecked(order.ID); err != nil {
+				app.logger.Println(err)
+			}
+		}
+	}
+}
+
+// expireOrder cancels a pending order and puts its stock back, it reports whether the
+// order is done with.
+func (app *application) expireOrder(order *models.Order) bool {
+	if order.Status == models.StatusPending {
+		canceled, err := app.expirePendingOrder(order)
+		if err != nil {
+			app.logger.Println(err)
+			return false
+		}
+		if !canceled {
+			return false
+		}
+	}
+	// canceled orders that failed to restock before are retried too
+	if order.Cancellation == nil {
+		return true
+	}
+	if err := app.restockCanceledOrder(order); err != nil {
+		app.logger.Println(err)
+		return false
+	}
+	return true
+}
+
+// expirePendingOrder cancels an unpaid order. Its payment intent is canceled first so
+// that the customer can't pay the order once it is canceled. Orders whose payment
+// went through or is under way are left to the webhook, it reports whether the order
+// was canceled.
+func (app *application) expirePendingOrder(order *models.Order) (bool, error) {
+	if order.PaymentIntentId != "" {
+		_, err := app.payments.CancelIntent(order.PaymentIntentId)
+		switch {
+		case errors.Is(err, payment.ErrNotCancelable):
+			return false, nil
+		case err != nil && !errors.Is(err, payment.ErrUnknownIntent):
+			return false, err
+		}
+	}
+
+	reason := "the order wasn't paid in time"
+	change := models.StatusChange{From: order.Status, ActorRole: models.GetRole(models.SystemRole)}
+	if err := app.models.Order.Cancel(order, change, reason); err != nil {
+		if errors.Is(err, models.ErrInvalidTransition) {
+			// paid or canceled in the meantime
+			return false, nil
+		}
+		return false, err
+	}
+	app.recordOrderEvent(order.ID, nil, models.OrderEvent{
+		Type:    models.OrderEventStatusChanged,
+		Message: "Order canceled: " + reason,
+		Data:    map[string]any{"from": change.From, "to": models.StatusCanceled, "reason": reason},
+	})
+	return true, nil
+}
+
+// startCreditNoteJob periodically issues the credit notes of succeeded refunds that
+// failed to be issued when the refund was made.
+func (app *application) startCreditNoteJob() {
+	app.background(func() {
+		ticker := time.NewTicker(creditNoteJobInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			app.issueMissingCreditNotes()
+		}
+	})
+}
+
+func (app *application) issueMissingCreditNotes() {
+	// the credit notes of refunds that just succeeded may still be issued in the background
+	orders, err := app.models.Order.GetMissingCreditNotes(time.Now().Add(-creditNoteJobInterval), 100)
+	if err != nil {
+		app.logger.Println(err)
+		return
+	}
+
+	for i := range orders {
+		order := &orders[i]
+		for _, r := range order.Refunds {
+			if r.Status != models.RefundSucceeded || r.CreditNoteIssued {
+				continue
+			}
+			if _, err := app.issueRefundCreditNote(order, r); err != nil {
+				app.logger.Println(fmt.Errorf("issuing credit note: %w", err))
+			}
+		}
+	}
+}
+
+// startStuckRefundJob periodically makes again the refunds that are pending because the
+// provider didn't answer, they reuse their idempotency key so none is made twice.
+// Refunds that the provider left pending are completed by the refund.updated webhook.
+func (app *application) startStuckRefundJob() {
+	app.background(func() {
+		ticker := time.NewTicker(stuckRefundJobInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			app.resumeStuckRefunds()
+		}
+	})
+}
+
+func (app *application) resumeStuckRefunds() {
+	// refunds that were just reserved may still be waiting for the provider
+	orders, err := app.models.Order.GetStuckRefunds(time.Now().Add(-stuckRefundJobInterval), 100)
+	if err != nil {
+		app.logger.Println(err)
+		return
+	}
+
+	for i := range orders {
+		order := &orders[i]
+		for _, r := range order.Refunds {
+			if r.Status != models.RefundPending || r.ProviderRefundId != "" {
+				continue
+			}
+			if err := app.resumeRefund(order, r); err != nil {
+				app.logger.Println(fmt.Errorf("resuming refund %s: %w", r.ID.Hex(), err))
+			}
+		}
+	}
+}
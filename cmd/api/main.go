@@ -6,18 +6,25 @@ import (
 	"log"
 	"os"
 
+	"github.com/GiorgosMarga/ecom_go/internal/payment"
+	"github.com/GiorgosMarga/ecom_go/internal/pricing"
+	"github.com/GiorgosMarga/ecom_go/internal/tax"
 	"github.com/GiorgosMarga/ecom_go/models"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/stripe/stripe-go/v81"
 )
 
 type application struct {
-	cfg      *config
-	logger   *log.Logger
-	models   models.Models
-	uploader *manager.Uploader
+	cfg           *config
+	logger        *log.Logger
+	models        models.Models
+	uploader      *manager.Uploader
+	storage       *s3.Client
+	notifications chan notification
+	pricing       *pricing.Service
+	tax           *tax.Engine
+	payments      payment.Provider
 }
 
 func main() {
@@ -28,7 +35,6 @@ func main() {
 		logger.Fatal(err)
 	}
 
-	stripe.Key = cfg.stripeKey
 	defer func() {
 		fmt.Println("Disconnecting from DB")
 		if err := db.Client().Disconnect(context.Background()); err != nil {
@@ -43,14 +49,32 @@ func main() {
 	}
 	logger.Println("Successfully conneected to the S3")
 
-	uploader := manager.NewUploader(s3.NewFromConfig(awsCfg))
+	storage := s3.NewFromConfig(awsCfg)
+	uploader := manager.NewUploader(storage)
+
+	m := models.NewModels(db)
+	if err := m.CreateIndexes(models.IndexConfig{CartTTL: cfg.cartTTL, IdempotencyTTL: cfg.idempotencyTTL}); err != nil {
+		logger.Fatal(err)
+	}
 
 	app := &application{
-		cfg:      cfg,
-		logger:   logger,
-		models:   models.NewModels(db),
-		uploader: uploader,
+		cfg:           cfg,
+		logger:        logger,
+		models:        m,
+		uploader:      uploader,
+		storage:       storage,
+		notifications: make(chan notification, 100),
+		pricing:       pricing.New(m.Variant),
+		tax:           tax.New(m.TaxRate, cfg.pricesIncludeTax),
+	}
+	if app.payments, err = app.newPaymentProvider(); err != nil {
+		logger.Fatal(err)
 	}
+	app.startNotifier()
+	app.startAbandonedCartJob()
+	app.startPendingOrderJob()
+	app.startCreditNoteJob()
+	app.startStuckRefundJob()
 	if err := app.run(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/GiorgosMarga/ecom_go/internal/payment"
+	"github.com/GiorgosMarga/ecom_go/internal/pricing"
+	"github.com/GiorgosMarga/ecom_go/internal/tax"
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// testDBEnv points the tests that need a database to a mongo replica set, checkouts and
+// invoices run in transactions. Every test gets a database of its own that is dropped
+// when it ends. Without it those tests are skipped.
+const testDBEnv = "ECOMGO_TEST_URI"
+
+// newTestApp returns an app that uses the fake payment provider, without a database.
+// Its webhook events are processed in process, when the fake sends them.
+func newTestApp(t *testing.T) (*application, *payment.Fake) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	app := &application{
+		cfg: &config{
+			jwtSecret:       []byte("test-secret"),
+			ginMode:         gin.TestMode,
+			webhookSecret:   "whsec_test",
+			paymentProvider: "fake",
+			cartTTL:         time.Hour,
+			idempotencyTTL:  time.Hour,
+			pendingOrderTTL: time.Hour,
+		},
+		logger:        log.New(io.Discard, "", 0),
+		notifications: make(chan notification, 100),
+	}
+	provider, err := app.newPaymentProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.payments = provider
+	return app, provider.(*payment.Fake)
+}
+
+// newTestDBApp is newTestApp with a database.
+func newTestDBApp(t *testing.T) (*application, *payment.Fake) {
+	t.Helper()
+	uri := os.Getenv(testDBEnv)
+	if uri == "" {
+		t.Skip(testDBEnv + " isn't set")
+	}
+
+	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database("ecomgo_test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := db.Drop(ctx); err != nil {
+			t.Log(err)
+		}
+		if err := client.Disconnect(ctx); err != nil {
+			t.Log(err)
+		}
+	})
+
+	app, fake := newTestApp(t)
+	app.models = models.NewModels(db)
+	if err := app.models.CreateIndexes(models.IndexConfig{CartTTL: app.cfg.cartTTL, IdempotencyTTL: app.cfg.idempotencyTTL}); err != nil {
+		t.Fatal(err)
+	}
+	app.pricing = pricing.New(app.models.Variant)
+	app.tax = tax.New(app.models.TaxRate, false)
+	return app, fake
+}
+
+// testShop is a catalog with one product, a zone that ships to Greece for a flat
+// rate, a customer and an admin.
+type testShop struct {
+	variant  *models.Variant
+	customer models.User
+	admin    models.User
+}
+
+const (
+	testPrice    = 5000
+	testShipping = 500
+)
+
+var testAddress = models.Address{
+	Name:       "Maria Papadopoulou",
+	Line1:      "Ermou 10",
+	City:       "Athens",
+	PostalCode: "105 63",
+	Country:    "GR",
+	Phone:      "+302101234567",
+}
+
+func newTestShop(t *testing.T, app *application) *testShop {
+	t.Helper()
+
+	product := &models.Product{Name: "Runner", Price: testPrice, Weight: 800}
+	if err := app.models.Product.Insert(product); err != nil {
+		t.Fatal(err)
+	}
+	variant := &models.Variant{
+		ProductId: product.ID,
+		Color:     "red",
+		Sizes:     []models.SizesAndStock{{Size: "42", SKU: "RUN-RED-42", Stock: 10}},
+	}
+	if err := app.models.Variant.Insert(variant); err != nil {
+		t.Fatal(err)
+	}
+	zone := &models.ShippingZone{
+		Name:      "Greece",
+		Countries: []string{"GR"},
+		Methods:   []models.ShippingMethod{{Code: "standard", Name: "Standard", RateType: models.RateFlat, Price: testShipping}},
+	}
+	if err := app.models.ShippingZone.Insert(zone); err != nil {
+		t.Fatal(err)
+	}
+
+	return &testShop{
+		variant:  variant,
+		customer: models.User{ID: primitive.NewObjectID(), Email: "maria@example.com", Role: models.GetRole(models.UserRole)},
+		admin:    models.User{ID: primitive.NewObjectID(), Email: "admin@example.com", Role: models.GetRole(models.AdminRole)},
+	}
+}
+
+// checkoutResponse is the response of the checkout endpoint.
+type checkoutResponse struct {
+	Order        models.Order `json:"order"`
+	ClientSecret string       `json:"client_secret"`
+}
+
+// checkout fills the cart of the customer with quantity items and checks it out.
+func (s *testShop) checkout(t *testing.T, app *application, quantity int) *models.Order {
+	t.Helper()
+
+	cart, err := app.models.Cart.GetActiveForUser(s.customer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := models.CartItem{
+		ID:         primitive.NewObjectID(),
+		VariantId:  s.variant.ID,
+		Size:       "42",
+		Quantity:   quantity,
+		AddedPrice: testPrice,
+		AddedAt:    time.Now(),
+	}
+	if _, err := app.models.Cart.AddItem(cart.ID, item); err != nil {
+		t.Fatal(err)
+	}
+
+	var res checkoutResponse
+	payload := gin.H{"cart_id": cart.ID, "shipping_method": "standard", "shipping_address": testAddress}
+	if status := sendRequest(t, app, http.MethodPost, "/api/v1/checkout", &s.customer, payload, &res); status != http.StatusCreated {
+		t.Fatalf("checkout status = %d, want %d", status, http.StatusCreated)
+	}
+	return &res.Order
+}
+
+// paidOrder checks out quantity items and pays for them.
+func (s *testShop) paidOrder(t *testing.T, app *application, fake *payment.Fake, quantity int) *models.Order {
+	t.Helper()
+
+	order := s.checkout(t, app, quantity)
+	if _, err := fake.Confirm(order.PaymentIntentId); err != nil {
+		t.Fatal(err)
+	}
+	return getOrder(t, app, order.ID)
+}
+
+func getOrder(t *testing.T, app *application, id primitive.ObjectID) *models.Order {
+	t.Helper()
+
+	order, err := app.models.Order.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+// sendRequest sends a request with the JSON of body to the routes of the app,
+// authenticated as user unless it is nil, and decodes the JSON response into dst unless
+// it is nil. It returns the status of the response.
+func sendRequest(t *testing.T, app *application, method, path string, user *models.User, body, dst any) int {
+	t.Helper()
+
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if user != nil {
+		token, err := app.createAccessToken(*user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, req)
+	if dst != nil && rec.Code < http.StatusBadRequest {
+		if err := json.Unmarshal(rec.Body.Bytes(), dst); err != nil {
+			t.Fatalf("decoding %s: %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
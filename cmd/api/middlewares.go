@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"strings"
 
 	"github.com/GiorgosMarga/ecom_go/models"
@@ -12,7 +13,7 @@ func (app *application) corsMiddleware() gin.HandlerFunc {
 
 		c.Header("Access-Control-Allow-Origin", "http://localhost:3000")
 		c.Header("Access-Control-Allow-Credentials", "true")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Idempotency-Key, accept, origin, Cache-Control, X-Requested-With")
 		c.Header("Access-Control-Allow-Methods", "POST,HEAD,PATCH,OPTIONS,GET,PUT")
 
 		if c.Request.Method == "OPTIONS" {
@@ -23,45 +24,66 @@ func (app *application) corsMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
-func (app *application) authenticateUser() gin.HandlerFunc {
-	return func(c *gin.Context) {
 
-		header := c.Request.Header["Authorization"]
-		if len(header) == 0 {
-			app.notAuthenticatedError(c)
-			c.Abort()
-			return
-		}
+var errMissingAuthHeader = errors.New("missing authorization header")
 
-		authHeader := header[0]
-		if authHeader == "" {
-			app.notAuthenticatedError(c)
-			c.Abort()
-			return
-		}
-		splittedHeader := strings.Split(authHeader, " ")
-		if len(splittedHeader) != 2 {
-			app.notAuthenticatedError(c)
-			c.Abort()
-			return
-		}
-		accessToken := splittedHeader[1]
+// userFromRequest reads and verifies the access token of the Authorization header
+func (app *application) userFromRequest(c *gin.Context) (*models.UserInfo, error) {
+	header := c.Request.Header["Authorization"]
+	if len(header) == 0 || header[0] == "" {
+		return nil, errMissingAuthHeader
+	}
+
+	splittedHeader := strings.Split(header[0], " ")
+	if len(splittedHeader) != 2 {
+		return nil, ErrInvalidJWT
+	}
+	accessToken := splittedHeader[1]
+
+	jwtToken, err := app.verifyToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := jwtToken.Claims.(*models.UserTokenClaims)
+	if !ok {
+		return nil, ErrInvalidJWT
+	}
+	return &claims.UserInfo, nil
+}
 
-		jwtToken, err := app.verifyToken(accessToken)
+func (app *application) authenticateUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := app.userFromRequest(c)
 		if err != nil {
-			app.logger.Println(err.Error())
+			if !errors.Is(err, errMissingAuthHeader) {
+				app.logger.Println(err.Error())
+			}
 			app.notAuthenticatedError(c)
 			c.Abort()
 			return
 		}
+		c.Set("user", *user)
+		c.Next()
+	}
+}
 
-		claims, ok := jwtToken.Claims.(*models.UserTokenClaims)
-		if !ok {
+// optionalAuthentication is like authenticateUser but lets anonymous requests through.
+// Requests that do send a token still need a valid one.
+func (app *application) optionalAuthentication() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := app.userFromRequest(c)
+		if err != nil {
+			if errors.Is(err, errMissingAuthHeader) {
+				c.Next()
+				return
+			}
+			app.logger.Println(err.Error())
 			app.notAuthenticatedError(c)
 			c.Abort()
 			return
 		}
-		c.Set("user", claims.UserInfo)
+		c.Set("user", *user)
 		c.Next()
 	}
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/GiorgosMarga/ecom_go/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	notificationLowStock    = "low_stock"
+	notificationBackInStock = "back_in_stock"
+	notificationAbandoned   = "abandoned_cart"
+)
+
+type notification struct {
+	Kind    string
+	To      string
+	Subject string
+	Body    string
+}
+
+// notify queues a notification for delivery. It never blocks the caller,
+// if the queue is full the notification is dropped and logged.
+func (app *application) notify(n notification) {
+	select {
+	case app.notifications <- n:
+	default:
+		app.logger.Printf("notification queue is full, dropping %s notification for %s\n", n.Kind, n.To)
+	}
+}
+
+// startNotifier consumes the notification channel. There is no mail provider
+// yet, so notifications are delivered to the log.
+func (app *application) startNotifier() {
+	app.background(func() {
+		for n := range app.notifications {
+			app.logger.Printf("notification [%s] to=%s subject=%q body=%q\n", n.Kind, n.To, n.Subject, n.Body)
+		}
+	})
+}
+
+// checkStockLevels compares the stock of a variant before and after an update.
+// Sizes that dropped to or below their low stock threshold trigger an admin alert
+// and sizes that got replenished notify the users that subscribed to them.
+func (app *application) checkStockLevels(before, after *models.Variant) {
+	for _, size := range after.Sizes {
+		oldStock := 0
+		if old := before.GetSize(size.Size); old != nil {
+			oldStock = old.Stock
+		}
+
+		app.alertLowStock(after.ID, size, oldStock)
+
+		if oldStock == 0 && size.Stock > 0 {
+			variantId, size := after.ID, size.Size
+			app.background(func() {
+				app.notifyBackInStock(variantId, size)
+			})
+		}
+	}
+}
+
+// alertLowStock notifies the admin if the stock of the size crossed its low stock threshold
+func (app *application) alertLowStock(variantId primitive.ObjectID, size models.SizesAndStock, oldStock int) {
+	if size.LowStockThreshold > 0 && size.Stock <= size.LowStockThreshold && oldStock > size.LowStockThreshold {
+		app.notify(notification{
+			Kind:    notificationLowStock,
+			To:      app.cfg.adminEmail,
+			Subject: fmt.Sprintf("Low stock for %s", size.SKU),
+			Body:    fmt.Sprintf("variant %s size %s has %d items left (threshold %d)", variantId.Hex(), size.Size, size.Stock, size.LowStockThreshold),
+		})
+	}
+}
+
+func (app *application) notifyBackInStock(variantId primitive.ObjectID, size string) {
+	subs, err := app.models.StockSubscription.GetPending(variantId, size)
+	if err != nil {
+		app.logger.Println(err)
+		return
+	}
+	for _, sub := range subs {
+		// mark first so that a concurrent job doesn't notify the same user twice
+		if err := app.models.StockSubscription.MarkNotified(sub.ID); err != nil {
+			continue
+		}
+		app.notify(notification{
+			Kind:    notificationBackInStock,
+			To:      sub.Email,
+			Subject: "Back in stock",
+			Body:    fmt.Sprintf("size %s of variant %s is available again", size, variantId.Hex()),
+		})
+	}
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"encoding/csv"
 	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/GiorgosMarga/ecom_go/internal/payment"
+	"github.com/GiorgosMarga/ecom_go/internal/pricing"
+	"github.com/GiorgosMarga/ecom_go/internal/tax"
 	"github.com/GiorgosMarga/ecom_go/internal/validator"
 	"github.com/GiorgosMarga/ecom_go/models"
 	"github.com/gin-gonic/gin"
@@ -11,73 +17,83 @@ import (
 
 func (app *application) registerOrderRoutes(router *gin.Engine) {
 	v1 := router.Group("/api/v1/orders")
-	v1.POST("/", app.authenticateUser(), app.createOrderHandler)
 	v1.GET("/:id", app.authenticateUser(), app.getOrderHandler)
 	v1.DELETE("/:id", app.authenticateUser(), app.authorizeUser(), app.deleteOrderHandler)
 	v1.PATCH("/:id", app.authenticateUser(), app.updateOrderHandler)
+	v1.POST("/:id/cancel", app.authenticateUser(), app.cancelOrderHandler)
+	v1.GET("", app.authenticateUser(), app.listOrdersHandler)
+
+	admin := router.Group("/api/v1/admin/orders", app.authenticateUser(), app.authorizeUser())
+	admin.GET("", app.searchOrdersHandler)
+	admin.GET("/export", app.exportOrdersHandler)
 }
 
-func (app *application) createOrderHandler(c *gin.Context) {
-	var order models.Order
+// priceOrder prices the lines with the pricing service and snapshots them onto the order
+func (app *application) priceOrder(order *models.Order, lines []models.OrderLinePayload) (*pricing.Quote, error) {
+	quote, err := app.pricing.Quote(lines)
+	if err != nil {
+		return nil, err
+	}
+	quote.Apply(order)
+	return quote, nil
+}
 
-	if err := c.BindJSON(&order); err != nil {
-		app.badRequestError(c, err)
-		return
+// taxOrder computes the tax of the order for its shipping address, or for the default
+// address of the user when the order has none. Orders without any address aren't taxed.
+func (app *application) taxOrder(order *models.Order) error {
+	address := order.ShippingAddress
+	if address == nil {
+		saved, err := app.models.Address.GetDefault(order.UserId)
+		if err != nil {
+			if errors.Is(err, models.ErrNotFound) {
+				return nil
+			}
+			return err
+		}
+		address = &saved.Address
 	}
 
-	user, err := GetUser(c)
+	taxes, err := app.tax.Calculate(address.Country, address.Region, tax.OrderLines(order))
 	if err != nil {
-		app.internalServerError(c, err)
-		return
+		return err
 	}
+	taxes.ApplyToOrder(order)
+	return nil
+}
 
-	// idToQuantity := make(map[primitive.ObjectID]int)
-	// for _, p := range order.Products {
-	// 	idToQuantity[p.ProductId] += p.Quantity
-	// }
-
-	// total, err := app.models.Product.GetPriceForOrder(idToQuantity)
-	// if err != nil {
-	// 	app.internalServerError(c, err)
-	// 	return
-	// }
-	order.UserId = user.UserID
-	// order.Total = total
-	if err := app.models.Order.Insert(&order); err != nil {
+// pricingError responds with the lines that couldn't be priced
+func (app *application) pricingError(c *gin.Context, err error) {
+	var linesErr *pricing.InvalidLinesError
+	switch {
+	case errors.As(err, &linesErr):
+		app.failedValidationError(c, gin.H{"products": linesErr.Lines})
+	case errors.Is(err, pricing.ErrEmptyOrder):
+		app.failedValidationError(c, gin.H{"products": err.Error()})
+	default:
 		app.internalServerError(c, err)
-		return
 	}
-
-	c.JSON(http.StatusCreated, gin.H{"order": order})
-
 }
 
+// getOrderHandler returns the order by its ObjectID or by its number. Only the owner
+// of the order and admins can see it.
 func (app *application) getOrderHandler(c *gin.Context) {
-	orderId := ReadIdParam(c)
 	user, err := GetUser(c)
 	if err != nil {
 		app.internalServerError(c, err)
 		return
 	}
-	order, err := app.models.Order.Get(orderId)
-	if err != nil {
-		switch {
-		case errors.Is(err, models.ErrNotFound):
-			app.notFoundError(c)
-		default:
-			app.internalServerError(c, err)
-		}
+	order := app.readOwnedOrder(c, user)
+	if order == nil {
 		return
 	}
 
-	// if the order doesnt belong to the user who made the request return notAuthorized
-	// if the user is an admin then return the order
-	if user.UserID != order.UserId && user.Role != models.GetRole(models.AdminRole) {
-		app.notAuthorizedError(c)
+	shipments, err := app.models.Shipment.GetForOrder(order.ID)
+	if err != nil {
+		app.internalServerError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"order": order})
+	c.JSON(http.StatusOK, gin.H{"order": order, "shipments": shipments})
 
 }
 
@@ -140,15 +156,68 @@ func (app *application) updateOrderHandler(c *gin.Context) {
 		return
 	}
 
-	if len(payload.Products) != 0 {
-		order.Products = payload.Products
+	// canceling has side effects (restock, refund) that live in cancelOrderHandler
+	if payload.Status != nil && *payload.Status == models.StatusCanceled && order.Status != models.StatusCanceled {
+		app.badRequestError(c, errors.New("orders are canceled through POST /api/v1/orders/:id/cancel"))
+		return
+	}
+
+	if payload.Status != nil && *payload.Status != order.Status {
+		if err := app.transitionOrder(order, *payload.Status, user); err != nil {
+			switch {
+			case errors.Is(err, models.ErrInvalidTransition):
+				app.conflictError(c, err)
+			default:
+				app.internalServerError(c, err)
+			}
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"order": order})
+
+}
+
+// transitionOrder moves the order to the given status on behalf of the actor, a nil
+// actor means that the change is made by the system. It returns ErrInvalidTransition
+// if the actor isn't allowed to make the change.
+func (app *application) transitionOrder(order *models.Order, to int, actor *models.UserInfo) error {
+	change := models.StatusChange{
+		From:      order.Status,
+		To:        to,
+		ActorRole: models.GetRole(models.SystemRole),
+	}
+	if actor != nil {
+		change.ActorId = actor.UserID
+		change.ActorRole = actor.Role
 	}
+	if err := app.models.Order.Transition(order, change); err != nil {
+		return err
+	}
+	app.recordOrderEvent(order.ID, actor, models.OrderEvent{
+		Type:    models.OrderEventStatusChanged,
+		Message: "Status changed from " + models.StatusName(change.From) + " to " + models.StatusName(to),
+		Data:    map[string]any{"from": change.From, "to": to},
+	})
+	if to == models.StatusPayed {
+		paid := *order
+		app.issueInBackground(func() (*models.Invoice, error) { return app.issueInvoice(&paid) })
+	}
+	return nil
+}
 
-	if payload.Status != nil {
-		order.Status = *payload.Status
+// cancelOrderHandler cancels the order and its payment intent, puts its stock back and
+// refunds it if it was paid. Every step is recorded on the order, so retrying a cancellation that failed
+// half way only does the steps that are left.
+func (app *application) cancelOrderHandler(c *gin.Context) {
+	orderId := ReadIdParam(c)
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
 	}
 
-	err = app.models.Order.Update(order)
+	order, err := app.models.Order.Get(orderId)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrNotFound):
@@ -158,7 +227,263 @@ func (app *application) updateOrderHandler(c *gin.Context) {
 		}
 		return
 	}
+	if order.UserId != user.UserID && user.Role != models.GetRole(models.AdminRole) {
+		app.notAuthorizedError(c)
+		return
+	}
+
+	if order.Status != models.StatusCanceled {
+		var payload models.CancelOrderPayload
+		if err := c.BindJSON(&payload); err != nil {
+			app.badRequestError(c, err)
+			return
+		}
+		v := validator.NewValidator()
+		if models.ValidateCancelOrderPayload(v, payload); !v.IsValid() {
+			app.failedValidationError(c, v.Errors)
+			return
+		}
+
+		// the payment intent is canceled first so that the customer can't pay the order
+		// once it is canceled
+		if order.Status == models.StatusPending && order.PaymentIntentId != "" {
+			_, err := app.payments.CancelIntent(order.PaymentIntentId)
+			switch {
+			case errors.Is(err, payment.ErrNotCancelable):
+				app.conflictError(c, errors.New("the payment of the order is under way"))
+				return
+			case err != nil && !errors.Is(err, payment.ErrUnknownIntent):
+				app.internalServerError(c, err)
+				return
+			}
+		}
+
+		change := models.StatusChange{From: order.Status, ActorId: user.UserID, ActorRole: user.Role}
+		if err := app.models.Order.Cancel(order, change, payload.Reason); err != nil {
+			switch {
+			case errors.Is(err, models.ErrInvalidTransition):
+				app.conflictError(c, err)
+			default:
+				app.internalServerError(c, err)
+			}
+			return
+		}
+		app.recordOrderEvent(order.ID, user, models.OrderEvent{
+			Type:    models.OrderEventStatusChanged,
+			Message: "Order canceled: " + payload.Reason,
+			Data:    map[string]any{"from": change.From, "to": models.StatusCanceled, "reason": payload.Reason},
+		})
+	}
+
+	// orders canceled before cancellations were recorded have nothing left to do
+	if order.Cancellation == nil {
+		c.JSON(http.StatusOK, gin.H{"order": order})
+		return
+	}
+
+	if err := app.restockCanceledOrder(order); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	if err := app.refundCanceledOrder(order); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"order": order})
+}
+
+// restockCanceledOrder puts back the stock reserved at checkout, at most once.
+func (app *application) restockCanceledOrder(order *models.Order) error {
+	if !order.Cancellation.NeedsRestock(order) {
+		return nil
+	}
+	err := app.restockLines(order.Products,
+		func(i int) (bool, error) { return app.models.Order.ClaimLineRestock(order.ID, i) },
+		func(i int) error { return app.models.Order.UnclaimLineRestock(order.ID, i) },
+	)
+	if err != nil {
+		return err
+	}
+	restored, err := app.models.Order.SetStockRestored(order.ID, len(order.Products))
+	if err != nil {
+		return err
+	}
+	order.Cancellation.StockRestored = restored
+	return nil
+}
+
+// restockLines puts the stock of the lines back one line at a time. Every line is
+// claimed before its stock is released, so a retry after a failure only releases the
+// lines that are left and a line is never released twice.
+func (app *application) restockLines(lines []models.OrderProducts, claim func(int) (bool, error), unclaim func(int) error) error {
+	for i, line := range lines {
+		claimed, err := claim(i)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			// restocked before or by a concurrent request
+			continue
+		}
+		if err := app.models.Variant.ReleaseStock([]models.OrderProducts{line}); err != nil {
+			if uerr := unclaim(i); uerr != nil {
+				app.logger.Println(uerr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// refundCanceledOrder refunds what is left of the payment of a paid order as a refund
+// of the order, so the order is never refunded twice.
+func (app *application) refundCanceledOrder(order *models.Order) error {
+	if !order.Cancellation.NeedsRefund(order) {
+		return nil
+	}
+	// the refund has the ID of the order, an order is canceled once
+	r := order.Refund(order.ID)
+	if r == nil {
+		if order.RefundableAmount() == 0 {
+			// everything was refunded before the order was canceled
+			return nil
+		}
+		r = &models.OrderRefund{
+			ID:        order.ID,
+			Source:    models.RefundSourceCancellation,
+			Amount:    order.RefundableAmount(),
+			Reason:    order.Cancellation.Reason,
+			ActorId:   order.Cancellation.ActorId,
+			ActorRole: order.Cancellation.ActorRole,
+		}
+	}
+	if err := app.refundOrder(order, r); err != nil {
+		return err
+	}
+	if err := app.models.Order.SetCancellationRefund(order.ID, r.ProviderRefundId, r.Status); err != nil {
+		return err
+	}
+	now := time.Now()
+	order.Cancellation.RefundId = r.ProviderRefundId
+	order.Cancellation.RefundStatus = r.Status
+	order.Cancellation.RefundedAt = &now
+	return nil
+}
+
+// listOrdersHandler returns the orders of the user, newest first
+func (app *application) listOrdersHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	qs := c.Request.URL.Query()
+	filters := models.Filters{
+		Page:         readInt(qs, "page", 1, v),
+		PageSize:     readInt(qs, "page_size", 20, v),
+		Sort:         readString(qs, "sort", "-created_at"),
+		SortSafelist: models.OrderSortSafelist,
+	}
+	if models.ValidateFilters(v, filters); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
 
+	orders, metadata, err := app.models.Order.GetAllForUser(user.UserID, filters)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"orders": orders, "metadata": metadata})
+}
+
+// readOrderSearch reads the filters of the admin order search from the query string
+func readOrderSearch(c *gin.Context, v *validator.Validator) models.OrderSearch {
+	qs := c.Request.URL.Query()
+	to, toExclusive := readEndTime(qs, "to", v)
+	return models.OrderSearch{
+		Ref:             readOrderRef(qs, "order", v),
+		Status:          readOptionalInt(qs, "status", v),
+		UserId:          readObjectId(qs, "user_id", v),
+		From:            readTime(qs, "from", v),
+		To:              to,
+		ToExclusive:     toExclusive,
+		MinTotal:        readOptionalInt(qs, "min_total", v),
+		MaxTotal:        readOptionalInt(qs, "max_total", v),
+		PaymentIntentId: qs.Get("payment_intent_id"),
+		Filters: models.Filters{
+			Page:         readInt(qs, "page", 1, v),
+			PageSize:     readInt(qs, "page_size", 20, v),
+			Sort:         readString(qs, "sort", "-created_at"),
+			SortSafelist: models.OrderSortSafelist,
+		},
+	}
+}
+
+func (app *application) searchOrdersHandler(c *gin.Context) {
+	v := validator.NewValidator()
+	search := readOrderSearch(c, v)
+	if models.ValidateOrderSearch(v, search); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	orders, metadata, err := app.models.Order.Search(search)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"orders": orders, "metadata": metadata})
+}
+
+// orderNumber returns the number of the order, empty for orders placed before orders
+// were numbered.
+func orderNumber(o models.Order) string {
+	if o.Number == 0 {
+		return ""
+	}
+	return strconv.FormatInt(o.Number, 10)
+}
+
+// exportOrdersHandler streams every order that matches the search as CSV
+func (app *application) exportOrdersHandler(c *gin.Context) {
+	v := validator.NewValidator()
+	search := readOrderSearch(c, v)
+	if models.ValidateOrderSearch(v, search); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", `attachment; filename="orders.csv"`)
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "number", "user_id", "status", "total", "shipping_cost", "payment_intent_id", "created_at", "updated_at"})
+	err := app.models.Order.Export(search, func(o models.Order) error {
+		return w.Write([]string{
+			o.ID.Hex(),
+			orderNumber(o),
+			o.UserId.Hex(),
+			models.StatusName(o.Status),
+			strconv.Itoa(o.Total),
+			strconv.Itoa(o.ShippingCost),
+			o.PaymentIntentId,
+			o.CreatedAt.Format(time.RFC3339),
+			o.UpdatedAt.Format(time.RFC3339),
+		})
+	})
+	w.Flush()
+	// the headers are already sent so the error can only be logged
+	if err == nil {
+		err = w.Error()
+	}
+	if err != nil {
+		app.logError(c, err)
+	}
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/GiorgosMarga/ecom_go/internal/payment"
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCancelPendingOrderCancelsItsPayment(t *testing.T) {
+	app, fake := newTestDBApp(t)
+	shop := newTestShop(t, app)
+	order := shop.checkout(t, app, 1)
+
+	payload := gin.H{"reason": "changed my mind"}
+	if status := sendRequest(t, app, http.MethodPost, "/api/v1/orders/"+order.ID.Hex()+"/cancel", &shop.customer, payload, nil); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	intent, err := fake.GetIntent(order.PaymentIntentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if intent.Status != payment.StatusCanceled {
+		t.Errorf("intent status = %q, want %q", intent.Status, payment.StatusCanceled)
+	}
+	if _, err := fake.Confirm(order.PaymentIntentId); err == nil {
+		t.Error("the canceled order could still be paid")
+	}
+}
+
+func TestLatePaymentOfCanceledOrderIsRefunded(t *testing.T) {
+	app, fake := newTestDBApp(t)
+	shop := newTestShop(t, app)
+	order := shop.checkout(t, app, 1)
+
+	// canceled without its intent, like an order whose intent couldn't be found
+	change := models.StatusChange{From: order.Status, ActorRole: models.GetRole(models.SystemRole)}
+	if err := app.models.Order.Cancel(order, change, "expired"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fake.Confirm(order.PaymentIntentId); err != nil {
+		t.Fatal(err)
+	}
+
+	order = getOrder(t, app, order.ID)
+	if order.Status != models.StatusCanceled {
+		t.Errorf("status = %d, want %d", order.Status, models.StatusCanceled)
+	}
+	if order.Cancellation.RefundStatus != models.RefundSucceeded {
+		t.Errorf("refund status = %q, want %q", order.Cancellation.RefundStatus, models.RefundSucceeded)
+	}
+	if order.ProviderRefunded != order.Total {
+		t.Errorf("refunded by the provider = %d, want %d", order.ProviderRefunded, order.Total)
+	}
+}
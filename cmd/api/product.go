@@ -115,6 +115,14 @@ func (app *application) updateProductHandler(c *gin.Context) {
 	if productPayload.Tags != nil {
 		product.Tags = *productPayload.Tags
 	}
+
+	if productPayload.Weight != nil {
+		product.Weight = *productPayload.Weight
+	}
+
+	if productPayload.TaxClass != nil {
+		product.TaxClass = *productPayload.TaxClass
+	}
 	v := validator.NewValidator()
 
 	if models.ValidateProduct(v, *product); !v.IsValid() {
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/GiorgosMarga/ecom_go/internal/payment"
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var errRefundFailed = errors.New("the payment provider declined the refund")
+
+func (app *application) registerRefundRoutes(router *gin.Engine) {
+	admin := router.Group("/api/v1/admin/orders", app.authenticateUser(), app.authorizeUser())
+	admin.POST("/:id/refunds", app.createRefundHandler)
+}
+
+// createRefundHandler refunds an amount, some lines, or everything that is left of the
+// payment of the order.
+func (app *application) createRefundHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	order := app.readOwnedOrder(c, user)
+	if order == nil {
+		return
+	}
+	if !order.IsPaid() || order.PaymentIntentId == "" {
+		app.conflictError(c, errOrderNotPaid)
+		return
+	}
+
+	var payload models.RefundPayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+	v := validator.NewValidator()
+	models.ValidateRefundPayload(v, payload)
+
+	r := &models.OrderRefund{
+		ID:        primitive.NewObjectID(),
+		Source:    models.RefundSourceAdmin,
+		Reason:    payload.Reason,
+		ActorId:   user.UserID,
+		ActorRole: user.Role,
+	}
+	switch {
+	case len(payload.Lines) > 0:
+		returns, err := app.models.Return.GetForOrder(order.ID)
+		if err != nil {
+			app.internalServerError(c, err)
+			return
+		}
+		r.Lines = payload.Lines
+		r.Amount = models.RefundLinesAmount(v, order, returns, payload.Lines)
+	case payload.Amount != nil:
+		r.Amount = *payload.Amount
+	default:
+		r.Amount = order.RefundableAmount()
+	}
+	if !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+	if r.Amount <= 0 {
+		app.conflictError(c, models.ErrRefundExceedsPayment)
+		return
+	}
+
+	if err := app.refundOrder(order, r); err != nil {
+		switch {
+		case errors.Is(err, models.ErrRefundExceedsPayment):
+			app.conflictError(c, err)
+		case errors.Is(err, payment.ErrRefundDeclined), errors.Is(err, errRefundFailed):
+			app.conflictError(c, errRefundFailed)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"refund": r, "order": order})
+}
+
+// refundOrder refunds r through the payment provider. The refund is reserved on the
+// order first, so that refunds can't add up to more than the payment, and its amount
+// is given back if the provider declines it. Any other error leaves the refund pending,
+// it may have been made, and refunding again with the ID of a pending refund resumes
+// it, the provider deduplicates it through the idempotency key.
+func (app *application) refundOrder(order *models.Order, r *models.OrderRefund) error {
+	if err := app.models.Order.ReserveRefund(order, r); err != nil {
+		return err
+	}
+	if r.Status == models.RefundSucceeded {
+		return nil
+	}
+
+	pr, err := app.payments.Refund(payment.RefundParams{
+		PaymentIntentId: order.PaymentIntentId,
+		Amount:          int64(r.Amount),
+		Metadata:        map[string]string{"order_id": order.ID.Hex(), "refund_id": r.ID.Hex()},
+		IdempotencyKey:  refundKey(r),
+	})
+	if err != nil {
+		if errors.Is(err, payment.ErrRefundDeclined) {
+			if cerr := app.models.Order.CompleteRefund(order, r, "", models.RefundFailed); cerr != nil {
+				app.logger.Println(cerr)
+			}
+		}
+		return err
+	}
+
+	status := refundStatus(pr.Status)
+	if err := app.models.Order.CompleteRefund(order, r, pr.ID, status); err != nil {
+		return err
+	}
+	if status == models.RefundFailed {
+		return errRefundFailed
+	}
+	refund := *r
+	refund.ProviderRefundId = pr.ID
+	refund.Status = status
+	return app.refundMade(order, refund)
+}
+
+// refundStatus maps the status of a refund of the provider to the status of the
+// refund of the order.
+func refundStatus(status string) string {
+	switch status {
+	case payment.RefundStatusSucceeded:
+		return models.RefundSucceeded
+	case payment.RefundStatusFailed, payment.RefundStatusCanceled:
+		return models.RefundFailed
+	default:
+		return models.RefundPending
+	}
+}
+
+// refundMade records a refund that the provider accepted. The credit note is issued and
+// the order moved to refunded once the refund has succeeded, a pending refund is
+// completed by the refund.updated webhook.
+func (app *application) refundMade(order *models.Order, r models.OrderRefund) error {
+	app.recordOrderEvent(order.ID, nil, models.OrderEvent{
+		Type:    models.OrderEventRefunded,
+		Message: refundMessage(&r),
+		Data: map[string]any{
+			"refund_id":          r.ID.Hex(),
+			"provider_refund_id": r.ProviderRefundId,
+			"amount":             r.Amount,
+			"source":             r.Source,
+			"status":             r.Status,
+		},
+	})
+	if r.Status != models.RefundSucceeded {
+		return nil
+	}
+
+	refunded := *order
+	app.issueInBackground(func() (*models.Invoice, error) {
+		return app.issueRefundCreditNote(&refunded, r)
+	})
+	return app.syncRefundedOrder(order)
+}
+
+// resumeRefund makes a refund again that is pending without the provider having
+// answered, through the flow that started it so that its source records the outcome.
+func (app *application) resumeRefund(order *models.Order, r models.OrderRefund) error {
+	switch r.Source {
+	case models.RefundSourceCancellation:
+		if order.Cancellation != nil {
+			return app.refundCanceledOrder(order)
+		}
+	case models.RefundSourceReturn:
+		ret, err := app.models.Return.Get(r.ID)
+		if err != nil {
+			return err
+		}
+		return app.refundReturn(ret)
+	}
+	return app.refundOrder(order, &r)
+}
+
+// recordRefundSource records the outcome of the refund on the cancellation or the
+// return it was made for.
+func (app *application) recordRefundSource(order *models.Order, r models.OrderRefund) error {
+	switch r.Source {
+	case models.RefundSourceCancellation:
+		return app.models.Order.SetCancellationRefund(order.ID, r.ProviderRefundId, r.Status)
+	case models.RefundSourceReturn:
+		return app.models.Return.SetRefund(r.ID, r.ProviderRefundId, r.Status)
+	}
+	return nil
+}
+
+// issueRefundCreditNote issues the credit note of a refund of the order and records it
+// on the refund, so that the credit note job doesn't issue it again.
+func (app *application) issueRefundCreditNote(order *models.Order, r models.OrderRefund) (*models.Invoice, error) {
+	var quantities map[primitive.ObjectID]int
+	if len(r.Lines) > 0 {
+		quantities = make(map[primitive.ObjectID]int, len(r.Lines))
+		for _, line := range r.Lines {
+			quantities[line.LineId] += line.Quantity
+		}
+	}
+	note, err := app.issueCreditNote(order, r.ProviderRefundId, r.Amount, quantities)
+	if err != nil {
+		return nil, err
+	}
+	if err := app.models.Order.SetCreditNoteIssued(order.ID, r.ID); err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+// refundKey returns the idempotency key of the refund. Refunds of cancellations and
+// returns keep the keys they were made with before refunds were recorded on orders.
+func refundKey(r *models.OrderRefund) string {
+	switch r.Source {
+	case models.RefundSourceCancellation:
+		return "cancel-refund-" + r.ID.Hex()
+	case models.RefundSourceReturn:
+		return "return-refund-" + r.ID.Hex()
+	default:
+		return "refund-" + r.ID.Hex()
+	}
+}
+
+func refundMessage(r *models.OrderRefund) string {
+	switch r.Source {
+	case models.RefundSourceCancellation:
+		return "Payment refunded after cancellation"
+	case models.RefundSourceReturn:
+		return "Returned items refunded"
+	}
+	if r.Reason != "" {
+		return fmt.Sprintf("Refunded %d: %s", r.Amount, r.Reason)
+	}
+	return fmt.Sprintf("Refunded %d", r.Amount)
+}
+
+// syncRefundedOrder moves a paid order to refunded once all of its payment has been
+// refunded. Canceled orders stay canceled.
+func (app *application) syncRefundedOrder(order *models.Order) error {
+	if !order.IsFullyRefunded() || order.Status == models.StatusRefunded || order.Status == models.StatusCanceled {
+		return nil
+	}
+	if err := app.transitionOrder(order, models.StatusRefunded, nil); err != nil && !errors.Is(err, models.ErrInvalidTransition) {
+		return err
+	}
+	return nil
+}
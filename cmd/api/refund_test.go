@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/GiorgosMarga/ecom_go/internal/payment"
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/gin-gonic/gin"
+)
+
+// refundResponse is the response of the refund endpoint.
+type refundResponse struct {
+	Refund models.OrderRefund `json:"refund"`
+	Order  models.Order       `json:"order"`
+}
+
+// refund refunds amount of the order as the admin of the shop, everything that is left
+// if amount is 0.
+func (s *testShop) refund(t *testing.T, app *application, order *models.Order, amount int, res *refundResponse) int {
+	t.Helper()
+
+	payload := gin.H{}
+	if amount > 0 {
+		payload["amount"] = amount
+	}
+	return sendRequest(t, app, http.MethodPost, "/api/v1/admin/orders/"+order.ID.Hex()+"/refunds", &s.admin, payload, res)
+}
+
+func TestRefundStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		want   string
+	}{
+		{payment.RefundStatusSucceeded, models.RefundSucceeded},
+		{payment.RefundStatusPending, models.RefundPending},
+		{payment.RefundStatusFailed, models.RefundFailed},
+		{payment.RefundStatusCanceled, models.RefundFailed},
+		{"requires_action", models.RefundPending},
+	}
+
+	for _, tt := range tests {
+		if got := refundStatus(tt.status); got != tt.want {
+			t.Errorf("refundStatus(%q) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestRefund(t *testing.T) {
+	app, fake := newTestDBApp(t)
+	shop := newTestShop(t, app)
+	order := shop.paidOrder(t, app, fake, 2)
+
+	var res refundResponse
+	if status := shop.refund(t, app, order, 3000, &res); status != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", status, http.StatusCreated)
+	}
+	if res.Refund.Status != models.RefundSucceeded {
+		t.Errorf("refund status = %q, want %q", res.Refund.Status, models.RefundSucceeded)
+	}
+	order = getOrder(t, app, order.ID)
+	if order.Status != models.StatusPayed {
+		t.Errorf("status after a partial refund = %d, want %d", order.Status, models.StatusPayed)
+	}
+	if order.AmountRefunded != 3000 || order.ProviderRefunded != 3000 {
+		t.Errorf("refunded = %d and %d by the provider, want 3000", order.AmountRefunded, order.ProviderRefunded)
+	}
+
+	// without an amount everything that is left is refunded
+	if status := shop.refund(t, app, order, 0, &res); status != http.StatusCreated {
+		t.Fatalf("second refund status = %d, want %d", status, http.StatusCreated)
+	}
+	if res.Refund.Amount != order.Total-3000 {
+		t.Errorf("second refund amount = %d, want %d", res.Refund.Amount, order.Total-3000)
+	}
+	order = getOrder(t, app, order.ID)
+	if order.Status != models.StatusRefunded {
+		t.Errorf("status = %d, want %d", order.Status, models.StatusRefunded)
+	}
+	if order.ProviderRefunded != order.Total {
+		t.Errorf("refunded by the provider = %d, want %d", order.ProviderRefunded, order.Total)
+	}
+	if order.RefundableAmount() != 0 {
+		t.Errorf("refundable amount = %d, want 0", order.RefundableAmount())
+	}
+}
+
+func TestRefundExceedingThePayment(t *testing.T) {
+	app, fake := newTestDBApp(t)
+	shop := newTestShop(t, app)
+	order := shop.paidOrder(t, app, fake, 1)
+
+	if status := shop.refund(t, app, order, order.Total+1, nil); status != http.StatusConflict {
+		t.Errorf("status = %d, want %d", status, http.StatusConflict)
+	}
+	if order = getOrder(t, app, order.ID); order.AmountRefunded != 0 {
+		t.Errorf("amount refunded = %d, want 0", order.AmountRefunded)
+	}
+}
+
+func TestRefundOfUnpaidOrder(t *testing.T) {
+	app, _ := newTestDBApp(t)
+	shop := newTestShop(t, app)
+	order := shop.checkout(t, app, 1)
+
+	if status := shop.refund(t, app, order, 0, nil); status != http.StatusConflict {
+		t.Errorf("status = %d, want %d", status, http.StatusConflict)
+	}
+}
+
+func TestPendingRefund(t *testing.T) {
+	tests := []struct {
+		name         string
+		succeeded    bool
+		wantStatus   string
+		wantOrder    int
+		wantRefunded int
+	}{
+		{name: "succeeds", succeeded: true, wantStatus: models.RefundSucceeded, wantOrder: models.StatusRefunded, wantRefunded: 1},
+		{name: "fails", succeeded: false, wantStatus: models.RefundFailed, wantOrder: models.StatusPayed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, fake := newTestDBApp(t)
+			shop := newTestShop(t, app)
+			order := shop.paidOrder(t, app, fake, 1)
+			fake.SetRefundsPending(true)
+
+			var res refundResponse
+			if status := shop.refund(t, app, order, 0, &res); status != http.StatusCreated {
+				t.Fatalf("status = %d, want %d", status, http.StatusCreated)
+			}
+			if res.Refund.Status != models.RefundPending {
+				t.Errorf("refund status = %q, want %q", res.Refund.Status, models.RefundPending)
+			}
+			if order = getOrder(t, app, order.ID); order.Status != models.StatusPayed {
+				t.Errorf("status of the order while the refund is pending = %d, want %d", order.Status, models.StatusPayed)
+			}
+
+			if _, err := fake.SettleRefund(res.Refund.ProviderRefundId, tt.succeeded); err != nil {
+				t.Fatal(err)
+			}
+			order = getOrder(t, app, order.ID)
+			if r := order.Refund(res.Refund.ID); r == nil || r.Status != tt.wantStatus {
+				t.Errorf("refund = %+v, want status %q", r, tt.wantStatus)
+			}
+			if order.Status != tt.wantOrder {
+				t.Errorf("status = %d, want %d", order.Status, tt.wantOrder)
+			}
+			if want := tt.wantRefunded * order.Total; order.AmountRefunded != want {
+				t.Errorf("amount refunded = %d, want %d", order.AmountRefunded, want)
+			}
+		})
+	}
+}
+
+func TestRefundResumedAfterProviderError(t *testing.T) {
+	app, fake := newTestDBApp(t)
+	shop := newTestShop(t, app)
+	order := shop.paidOrder(t, app, fake, 1)
+
+	fake.SetRefundError(errors.New("timeout"))
+	if status := shop.refund(t, app, order, 0, nil); status != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", status, http.StatusInternalServerError)
+	}
+	order = getOrder(t, app, order.ID)
+	if len(order.Refunds) != 1 {
+		t.Fatalf("refunds = %d, want 1", len(order.Refunds))
+	}
+	if r := order.Refunds[0]; r.Status != models.RefundPending || r.ProviderRefundId != "" {
+		t.Errorf("refund = %+v, want it pending without a refund of the provider", r)
+	}
+	if order.AmountRefunded != order.Total {
+		t.Errorf("amount refunded = %d, want the reserved %d", order.AmountRefunded, order.Total)
+	}
+
+	fake.SetRefundError(nil)
+	if err := app.resumeRefund(order, order.Refunds[0]); err != nil {
+		t.Fatal(err)
+	}
+	order = getOrder(t, app, order.ID)
+	if r := order.Refunds[0]; r.Status != models.RefundSucceeded || r.ProviderRefundId == "" {
+		t.Errorf("refund = %+v, want it succeeded", r)
+	}
+	if order.Status != models.StatusRefunded {
+		t.Errorf("status = %d, want %d", order.Status, models.StatusRefunded)
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const maxReturnPhotoSize = 5 << 20
+
+func (app *application) registerReturnRoutes(router *gin.Engine) {
+	orders := router.Group("/api/v1/orders", app.authenticateUser())
+	orders.POST("/:id/returns", app.createReturnHandler)
+	orders.GET("/:id/returns", app.listOrderReturnsHandler)
+
+	v1 := router.Group("/api/v1/returns", app.authenticateUser())
+	v1.GET("", app.listReturnsHandler)
+	v1.GET("/:id", app.getReturnHandler)
+
+	admin := router.Group("/api/v1/admin/returns", app.authenticateUser(), app.authorizeUser())
+	admin.GET("", app.searchReturnsHandler)
+	admin.POST("/:id/approve", app.approveReturnHandler)
+	admin.POST("/:id/reject", app.rejectReturnHandler)
+	admin.POST("/:id/receive", app.receiveReturnHandler)
+}
+
+// readOwnedOrder reads the order of the :id param, an ObjectID or an order number, and
+// checks that it belongs to the user or that the user is an admin. It writes the error
+// response and returns nil on failure.
+func (app *application) readOwnedOrder(c *gin.Context, user *models.UserInfo) *models.Order {
+	ref, err := models.ParseOrderRef(c.Param("id"))
+	if err != nil {
+		app.badRequestError(c, err)
+		return nil
+	}
+	order, err := app.models.Order.GetByRef(ref)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return nil
+	}
+	if order.UserId != user.UserID && user.Role != models.GetRole(models.AdminRole) {
+		app.notAuthorizedError(c)
+		return nil
+	}
+	return order
+}
+
+// createReturnHandler expects a multipart form with the ReturnPayload as JSON in the
+// "data" field and an optional image in the "photo" field.
+func (app *application) createReturnHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	order := app.readOwnedOrder(c, user)
+	if order == nil {
+		return
+	}
+	if err := models.CheckReturnWindow(order, app.cfg.returnWindow); err != nil {
+		app.conflictError(c, err)
+		return
+	}
+
+	if err := c.Request.ParseMultipartForm(maxReturnPhotoSize + 1<<20); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+	var payload models.ReturnPayload
+	if err := json.Unmarshal([]byte(c.PostForm("data")), &payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	if models.ValidateReturnPayload(v, payload); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	previous, err := app.models.Return.GetForOrder(order.ID)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	ret := &models.Return{
+		ID:      primitive.NewObjectID(),
+		OrderId: order.ID,
+		UserId:  order.UserId,
+		Reason:  payload.Reason,
+		Lines:   models.NewReturnLines(v, order, previous, payload.Lines),
+	}
+
+	photo, err := c.FormFile("photo")
+	if err != nil && !errors.Is(err, http.ErrMissingFile) {
+		app.badRequestError(c, err)
+		return
+	}
+	if photo != nil {
+		v.Validate(photo.Size <= maxReturnPhotoSize, "photo", "must not be larger than 5MB")
+		v.Validate(strings.HasPrefix(photo.Header.Get("Content-Type"), "image/"), "photo", "must be an image")
+	}
+	if !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	// the check above is repeated atomically on the order, a concurrent return may have
+	// been requested since the previous returns were read
+	if err := app.models.Order.ReserveReturn(order, ret.Lines); err != nil {
+		switch {
+		case errors.Is(err, models.ErrReturnExceedsOrder):
+			app.failedValidationError(c, gin.H{"quantity": err.Error()})
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+	release := func() {
+		if err := app.models.Order.ReleaseReturn(order.ID, ret.Lines); err != nil {
+			app.logError(c, err)
+		}
+	}
+
+	if photo != nil {
+		key := "returns/" + ret.ID.Hex() + "/" + filepath.Base(photo.Filename)
+		ret.Photo, err = app.uploadFile(photo, key)
+		if err != nil {
+			release()
+			app.internalServerError(c, err)
+			return
+		}
+	}
+
+	if err := app.models.Return.Insert(ret); err != nil {
+		release()
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"return": ret})
+}
+
+func (app *application) listOrderReturnsHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	order := app.readOwnedOrder(c, user)
+	if order == nil {
+		return
+	}
+
+	returns, err := app.models.Return.GetForOrder(order.ID)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"returns": returns})
+}
+
+// listReturnsHandler returns the returns of the user, newest first
+func (app *application) listReturnsHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	app.searchReturns(c, user.UserID)
+}
+
+// searchReturnsHandler lets admins list every return, optionally of a user
+func (app *application) searchReturnsHandler(c *gin.Context) {
+	v := validator.NewValidator()
+	userId := readObjectId(c.Request.URL.Query(), "user_id", v)
+	if !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+	app.searchReturns(c, userId)
+}
+
+func (app *application) searchReturns(c *gin.Context, userId primitive.ObjectID) {
+	v := validator.NewValidator()
+	qs := c.Request.URL.Query()
+	filters := models.Filters{
+		Page:         readInt(qs, "page", 1, v),
+		PageSize:     readInt(qs, "page_size", 20, v),
+		Sort:         readString(qs, "sort", "-created_at"),
+		SortSafelist: models.ReturnSortSafelist,
+	}
+	status := readOptionalInt(qs, "status", v)
+	if status != nil {
+		v.Validate(models.ReturnStatusName(*status) != "", "status", "not allowed status")
+	}
+	if models.ValidateFilters(v, filters); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	returns, metadata, err := app.models.Return.Search(userId, status, filters)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"returns": returns, "metadata": metadata})
+}
+
+func (app *application) getReturnHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	ret := app.readReturn(c)
+	if ret == nil {
+		return
+	}
+	if ret.UserId != user.UserID && user.Role != models.GetRole(models.AdminRole) {
+		app.notAuthorizedError(c)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"return": ret})
+}
+
+func (app *application) readReturn(c *gin.Context) *models.Return {
+	ret, err := app.models.Return.Get(ReadIdParam(c))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return nil
+	}
+	return ret
+}
+
+func (app *application) approveReturnHandler(c *gin.Context) {
+	app.decideReturn(c, models.ReturnRequested, models.ReturnApproved)
+}
+
+// rejectReturnHandler rejects the return and gives its items back to the order, so
+// that they can be returned again.
+func (app *application) rejectReturnHandler(c *gin.Context) {
+	ret := app.transitionReturn(c, models.ReturnRequested, models.ReturnRejected)
+	if ret == nil {
+		return
+	}
+	if err := app.releaseReturn(ret); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"return": ret})
+}
+
+// receiveReturnHandler marks the return as received, puts the items back in stock and
+// refunds them. Calling it again on a received return finishes the steps that failed.
+func (app *application) receiveReturnHandler(c *gin.Context) {
+	ret := app.transitionReturn(c, models.ReturnApproved, models.ReturnReceived)
+	if ret == nil {
+		return
+	}
+
+	if err := app.restockReturn(ret); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	if err := app.refundReturn(ret); err != nil {
+		switch {
+		case errors.Is(err, models.ErrRefundExceedsPayment):
+			app.conflictError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"return": ret})
+}
+
+func (app *application) decideReturn(c *gin.Context, from, to int) {
+	ret := app.transitionReturn(c, from, to)
+	if ret == nil {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"return": ret})
+}
+
+// transitionReturn moves the return of the :id param from one status to the other with
+// the optional note of the body. A return that is already in the target status is
+// returned as is, so that retries succeed.
+func (app *application) transitionReturn(c *gin.Context, from, to int) *models.Return {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return nil
+	}
+
+	var payload models.ReturnDecisionPayload
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&payload); err != nil {
+			app.badRequestError(c, err)
+			return nil
+		}
+	}
+	v := validator.NewValidator()
+	if models.ValidateReturnDecisionPayload(v, payload); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return nil
+	}
+
+	ret := app.readReturn(c)
+	if ret == nil {
+		return nil
+	}
+	if ret.Status == to {
+		return ret
+	}
+	if ret.Status != from {
+		app.conflictError(c, models.ErrInvalidTransition)
+		return nil
+	}
+
+	change := models.StatusChange{From: from, To: to, ActorId: user.UserID, ActorRole: user.Role}
+	if err := app.models.Return.Transition(ret, change, payload.Note); err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidTransition):
+			app.conflictError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
+		return nil
+	}
+	return ret
+}
+
+// restockReturn puts the returned items back in stock, at most once.
+func (app *application) restockReturn(ret *models.Return) error {
+	if ret.StockRestored {
+		return nil
+	}
+	err := app.restockLines(ret.StockLines(),
+		func(i int) (bool, error) { return app.models.Return.ClaimLineRestock(ret.ID, i) },
+		func(i int) error { return app.models.Return.UnclaimLineRestock(ret.ID, i) },
+	)
+	if err != nil {
+		return err
+	}
+	restored, err := app.models.Return.SetStockRestored(ret.ID, len(ret.Lines))
+	if err != nil {
+		return err
+	}
+	ret.StockRestored = restored
+	return nil
+}
+
+// releaseReturn takes the items of a rejected return out of the items returned of the
+// order, at most once.
+func (app *application) releaseReturn(ret *models.Return) error {
+	if ret.Released {
+		return nil
+	}
+	claimed, err := app.models.Return.ClaimRelease(ret.ID)
+	if err != nil {
+		return err
+	}
+	if claimed {
+		if err := app.models.Order.ReleaseReturn(ret.OrderId, ret.Lines); err != nil {
+			if uerr := app.models.Return.UnclaimRelease(ret.ID); uerr != nil {
+				app.logger.Println(uerr)
+			}
+			return err
+		}
+	}
+	ret.Released = true
+	return nil
+}
+
+// refundReturn refunds the returned items as a refund of the order, so the return is
+// never refunded twice and never refunds more than is left of the payment.
+func (app *application) refundReturn(ret *models.Return) error {
+	if ret.RefundId != "" || ret.RefundAmount == 0 {
+		return nil
+	}
+	order, err := app.models.Order.Get(ret.OrderId)
+	if err != nil {
+		return err
+	}
+	if order.PaymentIntentId == "" {
+		return nil
+	}
+
+	// the refund has the ID of the return, so that retries resume it
+	r := order.Refund(ret.ID)
+	if r == nil {
+		r = &models.OrderRefund{
+			ID:        ret.ID,
+			Source:    models.RefundSourceReturn,
+			Amount:    ret.RefundAmount,
+			Lines:     make([]models.RefundLine, 0, len(ret.Lines)),
+			ActorRole: models.GetRole(models.SystemRole),
+		}
+		for _, line := range ret.Lines {
+			r.Lines = append(r.Lines, models.RefundLine{LineId: line.LineId, Quantity: line.Quantity})
+		}
+	}
+	if err := app.refundOrder(order, r); err != nil {
+		return err
+	}
+	if err := app.models.Return.SetRefund(ret.ID, r.ProviderRefundId, r.Status); err != nil {
+		return err
+	}
+	ret.RefundId = r.ProviderRefundId
+	ret.RefundStatus = r.Status
+	return nil
+}
@@ -8,8 +8,16 @@ import (
 
 func (app *application) run() error {
 	gin.SetMode(app.cfg.ginMode)
+	r := app.routes()
+	fmt.Printf("Server is listening on port %s\n", app.cfg.port)
+	return r.Run(fmt.Sprintf(":%s", app.cfg.port))
+}
+
+// routes returns the router with the middlewares and the routes of the api.
+func (app *application) routes() *gin.Engine {
 	r := gin.Default()
 	r.Use(app.corsMiddleware())
+	r.Use(app.idempotency())
 	app.registerProductRoutes(r)
 	app.registerUserRoutes(r)
 	app.registerCartRoutes(r)
@@ -17,7 +25,16 @@ func (app *application) run() error {
 	app.registerOrderRoutes(r)
 	app.registerReviewRoutes(r)
 	app.registerVariantsRoutes(r)
-	app.registerPaymentRoutes(r)
-	fmt.Printf("Server is listening on port %s\n", app.cfg.port)
-	return r.Run(fmt.Sprintf(":%s", app.cfg.port))
+	app.registerWishlistRoutes(r)
+	app.registerCheckoutRoutes(r)
+	app.registerReturnRoutes(r)
+	app.registerAddressRoutes(r)
+	app.registerShippingRoutes(r)
+	app.registerShipmentRoutes(r)
+	app.registerTaxRoutes(r)
+	app.registerInvoiceRoutes(r)
+	app.registerTimelineRoutes(r)
+	app.registerWebhookRoutes(r)
+	app.registerRefundRoutes(r)
+	return r
 }
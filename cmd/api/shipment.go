@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/gin-gonic/gin"
+)
+
+var errOrderNotShippable = errors.New("only paid orders can be shipped")
+
+func (app *application) registerShipmentRoutes(router *gin.Engine) {
+	orders := router.Group("/api/v1/admin/orders", app.authenticateUser(), app.authorizeUser())
+	orders.POST("/:id/shipments", app.createShipmentHandler)
+
+	admin := router.Group("/api/v1/admin/shipments", app.authenticateUser(), app.authorizeUser())
+	admin.PATCH("/:id", app.updateShipmentHandler)
+	admin.POST("/:id/delivered", app.deliverShipmentHandler)
+}
+
+// createShipmentHandler ships some or all of the remaining items of the order. The
+// order moves to shipped once all of its items are in a shipment.
+func (app *application) createShipmentHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	order, err := app.models.Order.Get(ReadIdParam(c))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+	if order.Status != models.StatusPayed && order.Status != models.StatusShipped {
+		app.conflictError(c, errOrderNotShippable)
+		return
+	}
+
+	var payload models.ShipmentPayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	shipments, err := app.models.Shipment.GetForOrder(order.ID)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	shipment := &models.Shipment{
+		OrderId:        order.ID,
+		Carrier:        payload.Carrier,
+		TrackingNumber: payload.TrackingNumber,
+		TrackingURL:    payload.TrackingURL,
+		Lines:          models.NewShipmentLines(v, order, shipments, payload.Lines),
+	}
+	if models.ValidateShipment(v, *shipment); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	// the check above is repeated atomically on the order, a concurrent shipment may
+	// have been created since the previous shipments were read
+	if err := app.models.Order.ReserveShipment(order, shipment.Lines); err != nil {
+		switch {
+		case errors.Is(err, models.ErrShipmentExceedsOrder):
+			app.conflictError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	if err := app.models.Shipment.Insert(shipment); err != nil {
+		if rerr := app.models.Order.ReleaseShipment(order.ID, shipment.Lines); rerr != nil {
+			app.logError(c, rerr)
+		}
+		app.internalServerError(c, err)
+		return
+	}
+	app.recordOrderEvent(order.ID, user, models.OrderEvent{
+		Type:    models.OrderEventShipmentCreated,
+		Message: "Shipped with " + shipment.Carrier + ", tracking number " + shipment.TrackingNumber,
+		Data:    map[string]any{"shipment_id": shipment.ID.Hex(), "lines": shipment.Lines},
+	})
+
+	shipments = append(shipments, *shipment)
+	if err := app.syncOrderWithShipments(order, shipments); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"shipment": shipment, "order": order})
+}
+
+func (app *application) readShipment(c *gin.Context) (*models.Shipment, bool) {
+	id := ReadIdParam(c)
+	if id.IsZero() {
+		app.badRequestError(c, models.ErrInvalidID)
+		return nil, false
+	}
+
+	shipment, err := app.models.Shipment.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return nil, false
+	}
+	return shipment, true
+}
+
+func (app *application) updateShipmentHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	shipment, ok := app.readShipment(c)
+	if !ok {
+		return
+	}
+
+	var payload models.ShipmentUpdatePayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+	if payload.Carrier != nil {
+		shipment.Carrier = *payload.Carrier
+	}
+	if payload.TrackingNumber != nil {
+		shipment.TrackingNumber = *payload.TrackingNumber
+	}
+	if payload.TrackingURL != nil {
+		shipment.TrackingURL = *payload.TrackingURL
+	}
+
+	v := validator.NewValidator()
+	if models.ValidateShipment(v, *shipment); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	if err := app.models.Shipment.Update(shipment); err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+	app.recordOrderEvent(shipment.OrderId, user, models.OrderEvent{
+		Type:    models.OrderEventShipmentUpdated,
+		Message: "Tracking changed to " + shipment.Carrier + ", tracking number " + shipment.TrackingNumber,
+		Data:    map[string]any{"shipment_id": shipment.ID.Hex()},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"shipment": shipment})
+}
+
+// deliverShipmentHandler marks the shipment as delivered. The order moves to delivered
+// once all of its items have been shipped and every shipment has been delivered.
+func (app *application) deliverShipmentHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	shipment, ok := app.readShipment(c)
+	if !ok {
+		return
+	}
+
+	wasDelivered := shipment.DeliveredAt != nil
+	if err := app.models.Shipment.MarkDelivered(shipment); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	if !wasDelivered {
+		app.recordOrderEvent(shipment.OrderId, user, models.OrderEvent{
+			Type:    models.OrderEventShipmentDelivered,
+			Message: "Shipment " + shipment.TrackingNumber + " delivered",
+			Data:    map[string]any{"shipment_id": shipment.ID.Hex()},
+		})
+	}
+
+	order, err := app.models.Order.Get(shipment.OrderId)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	shipments, err := app.models.Shipment.GetForOrder(order.ID)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	if err := app.syncOrderWithShipments(order, shipments); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"shipment": shipment, "order": order})
+}
+
+// syncOrderWithShipments moves the order to shipped when all of its items have been
+// shipped, and to delivered when all of its shipments have been delivered.
+func (app *application) syncOrderWithShipments(order *models.Order, shipments []models.Shipment) error {
+	if order.Status == models.StatusPayed && models.IsFullyShipped(order, shipments) {
+		if err := app.transitionOrder(order, models.StatusShipped, nil); err != nil {
+			// the order changed concurrently, it will be synced on the next shipment event
+			if errors.Is(err, models.ErrInvalidTransition) {
+				return nil
+			}
+			return err
+		}
+	}
+	if order.Status == models.StatusShipped && models.IsFullyDelivered(order, shipments) {
+		if err := app.transitionOrder(order, models.StatusDelivered, nil); err != nil {
+			if errors.Is(err, models.ErrInvalidTransition) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/gin-gonic/gin"
+)
+
+func (app *application) registerShippingRoutes(router *gin.Engine) {
+	admin := router.Group("/api/v1/admin/shipping/zones", app.authenticateUser(), app.authorizeUser())
+	admin.POST("", app.createShippingZoneHandler)
+	admin.GET("", app.listShippingZonesHandler)
+	admin.GET("/:id", app.getShippingZoneHandler)
+	admin.PATCH("/:id", app.updateShippingZoneHandler)
+	admin.DELETE("/:id", app.deleteShippingZoneHandler)
+}
+
+// cartShippingRatesHandler returns the shipping methods that can ship the cart to the
+// destination, with their cost. The destination is the country query param, an address
+// of the address book (address_id) or the default address of the user.
+func (app *application) cartShippingRatesHandler(c *gin.Context) {
+	cart, ok := app.readOwnedCart(c)
+	if !ok {
+		return
+	}
+
+	v := validator.NewValidator()
+	qs := c.Request.URL.Query()
+	country := strings.ToUpper(readString(qs, "country", ""))
+	addressId := readObjectId(qs, "address_id", v)
+	if !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	if country == "" {
+		user, err := GetUser(c)
+		if err != nil {
+			app.failedValidationError(c, gin.H{"country": "must be provided"})
+			return
+		}
+		address, err := app.checkoutAddress(user.UserID, addressId, nil)
+		if err != nil {
+			switch {
+			case errors.Is(err, models.ErrNotFound):
+				app.failedValidationError(c, gin.H{"country": "must be provided"})
+			default:
+				app.internalServerError(c, err)
+			}
+			return
+		}
+		country = address.Country
+	}
+
+	quote, err := app.pricing.Quote(cart.OrderLines())
+	if err != nil {
+		app.pricingError(c, err)
+		return
+	}
+
+	zone, err := app.models.ShippingZone.GetForCountry(country)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			// we don't ship there
+			c.JSON(http.StatusOK, gin.H{"country": country, "rates": []models.ShippingRate{}})
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"country":  country,
+		"subtotal": quote.Subtotal,
+		"weight":   quote.Weight,
+		"rates":    zone.Rates(quote.Subtotal, quote.Weight),
+	})
+}
+
+func (app *application) createShippingZoneHandler(c *gin.Context) {
+	var payload models.ShippingZonePayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	zone := &models.ShippingZone{}
+	payload.Apply(zone)
+
+	v := validator.NewValidator()
+	if models.ValidateShippingZone(v, *zone); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	if err := app.models.ShippingZone.Insert(zone); err != nil {
+		switch {
+		case errors.Is(err, models.ErrCountryInOtherZone):
+			app.conflictError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"zone": zone})
+}
+
+func (app *application) listShippingZonesHandler(c *gin.Context) {
+	zones, err := app.models.ShippingZone.GetAll()
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"zones": zones})
+}
+
+func (app *application) readShippingZone(c *gin.Context) (*models.ShippingZone, bool) {
+	id := ReadIdParam(c)
+	if id.IsZero() {
+		app.badRequestError(c, models.ErrInvalidID)
+		return nil, false
+	}
+
+	zone, err := app.models.ShippingZone.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return nil, false
+	}
+	return zone, true
+}
+
+func (app *application) getShippingZoneHandler(c *gin.Context) {
+	zone, ok := app.readShippingZone(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"zone": zone})
+}
+
+func (app *application) updateShippingZoneHandler(c *gin.Context) {
+	zone, ok := app.readShippingZone(c)
+	if !ok {
+		return
+	}
+
+	var payload models.ShippingZonePayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	payload.Apply(zone)
+	v := validator.NewValidator()
+	if models.ValidateShippingZone(v, *zone); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	if err := app.models.ShippingZone.Update(zone); err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		case errors.Is(err, models.ErrCountryInOtherZone):
+			app.conflictError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"zone": zone})
+}
+
+func (app *application) deleteShippingZoneHandler(c *gin.Context) {
+	id := ReadIdParam(c)
+	if id.IsZero() {
+		app.badRequestError(c, models.ErrInvalidID)
+		return
+	}
+
+	if err := app.models.ShippingZone.Delete(id); err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
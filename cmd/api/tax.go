@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/gin-gonic/gin"
+)
+
+func (app *application) registerTaxRoutes(router *gin.Engine) {
+	admin := router.Group("/api/v1/admin/tax/rates", app.authenticateUser(), app.authorizeUser())
+	admin.POST("", app.createTaxRateHandler)
+	admin.GET("", app.listTaxRatesHandler)
+	admin.GET("/:id", app.getTaxRateHandler)
+	admin.PATCH("/:id", app.updateTaxRateHandler)
+	admin.DELETE("/:id", app.deleteTaxRateHandler)
+}
+
+func (app *application) createTaxRateHandler(c *gin.Context) {
+	var payload models.TaxRatePayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	rate := &models.TaxRate{}
+	payload.Apply(rate)
+
+	v := validator.NewValidator()
+	if models.ValidateTaxRate(v, *rate); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	if err := app.models.TaxRate.Insert(rate); err != nil {
+		switch {
+		case errors.Is(err, models.ErrDuplicateTaxRate):
+			app.conflictError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"rate": rate})
+}
+
+// listTaxRatesHandler returns every rate, or the rates of the country query param
+func (app *application) listTaxRatesHandler(c *gin.Context) {
+	rates, err := app.models.TaxRate.GetAll(readString(c.Request.URL.Query(), "country", ""))
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rates": rates})
+}
+
+func (app *application) readTaxRate(c *gin.Context) (*models.TaxRate, bool) {
+	id := ReadIdParam(c)
+	if id.IsZero() {
+		app.badRequestError(c, models.ErrInvalidID)
+		return nil, false
+	}
+
+	rate, err := app.models.TaxRate.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return nil, false
+	}
+	return rate, true
+}
+
+func (app *application) getTaxRateHandler(c *gin.Context) {
+	rate, ok := app.readTaxRate(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rate": rate})
+}
+
+func (app *application) updateTaxRateHandler(c *gin.Context) {
+	rate, ok := app.readTaxRate(c)
+	if !ok {
+		return
+	}
+
+	var payload models.TaxRatePayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	payload.Apply(rate)
+	v := validator.NewValidator()
+	if models.ValidateTaxRate(v, *rate); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	if err := app.models.TaxRate.Update(rate); err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		case errors.Is(err, models.ErrDuplicateTaxRate):
+			app.conflictError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rate": rate})
+}
+
+func (app *application) deleteTaxRateHandler(c *gin.Context) {
+	id := ReadIdParam(c)
+	if id.IsZero() {
+		app.badRequestError(c, models.ErrInvalidID)
+		return
+	}
+
+	if err := app.models.TaxRate.Delete(id); err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (app *application) registerTimelineRoutes(router *gin.Engine) {
+	orders := router.Group("/api/v1/orders", app.authenticateUser())
+	orders.GET("/:id/timeline", app.getOrderTimelineHandler)
+
+	admin := router.Group("/api/v1/admin/orders", app.authenticateUser(), app.authorizeUser())
+	admin.POST("/:id/notes", app.createOrderNoteHandler)
+}
+
+// recordOrderEvent appends an event to the timeline of the order on behalf of the
+// actor, a nil actor means that the system did it. The timeline is a record of changes
+// that already happened, so failing to write it is logged and doesn't fail the request.
+func (app *application) recordOrderEvent(orderId primitive.ObjectID, actor *models.UserInfo, e models.OrderEvent) {
+	e.OrderId = orderId
+	e.ActorRole = models.GetRole(models.SystemRole)
+	if actor != nil {
+		e.ActorId = actor.UserID
+		e.ActorRole = actor.Role
+	}
+	if err := app.models.OrderEvent.Insert(&e); err != nil {
+		app.logger.Println("recording order event:", err)
+	}
+}
+
+// recordOrderCreated records the creation of an order by its owner.
+func (app *application) recordOrderCreated(order *models.Order, user *models.UserInfo) {
+	app.recordOrderEvent(order.ID, user, models.OrderEvent{
+		Type:    models.OrderEventCreated,
+		Message: "Order " + order.Reference() + " placed",
+		Data:    map[string]any{"total": order.Total, "lines": len(order.Products)},
+	})
+}
+
+// getOrderTimelineHandler returns the timeline of the order to its owner or to an
+// admin. Only admins see internal events.
+func (app *application) getOrderTimelineHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	order := app.readOwnedOrder(c, user)
+	if order == nil {
+		return
+	}
+
+	isAdmin := user.Role == models.GetRole(models.AdminRole)
+	events, err := app.models.OrderEvent.GetForOrder(order.ID, isAdmin)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"timeline": events})
+}
+
+// createOrderNoteHandler adds a note of an admin to the timeline of the order.
+func (app *application) createOrderNoteHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	order := app.readOwnedOrder(c, user)
+	if order == nil {
+		return
+	}
+
+	var payload models.OrderNotePayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+	v := validator.NewValidator()
+	if models.ValidateOrderNotePayload(v, payload); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	note := models.OrderEvent{
+		OrderId:   order.ID,
+		Type:      models.OrderEventNote,
+		Message:   payload.Message,
+		ActorId:   user.UserID,
+		ActorRole: user.Role,
+		Internal:  payload.Internal == nil || *payload.Internal,
+	}
+	if err := app.models.OrderEvent.Insert(&note); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"note": note})
+}
@@ -70,6 +70,8 @@ func (app *application) registerUserHandler(c *gin.Context) {
 		app.internalServerError(c, err)
 		return
 	}
+	app.mergeGuestCart(c, user.ID)
+
 	// keep cookie for a week
 	c.SetCookie("refrest_token", refreshToken, 60*60*24*7, "/", "localhost", false, true)
 	c.SetCookie("access_token", accessToken, 60*60*24*7, "/", "localhost", false, true)
@@ -125,6 +127,8 @@ func (app *application) loginUserHandler(c *gin.Context) {
 		app.internalServerError(c, err)
 		return
 	}
+	app.mergeGuestCart(c, u.ID)
+
 	c.SetCookie("refresh_token", refreshToken, 60*60*24*7, "/", "localhost", false, false) // 7 days
 	c.SetCookie("access_token", accessToken, 60*60*24*7, "/", "localhost", false, false)   // 7 days
 	c.JSON(http.StatusOK, gin.H{"user": u})
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/GiorgosMarga/ecom_go/internal/validator"
@@ -21,6 +22,8 @@ func (app *application) registerVariantsRoutes(router *gin.Engine) {
 	// v1.POST("/login", app.loginUserHandler)
 	v1.GET("/:id", app.authenticateUser(), app.getVariantHandler)
 	v1.DELETE("/:id", app.deleteVariantHandler)
+	v1.PATCH("/:id", app.authenticateUser(), app.authorizeUser(), app.updateVariantHandler)
+	v1.POST("/:id/notify", app.authenticateUser(), app.subscribeStockHandler)
 }
 func (app *application) getVariantHandler(c *gin.Context) {
 	id := c.Params.ByName("id")
@@ -117,3 +120,121 @@ func (app *application) deleteVariantHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "success"})
 
 }
+
+func (app *application) updateVariantHandler(c *gin.Context) {
+	variantId := c.Params.ByName("id")
+	variant, err := app.models.Variant.GetById(variantId)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		case errors.Is(err, models.ErrInvalidID):
+			app.badRequestError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+	before := *variant
+	before.Sizes = slices.Clone(variant.Sizes)
+
+	var payload models.VariantUpdatePayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	if payload.Color != nil {
+		variant.Color = *payload.Color
+	}
+	if payload.Sizes != nil {
+		variant.Sizes = payload.Sizes
+	}
+
+	v := validator.NewValidator()
+	if models.ValidateVariant(v, *variant); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	// the sizes are changed only when they were sent, from the sizes the variant had
+	var sizesBefore []models.SizesAndStock
+	if payload.Sizes != nil {
+		sizesBefore = append([]models.SizesAndStock{}, before.Sizes...)
+	}
+	if err := app.models.Variant.Update(variant, sizesBefore); err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		case errors.Is(err, models.ErrOutOfStock):
+			app.conflictError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	// read it back to get the stock as it is after any concurrent reservations
+	variant, err = app.models.Variant.GetById(variantId)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	app.checkStockLevels(&before, variant)
+
+	c.JSON(http.StatusOK, gin.H{"v": variant})
+}
+
+// subscribeStockHandler lets a user ask to be notified when an out of stock
+// size of a variant becomes available again
+func (app *application) subscribeStockHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	variant, err := app.models.Variant.GetById(c.Params.ByName("id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		case errors.Is(err, models.ErrInvalidID):
+			app.badRequestError(c, err)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	var payload models.StockSubscriptionPayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	size := variant.GetSize(payload.Size)
+	v.Validate(size != nil, "size", "unknown size")
+	if size != nil {
+		v.Validate(size.Stock == 0, "size", "is in stock")
+	}
+	if !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	sub := &models.StockSubscription{
+		UserId:    user.UserID,
+		Email:     user.Email,
+		VariantId: variant.ID,
+		Size:      payload.Size,
+	}
+	if err := app.models.StockSubscription.Insert(sub); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"subscription": sub})
+}
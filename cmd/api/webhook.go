@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/GiorgosMarga/ecom_go/internal/payment"
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxWebhookBytes bounds the body of webhook requests, Stripe events are much smaller.
+const maxWebhookBytes = 64 * 1024
+
+var errNoWebhookSecret = errors.New("STRIPE_WEBHOOK_SECRET must be set to verify the events of the payment provider")
+
+func (app *application) registerWebhookRoutes(router *gin.Engine) {
+	v1 := router.Group("/api/v1/webhooks")
+	v1.POST("/stripe", app.paymentWebhookHandler)
+}
+
+// newPaymentProvider returns the payment provider of the config. The fake provider
+// delivers its webhook events in process instead of through the webhook route. Both
+// need the webhook secret, without it anyone could post events to the webhook route.
+func (app *application) newPaymentProvider() (payment.Provider, error) {
+	if app.cfg.webhookSecret == "" {
+		return nil, errNoWebhookSecret
+	}
+	if app.cfg.paymentProvider != "fake" {
+		return payment.NewStripe(app.cfg.stripeKey, app.cfg.webhookSecret), nil
+	}
+	fake := payment.NewFake(app.cfg.webhookSecret)
+	fake.OnEvent(func(e *payment.Event) {
+		if _, err := app.processPaymentEvent(e); err != nil {
+			app.logger.Println(fmt.Errorf("processing payment event %s: %w", e.ID, err))
+		}
+	})
+	return fake, nil
+}
+
+// paymentWebhookHandler verifies the signature of an event of the payment provider and
+// reconciles the order it is about. Deliveries of an event that was processed already
+// are acknowledged without doing anything. Processing errors answer with a 500 so that
+// the provider delivers the event again.
+func (app *application) paymentWebhookHandler(c *gin.Context) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			app.requestTooLargeError(c, tooLarge.Limit)
+			return
+		}
+		app.badRequestError(c, err)
+		return
+	}
+	event, err := app.payments.ParseWebhook(body, c.Request.Header)
+	if err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	processed, err := app.processPaymentEvent(event)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+	if !processed {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "processed"})
+}
+
+// processPaymentEvent handles the event once, it reports whether the event was
+// processed or ignored because it was processed before or isn't handled. The event is
+// marked as processed only after it has been handled, a failure leaves it to the retry
+// of the provider. The handlers are idempotent, so that handling concurrent deliveries
+// of the same event is harmless.
+func (app *application) processPaymentEvent(event *payment.Event) (bool, error) {
+	var handle func(*payment.Event) error
+	switch event.Type {
+	case payment.EventPaymentSucceeded:
+		handle = app.handlePaymentSucceeded
+	case payment.EventPaymentFailed:
+		handle = app.handlePaymentFailed
+	case payment.EventRefunded:
+		handle = app.handleChargeRefunded
+	case payment.EventRefundUpdated:
+		handle = app.handleRefundUpdated
+	default:
+		return false, nil
+	}
+
+	processed, err := app.models.WebhookEvent.IsProcessed(event.ID)
+	if err != nil || processed {
+		return false, err
+	}
+	if err := handle(event); err != nil {
+		return false, err
+	}
+	if err := app.models.WebhookEvent.MarkProcessed(event.ID, event.Type); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// webhookOrder returns the order of the payment intent, nil if it isn't one of ours.
+func (app *application) webhookOrder(paymentIntentId string) (*models.Order, error) {
+	order, err := app.models.Order.GetByPaymentIntent(paymentIntentId)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			app.logger.Println("webhook: no order for payment intent", paymentIntentId)
+			return nil, nil
+		}
+		return nil, err
+	}
+	return order, nil
+}
+
+// handlePaymentSucceeded records the amount received, which refunds are capped to, and
+// moves the order to paid. An order that isn't pending anymore is left as it is, a
+// payment for a canceled order is refunded.
+func (app *application) handlePaymentSucceeded(event *payment.Event) error {
+	order, err := app.webhookOrder(event.PaymentIntentId)
+	if err != nil || order == nil {
+		return err
+	}
+	if err := app.models.Order.SetAmountReceived(order.ID, int(event.Amount)); err != nil {
+		return err
+	}
+	order.AmountReceived = int(event.Amount)
+
+	app.recordOrderEvent(order.ID, nil, models.OrderEvent{
+		Type:    models.OrderEventPaymentSucceeded,
+		Message: "Payment succeeded",
+		Data:    map[string]any{"payment_intent_id": event.PaymentIntentId, "amount": event.Amount, "event_id": event.ID},
+	})
+	if int(event.Amount) != order.Total {
+		app.recordOrderEvent(order.ID, nil, models.OrderEvent{
+			Type:     models.OrderEventNote,
+			Message:  fmt.Sprintf("Amount received %d differs from the order total %d", event.Amount, order.Total),
+			Internal: true,
+		})
+	}
+
+	switch order.Status {
+	case models.StatusPending:
+		if err := app.transitionOrder(order, models.StatusPayed, nil); err != nil && !errors.Is(err, models.ErrInvalidTransition) {
+			return err
+		}
+	case models.StatusCanceled:
+		return app.refundLatePayment(order)
+	}
+	return nil
+}
+
+// refundLatePayment refunds a payment that went through after the order was canceled,
+// as the refund of the cancellation. Orders canceled before cancellations were recorded
+// and refunds the provider declines are left to the admins.
+func (app *application) refundLatePayment(order *models.Order) error {
+	if order.Cancellation == nil {
+		app.recordOrderEvent(order.ID, nil, models.OrderEvent{
+			Type:     models.OrderEventNote,
+			Message:  "Payment received for a canceled order, it has to be refunded",
+			Internal: true,
+		})
+		return nil
+	}
+	if !order.Cancellation.WasPaid {
+		if err := app.models.Order.SetCancellationPaid(order.ID); err != nil {
+			return err
+		}
+		order.Cancellation.WasPaid = true
+	}
+
+	err := app.refundCanceledOrder(order)
+	if errors.Is(err, payment.ErrRefundDeclined) || errors.Is(err, errRefundFailed) {
+		app.recordOrderEvent(order.ID, nil, models.OrderEvent{
+			Type:     models.OrderEventNote,
+			Message:  "Payment received for a canceled order, the refund was declined and it has to be refunded",
+			Internal: true,
+		})
+		return nil
+	}
+	return err
+}
+
+// handlePaymentFailed records the failure. The order stays pending so that the
+// customer can pay it with another payment method.
+func (app *application) handlePaymentFailed(event *payment.Event) error {
+	order, err := app.webhookOrder(event.PaymentIntentId)
+	if err != nil || order == nil {
+		return err
+	}
+
+	reason := event.FailureReason
+	if reason == "" {
+		reason = "unknown reason"
+	}
+	app.recordOrderEvent(order.ID, nil, models.OrderEvent{
+		Type:    models.OrderEventPaymentFailed,
+		Message: "Payment failed: " + reason,
+		Data:    map[string]any{"payment_intent_id": event.PaymentIntentId, "event_id": event.ID},
+	})
+	return nil
+}
+
+// handleChargeRefunded records the total refunded on the payment of the order,
+// including refunds made from the dashboard of the provider, and moves the order to
+// refunded once all of it has been refunded.
+func (app *application) handleChargeRefunded(event *payment.Event) error {
+	if event.PaymentIntentId == "" {
+		return nil
+	}
+	order, err := app.webhookOrder(event.PaymentIntentId)
+	if err != nil || order == nil {
+		return err
+	}
+
+	if err := app.models.Order.SetProviderRefunded(order.ID, int(event.Amount)); err != nil {
+		return err
+	}
+	order.ProviderRefunded = max(order.ProviderRefunded, int(event.Amount))
+	app.recordOrderEvent(order.ID, nil, models.OrderEvent{
+		Type:    models.OrderEventRefunded,
+		Message: fmt.Sprintf("Payment provider reports %d of %d refunded", event.Amount, event.PaymentAmount),
+		Data:    map[string]any{"charge_id": event.ChargeId, "amount_refunded": event.Amount, "event_id": event.ID},
+	})
+	return app.syncRefundedOrder(order)
+}
+
+// handleRefundUpdated completes a refund of the order that was pending, found by the ID
+// the provider gave it or, when the provider never answered the refund request, by the
+// ID in its metadata. Refunds made from the dashboard of the provider aren't refunds of
+// the order, charge.refunded accounts for them.
+func (app *application) handleRefundUpdated(event *payment.Event) error {
+	status := refundStatus(event.RefundStatus)
+	if event.PaymentIntentId == "" || status == models.RefundPending {
+		return nil
+	}
+	order, err := app.webhookOrder(event.PaymentIntentId)
+	if err != nil || order == nil {
+		return err
+	}
+
+	r := order.RefundByProviderId(event.RefundId)
+	if r == nil {
+		if id, err := primitive.ObjectIDFromHex(event.Metadata["refund_id"]); err == nil {
+			r = order.Refund(id)
+		}
+	}
+	if r == nil || r.Status != models.RefundPending {
+		return nil
+	}
+
+	refund := *r
+	if err := app.models.Order.CompleteRefund(order, &refund, event.RefundId, status); err != nil {
+		return err
+	}
+	if err := app.recordRefundSource(order, refund); err != nil {
+		return err
+	}
+	if status == models.RefundFailed {
+		reason := event.FailureReason
+		if reason == "" {
+			reason = "unknown reason"
+		}
+		app.recordOrderEvent(order.ID, nil, models.OrderEvent{
+			Type:     models.OrderEventNote,
+			Message:  fmt.Sprintf("Refund of %d failed: %s", refund.Amount, reason),
+			Data:     map[string]any{"refund_id": refund.ID.Hex(), "provider_refund_id": event.RefundId, "event_id": event.ID},
+			Internal: true,
+		})
+		return nil
+	}
+	return app.refundMade(order, refund)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GiorgosMarga/ecom_go/internal/payment"
+	"github.com/GiorgosMarga/ecom_go/models"
+)
+
+// postWebhook posts a signed event to the webhook route and returns the response.
+func postWebhook(t *testing.T, app *application, fake *payment.Fake, e payment.Event) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, header, err := fake.SignWebhook(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/webhooks/stripe", bytes.NewReader(body))
+	req.Header = header
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNewPaymentProviderNeedsWebhookSecret(t *testing.T) {
+	for _, provider := range []string{"stripe", "fake"} {
+		app := &application{cfg: &config{paymentProvider: provider, stripeKey: "sk_test"}}
+		if _, err := app.newPaymentProvider(); !errors.Is(err, errNoWebhookSecret) {
+			t.Errorf("%s: err = %v, want %v", provider, err, errNoWebhookSecret)
+		}
+	}
+}
+
+func TestWebhookRejectsInvalidSignature(t *testing.T) {
+	app, fake := newTestApp(t)
+
+	body, header, err := fake.SignWebhook(payment.Event{ID: "evt_1", Type: payment.EventPaymentSucceeded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = append(body, ' ')
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/webhooks/stripe", bytes.NewReader(body))
+	req.Header = header
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestWebhookRejectsLargeBody(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	body := bytes.Repeat([]byte(" "), maxWebhookBytes+1)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/webhooks/stripe", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestWebhookIgnoresUnhandledEvents(t *testing.T) {
+	app, fake := newTestApp(t)
+
+	rec := postWebhook(t, app, fake, payment.Event{ID: "evt_1", Type: "customer.created"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if !bytes.Contains(rec.Body.Bytes(), []byte(`"ignored"`)) {
+		t.Errorf("body = %s, want the event ignored", rec.Body.String())
+	}
+}
+
+func TestPaymentSucceededPaysTheOrder(t *testing.T) {
+	app, fake := newTestDBApp(t)
+	shop := newTestShop(t, app)
+
+	order := shop.paidOrder(t, app, fake, 2)
+	if order.Status != models.StatusPayed {
+		t.Errorf("status = %d, want %d", order.Status, models.StatusPayed)
+	}
+	if order.AmountReceived != order.Total {
+		t.Errorf("amount received = %d, want %d", order.AmountReceived, order.Total)
+	}
+
+	// a redelivery of the event is acknowledged without being handled again
+	events := fake.Events()
+	rec := postWebhook(t, app, fake, events[len(events)-1])
+	if rec.Code != http.StatusOK {
+		t.Fatalf("redelivery status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if !bytes.Contains(rec.Body.Bytes(), []byte(`"ignored"`)) {
+		t.Errorf("redelivery body = %s, want the event ignored", rec.Body.String())
+	}
+}
+
+func TestPaymentFailedKeepsTheOrderPending(t *testing.T) {
+	app, fake := newTestDBApp(t)
+	shop := newTestShop(t, app)
+	fake.SetOutcome(payment.OutcomeFail)
+
+	order := shop.paidOrder(t, app, fake, 1)
+	if order.Status != models.StatusPending {
+		t.Errorf("status = %d, want %d", order.Status, models.StatusPending)
+	}
+	if order.AmountReceived != 0 {
+		t.Errorf("amount received = %d, want 0", order.AmountReceived)
+	}
+}
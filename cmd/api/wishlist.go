@@ -0,0 +1,401 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/GiorgosMarga/ecom_go/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (app *application) registerWishlistRoutes(router *gin.Engine) {
+	v1 := router.Group("/api/v1/wishlists")
+	v1.POST("", app.authenticateUser(), app.createWishlistHandler)
+	v1.GET("", app.authenticateUser(), app.listWishlistsHandler)
+	v1.GET("/shared/:token", app.getSharedWishlistHandler)
+	v1.GET("/:id", app.authenticateUser(), app.getWishlistHandler)
+	v1.PATCH("/:id", app.authenticateUser(), app.updateWishlistHandler)
+	v1.DELETE("/:id", app.authenticateUser(), app.deleteWishlistHandler)
+	v1.POST("/:id/items", app.authenticateUser(), app.addWishlistItemHandler)
+	v1.DELETE("/:id/items/:lineId", app.authenticateUser(), app.removeWishlistItemHandler)
+	v1.POST("/:id/items/:lineId/cart", app.authenticateUser(), app.moveWishlistItemToCartHandler)
+}
+
+// readOwnedWishlist reads the wishlist with the given id and makes sure that it belongs to
+// the user of the request. It returns false if it doesn't, in which case a response has already been sent.
+func (app *application) readOwnedWishlist(c *gin.Context, id primitive.ObjectID) (*models.Wishlist, bool) {
+	if id.IsZero() {
+		app.badRequestError(c, models.ErrInvalidID)
+		return nil, false
+	}
+
+	wishlist, err := app.models.Wishlist.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return nil, false
+	}
+
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return nil, false
+	}
+	if wishlist.UserId != user.UserID {
+		app.notAuthorizedError(c)
+		return nil, false
+	}
+	return wishlist, true
+}
+
+func (app *application) fillWishlist(w *models.Wishlist) error {
+	catalog, err := app.models.Variant.GetCatalog(w.VariantIds())
+	if err != nil {
+		return err
+	}
+	w.Fill(catalog)
+	return nil
+}
+
+func (app *application) createWishlistHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	var payload models.WishlistPayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	wishlist := &models.Wishlist{UserId: user.UserID}
+	if payload.Name != nil {
+		wishlist.Name = *payload.Name
+	}
+	if payload.Shared != nil && *payload.Shared {
+		token, err := utils.RandomToken(32)
+		if err != nil {
+			app.internalServerError(c, err)
+			return
+		}
+		wishlist.ShareToken = token
+	}
+
+	v := validator.NewValidator()
+	if models.ValidateWishlist(v, *wishlist); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	if err := app.models.Wishlist.Insert(wishlist); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"wishlist": wishlist})
+}
+
+func (app *application) listWishlistsHandler(c *gin.Context) {
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	wishlists, err := app.models.Wishlist.GetForUser(user.UserID)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"wishlists": wishlists})
+}
+
+func (app *application) getWishlistHandler(c *gin.Context) {
+	wishlist, ok := app.readOwnedWishlist(c, ReadIdParam(c))
+	if !ok {
+		return
+	}
+
+	if err := app.fillWishlist(wishlist); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"wishlist": wishlist})
+}
+
+// getSharedWishlistHandler is the public, read only view of a shared wishlist
+func (app *application) getSharedWishlistHandler(c *gin.Context) {
+	wishlist, err := app.models.Wishlist.GetByShareToken(c.Param("token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	if err := app.fillWishlist(wishlist); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"wishlist": wishlist})
+}
+
+func (app *application) updateWishlistHandler(c *gin.Context) {
+	wishlist, ok := app.readOwnedWishlist(c, ReadIdParam(c))
+	if !ok {
+		return
+	}
+
+	var payload models.WishlistPayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	if payload.Name != nil {
+		wishlist.Name = *payload.Name
+	}
+	if payload.Shared != nil {
+		switch {
+		case !*payload.Shared:
+			wishlist.ShareToken = ""
+		case wishlist.ShareToken == "":
+			token, err := utils.RandomToken(32)
+			if err != nil {
+				app.internalServerError(c, err)
+				return
+			}
+			wishlist.ShareToken = token
+		}
+	}
+
+	v := validator.NewValidator()
+	if models.ValidateWishlist(v, *wishlist); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return
+	}
+
+	if err := app.models.Wishlist.Update(wishlist); err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"wishlist": wishlist})
+}
+
+func (app *application) deleteWishlistHandler(c *gin.Context) {
+	id := ReadIdParam(c)
+	if id.IsZero() {
+		app.badRequestError(c, models.ErrInvalidID)
+		return
+	}
+
+	user, err := GetUser(c)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	if err := app.models.Wishlist.Delete(id, user.UserID); err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (app *application) addWishlistItemHandler(c *gin.Context) {
+	wishlist, ok := app.readOwnedWishlist(c, ReadIdParam(c))
+	if !ok {
+		return
+	}
+
+	var payload models.WishlistItemPayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	wishlist, ok = app.addWishlistItem(c, wishlist.ID, payload)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"wishlist": wishlist})
+}
+
+// addWishlistItem validates the item against the catalog and adds it to the wishlist.
+// It returns false if a response has already been sent.
+func (app *application) addWishlistItem(c *gin.Context, id primitive.ObjectID, payload models.WishlistItemPayload) (*models.Wishlist, bool) {
+	catalog, err := app.models.Variant.GetCatalog([]primitive.ObjectID{payload.VariantId})
+	if err != nil {
+		app.internalServerError(c, err)
+		return nil, false
+	}
+
+	v := validator.NewValidator()
+	if models.ValidateWishlistItem(v, payload, catalog); !v.IsValid() {
+		app.failedValidationError(c, v.Errors)
+		return nil, false
+	}
+
+	item := models.WishlistItem{
+		ID:        primitive.NewObjectID(),
+		VariantId: payload.VariantId,
+		Size:      payload.Size,
+		AddedAt:   time.Now(),
+	}
+	wishlist, err := app.models.Wishlist.AddItem(id, item)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return nil, false
+	}
+
+	if err := app.fillWishlist(wishlist); err != nil {
+		app.internalServerError(c, err)
+		return nil, false
+	}
+	return wishlist, true
+}
+
+func (app *application) removeWishlistItemHandler(c *gin.Context) {
+	wishlist, ok := app.readOwnedWishlist(c, ReadIdParam(c))
+	if !ok {
+		return
+	}
+
+	wishlist, err := app.models.Wishlist.RemoveItem(wishlist.ID, ReadObjectIdParam(c, "lineId"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			app.notFoundError(c)
+		default:
+			app.internalServerError(c, err)
+		}
+		return
+	}
+
+	if err := app.fillWishlist(wishlist); err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"wishlist": wishlist})
+}
+
+// moveWishlistItemToCartHandler moves an item of the wishlist into the active cart of the user
+func (app *application) moveWishlistItemToCartHandler(c *gin.Context) {
+	wishlist, ok := app.readOwnedWishlist(c, ReadIdParam(c))
+	if !ok {
+		return
+	}
+
+	lineId := ReadObjectIdParam(c, "lineId")
+	item := wishlist.GetItem(lineId)
+	if item == nil {
+		app.notFoundError(c)
+		return
+	}
+
+	payload := models.MoveToCartPayload{Quantity: 1}
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&payload); err != nil {
+			app.badRequestError(c, err)
+			return
+		}
+	}
+
+	cart, err := app.models.Cart.GetActiveForUser(wishlist.UserId)
+	if err != nil {
+		app.internalServerError(c, err)
+		return
+	}
+
+	cart, ok = app.addCartItem(c, cart, models.CartItemPayload{
+		VariantId: item.VariantId,
+		Size:      item.Size,
+		Quantity:  payload.Quantity,
+	})
+	if !ok {
+		return
+	}
+
+	if _, err := app.models.Wishlist.RemoveItem(wishlist.ID, lineId); err != nil && !errors.Is(err, models.ErrNotFound) {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"cart": cart})
+}
+
+// moveCartItemToWishlistHandler saves a line of the cart for later
+func (app *application) moveCartItemToWishlistHandler(c *gin.Context) {
+	cart, ok := app.readActiveCart(c)
+	if !ok {
+		return
+	}
+
+	lineId := ReadObjectIdParam(c, "lineId")
+	item := cart.GetItem(lineId)
+	if item == nil {
+		app.notFoundError(c)
+		return
+	}
+
+	var payload models.MoveToWishlistPayload
+	if err := c.BindJSON(&payload); err != nil {
+		app.badRequestError(c, err)
+		return
+	}
+
+	wishlist, ok := app.readOwnedWishlist(c, payload.WishlistId)
+	if !ok {
+		return
+	}
+
+	wishlist, ok = app.addWishlistItem(c, wishlist.ID, models.WishlistItemPayload{
+		VariantId: item.VariantId,
+		Size:      item.Size,
+	})
+	if !ok {
+		return
+	}
+
+	if _, err := app.models.Cart.RemoveItem(cart.ID, lineId); err != nil && !errors.Is(err, models.ErrNotFound) {
+		app.internalServerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"wishlist": wishlist})
+}
@@ -0,0 +1,159 @@
+// Package invoice renders invoices and credit notes as PDF documents.
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/GiorgosMarga/ecom_go/models"
+	"github.com/go-pdf/fpdf"
+)
+
+// Seller is the business that issues the documents, printed in their header.
+type Seller struct {
+	Name      string
+	Address   string
+	VATNumber string
+}
+
+// Render returns the PDF of the invoice or the credit note.
+func Render(inv *models.Invoice, seller Seller) ([]byte, error) {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetTitle(inv.DisplayNumber, true)
+	pdf.SetMargins(15, 15, 15)
+	pdf.AddPage()
+
+	title := "INVOICE"
+	if inv.Type == models.InvoiceTypeCreditNote {
+		title = "CREDIT NOTE"
+	}
+
+	// seller on the left, document details on the right
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(100, 8, tr(seller.Name), "", 0, "L", false, 0, "")
+	pdf.CellFormat(80, 8, title, "", 1, "R", false, 0, "")
+	pdf.SetFont("Helvetica", "", 9)
+	details := []string{
+		"Number: " + inv.DisplayNumber,
+		"Date: " + inv.IssuedAt.Format("2006-01-02"),
+		"Order: " + orderReference(inv),
+	}
+	if inv.RefundId != "" {
+		details = append(details, "Refund: "+inv.RefundId)
+	}
+	sellerLines := strings.Split(seller.Address, "\n")
+	if seller.VATNumber != "" {
+		sellerLines = append(sellerLines, "VAT: "+seller.VATNumber)
+	}
+	for i := 0; i < max(len(sellerLines), len(details)); i++ {
+		left, right := "", ""
+		if i < len(sellerLines) {
+			left = sellerLines[i]
+		}
+		if i < len(details) {
+			right = details[i]
+		}
+		pdf.CellFormat(100, 5, tr(left), "", 0, "L", false, 0, "")
+		pdf.CellFormat(80, 5, tr(right), "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(6)
+
+	if a := inv.BillingAddress; a != nil {
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.CellFormat(0, 6, "Bill to", "", 1, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 9)
+		for _, line := range []string{a.Name, a.Line1, a.Line2, strings.TrimSpace(a.PostalCode + " " + a.City), strings.TrimSpace(a.Region + " " + a.Country)} {
+			if line != "" {
+				pdf.CellFormat(0, 5, tr(line), "", 1, "L", false, 0, "")
+			}
+		}
+		pdf.Ln(6)
+	}
+
+	widths := []float64{80, 15, 25, 20, 40}
+	pdf.SetFont("Helvetica", "B", 9)
+	pdf.SetFillColor(235, 235, 235)
+	for i, h := range []string{"Description", "Qty", "Unit price", "Tax", "Total"} {
+		align := "R"
+		if i == 0 {
+			align = "L"
+		}
+		pdf.CellFormat(widths[i], 7, h, "B", 0, align, true, 0, "")
+	}
+	pdf.Ln(-1)
+
+	pdf.SetFont("Helvetica", "", 9)
+	for _, line := range inv.Lines {
+		pdf.CellFormat(widths[0], 6, tr(truncate(line.Description, 50)), "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[1], 6, fmt.Sprint(line.Quantity), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[2], 6, money(line.UnitPrice), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[3], 6, percent(line.TaxRate), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[4], 6, money(line.Total), "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(4)
+
+	total := func(label string, amount int, bold bool) {
+		style := ""
+		if bold {
+			style = "B"
+		}
+		pdf.SetFont("Helvetica", style, 9)
+		pdf.CellFormat(140, 6, label, "", 0, "R", false, 0, "")
+		pdf.CellFormat(40, 6, money(amount), "", 1, "R", false, 0, "")
+	}
+	total("Subtotal", inv.Subtotal, false)
+	if inv.ShippingCost > 0 {
+		total("Shipping", inv.ShippingCost, false)
+	}
+	if inv.Discount > 0 {
+		total("Discount", -inv.Discount, false)
+	}
+	for _, tl := range inv.TaxBreakdown {
+		label := fmt.Sprintf("%s %s on %s", tl.Name, percent(tl.Rate), money(tl.Taxable))
+		if inv.TaxInclusive {
+			label = "incl. " + label
+		}
+		total(tr(label), tl.Tax, false)
+	}
+	total("Total ("+inv.Currency+")", inv.Total, true)
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func orderReference(inv *models.Invoice) string {
+	if inv.OrderNumber == 0 {
+		return inv.OrderId.Hex()
+	}
+	return fmt.Sprintf("#%d", inv.OrderNumber)
+}
+
+// money formats an amount in cents.
+func money(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// percent formats a rate in basis points.
+func percent(bp int) string {
+	if bp%100 == 0 {
+		return fmt.Sprintf("%d%%", bp/100)
+	}
+	return fmt.Sprintf("%d.%02d%%", bp/100, bp%100)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
@@ -0,0 +1,447 @@
+package payment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Outcome is how the fake settles the payments that are confirmed.
+type Outcome int
+
+const (
+	OutcomeSucceed Outcome = iota
+	OutcomeFail
+	// OutcomeRequiresAction asks for 3D Secure, the payment is settled by Authenticate.
+	OutcomeRequiresAction
+)
+
+const fakeSignatureHeader = "Fake-Signature"
+
+var (
+	ErrNotConfirmable = errors.New("the payment intent can't be confirmed in its status")
+	ErrNotRefundable  = fmt.Errorf("%w: the payment intent has no payment left to refund", ErrRefundDeclined)
+	ErrUnknownRefund  = errors.New("unknown refund")
+)
+
+// Fake is an in-process Provider. Intents wait for Confirm, the customer paying, and
+// are settled with the outcome the fake is set to. The webhook events of the payments
+// are delivered to the handler set with OnEvent, after the webhook delay.
+type Fake struct {
+	mu       sync.Mutex
+	secret   string
+	outcome  Outcome
+	delay    time.Duration
+	handler  func(*Event)
+	seq      int
+	intents  map[string]*Intent
+	manual   map[string]bool
+	refunded map[string]int64
+	// results of the requests made with an idempotency key
+	keys   map[string]any
+	events []Event
+	// refunds by ID, the amount of their intent that they succeeded to refund and how
+	// the next refunds are made
+	refunds        map[string]*fakeRefund
+	settled        map[string]int64
+	refundsPending bool
+	refundErr      error
+}
+
+type fakeRefund struct {
+	Refund
+	intentId string
+	metadata map[string]string
+}
+
+// NewFake returns a fake that settles payments successfully and delivers webhook
+// events right away. Its webhook requests are signed with secret.
+func NewFake(secret string) *Fake {
+	return &Fake{
+		secret:   secret,
+		intents:  make(map[string]*Intent),
+		manual:   make(map[string]bool),
+		refunded: make(map[string]int64),
+		keys:     make(map[string]any),
+		refunds:  make(map[string]*fakeRefund),
+		settled:  make(map[string]int64),
+	}
+}
+
+// SetOutcome sets how the next confirmed payments are settled.
+func (f *Fake) SetOutcome(o Outcome) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.outcome = o
+}
+
+// SetWebhookDelay delays the delivery of webhook events, like a provider that is slow
+// to notify.
+func (f *Fake) SetWebhookDelay(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delay = d
+}
+
+// SetRefundsPending makes the next refunds stay pending until they are settled by
+// SettleRefund, like refunds the bank takes days to process.
+func (f *Fake) SetRefundsPending(pending bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refundsPending = pending
+}
+
+// SetRefundError makes the next refunds fail with err without being made, like a
+// provider that times out. A nil err makes refunds work again.
+func (f *Fake) SetRefundError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refundErr = err
+}
+
+// OnEvent sets the handler webhook events are delivered to.
+func (f *Fake) OnEvent(fn func(*Event)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handler = fn
+}
+
+// Events returns every webhook event the fake has sent.
+func (f *Fake) Events() []Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Event(nil), f.events...)
+}
+
+func (f *Fake) nextID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_fake_%d", prefix, f.seq)
+}
+
+func (f *Fake) CreateIntent(p IntentParams) (*Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if prev, ok := f.keys[p.IdempotencyKey].(*Intent); ok && p.IdempotencyKey != "" {
+		intent := *prev
+		return &intent, nil
+	}
+	id := f.nextID("pi")
+	intent := &Intent{
+		ID:           id,
+		ClientSecret: id + "_secret",
+		Amount:       p.Amount,
+		Currency:     p.Currency,
+		Status:       StatusRequiresConfirmation,
+	}
+	f.intents[id] = intent
+	f.manual[id] = p.ManualCapture
+	if p.IdempotencyKey != "" {
+		f.keys[p.IdempotencyKey] = intent
+	}
+	copied := *intent
+	return &copied, nil
+}
+
+func (f *Fake) GetIntent(id string) (*Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, ok := f.intents[id]
+	if !ok {
+		return nil, ErrUnknownIntent
+	}
+	copied := *intent
+	return &copied, nil
+}
+
+// Confirm pays the intent, as the customer would from the client, and settles it with
+// the outcome of the fake.
+func (f *Fake) Confirm(id string) (*Intent, error) {
+	f.mu.Lock()
+	intent, ok := f.intents[id]
+	if !ok {
+		f.mu.Unlock()
+		return nil, ErrUnknownIntent
+	}
+	if intent.Status != StatusRequiresConfirmation && intent.Status != StatusRequiresPaymentMethod {
+		f.mu.Unlock()
+		return nil, ErrNotConfirmable
+	}
+
+	var event *Event
+	switch f.outcome {
+	case OutcomeSucceed:
+		event = f.settle(intent, true)
+	case OutcomeFail:
+		event = f.settle(intent, false)
+	case OutcomeRequiresAction:
+		intent.Status = StatusRequiresAction
+	}
+	copied := *intent
+	f.mu.Unlock()
+
+	f.deliver(event)
+	return &copied, nil
+}
+
+// Authenticate completes the 3D Secure challenge of an intent that requires action.
+func (f *Fake) Authenticate(id string, passed bool) (*Intent, error) {
+	f.mu.Lock()
+	intent, ok := f.intents[id]
+	if !ok {
+		f.mu.Unlock()
+		return nil, ErrUnknownIntent
+	}
+	if intent.Status != StatusRequiresAction {
+		f.mu.Unlock()
+		return nil, ErrNotConfirmable
+	}
+	event := f.settle(intent, passed)
+	copied := *intent
+	f.mu.Unlock()
+
+	f.deliver(event)
+	return &copied, nil
+}
+
+// settle moves the intent to its final status and returns the event to deliver, if
+// any. It must be called with the lock held.
+func (f *Fake) settle(intent *Intent, succeeded bool) *Event {
+	if !succeeded {
+		intent.Status = StatusRequiresPaymentMethod
+		return f.newEvent(Event{
+			Type:            EventPaymentFailed,
+			PaymentIntentId: intent.ID,
+			PaymentAmount:   intent.Amount,
+			FailureReason:   "Your card was declined.",
+		})
+	}
+	if f.manual[intent.ID] {
+		intent.Status = StatusRequiresCapture
+		return nil
+	}
+	intent.Status = StatusSucceeded
+	intent.AmountReceived = intent.Amount
+	return f.newEvent(Event{
+		Type:            EventPaymentSucceeded,
+		PaymentIntentId: intent.ID,
+		Amount:          intent.AmountReceived,
+		PaymentAmount:   intent.Amount,
+	})
+}
+
+func (f *Fake) CaptureIntent(id string, amount int64) (*Intent, error) {
+	f.mu.Lock()
+	intent, ok := f.intents[id]
+	if !ok {
+		f.mu.Unlock()
+		return nil, ErrUnknownIntent
+	}
+	if intent.Status == StatusSucceeded {
+		// already captured
+		copied := *intent
+		f.mu.Unlock()
+		return &copied, nil
+	}
+	if intent.Status != StatusRequiresCapture || amount > intent.Amount {
+		f.mu.Unlock()
+		return nil, ErrNotConfirmable
+	}
+	if amount == 0 {
+		amount = intent.Amount
+	}
+	intent.Status = StatusSucceeded
+	intent.AmountReceived = amount
+	event := f.newEvent(Event{
+		Type:            EventPaymentSucceeded,
+		PaymentIntentId: intent.ID,
+		Amount:          amount,
+		PaymentAmount:   intent.Amount,
+	})
+	copied := *intent
+	f.mu.Unlock()
+
+	f.deliver(event)
+	return &copied, nil
+}
+
+func (f *Fake) CancelIntent(id string) (*Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, ok := f.intents[id]
+	if !ok {
+		return nil, ErrUnknownIntent
+	}
+	if intent.Status == StatusSucceeded || intent.Status == StatusProcessing {
+		return nil, ErrNotCancelable
+	}
+	intent.Status = StatusCanceled
+	copied := *intent
+	return &copied, nil
+}
+
+func (f *Fake) Refund(p RefundParams) (*Refund, error) {
+	f.mu.Lock()
+	if f.refundErr != nil {
+		err := f.refundErr
+		f.mu.Unlock()
+		return nil, err
+	}
+	if prev, ok := f.keys[p.IdempotencyKey].(*fakeRefund); ok && p.IdempotencyKey != "" {
+		f.mu.Unlock()
+		refund := prev.Refund
+		return &refund, nil
+	}
+	intent, ok := f.intents[p.PaymentIntentId]
+	if !ok {
+		f.mu.Unlock()
+		return nil, errors.Join(ErrRefundDeclined, ErrUnknownIntent)
+	}
+	left := intent.AmountReceived - f.refunded[intent.ID]
+	amount := p.Amount
+	if amount == 0 {
+		amount = left
+	}
+	if intent.Status != StatusSucceeded || amount <= 0 || amount > left {
+		f.mu.Unlock()
+		return nil, ErrNotRefundable
+	}
+
+	f.refunded[intent.ID] += amount
+	refund := &fakeRefund{
+		Refund:   Refund{ID: f.nextID("re"), Amount: amount, Status: RefundStatusSucceeded},
+		intentId: intent.ID,
+		metadata: p.Metadata,
+	}
+	f.refunds[refund.ID] = refund
+	if p.IdempotencyKey != "" {
+		f.keys[p.IdempotencyKey] = refund
+	}
+	var event *Event
+	if f.refundsPending {
+		refund.Status = RefundStatusPending
+	} else {
+		event = f.refundSucceeded(refund)
+	}
+	copied := refund.Refund
+	f.mu.Unlock()
+
+	f.deliver(event)
+	return &copied, nil
+}
+
+// SettleRefund settles a pending refund and delivers its refund.updated event. A
+// refund that fails gives its amount back to the payment.
+func (f *Fake) SettleRefund(id string, succeeded bool) (*Refund, error) {
+	f.mu.Lock()
+	refund, ok := f.refunds[id]
+	if !ok {
+		f.mu.Unlock()
+		return nil, ErrUnknownRefund
+	}
+	if refund.Status != RefundStatusPending {
+		copied := refund.Refund
+		f.mu.Unlock()
+		return &copied, nil
+	}
+
+	var refunded *Event
+	if succeeded {
+		refund.Status = RefundStatusSucceeded
+		refunded = f.refundSucceeded(refund)
+	} else {
+		refund.Status = RefundStatusFailed
+		f.refunded[refund.intentId] -= refund.Amount
+	}
+	updated := f.newEvent(Event{
+		Type:            EventRefundUpdated,
+		PaymentIntentId: refund.intentId,
+		ChargeId:        "ch_" + refund.intentId,
+		Amount:          refund.Amount,
+		RefundId:        refund.ID,
+		RefundStatus:    refund.Status,
+		Metadata:        refund.metadata,
+	})
+	copied := refund.Refund
+	f.mu.Unlock()
+
+	f.deliver(updated)
+	f.deliver(refunded)
+	return &copied, nil
+}
+
+// refundSucceeded counts the refund as refunded and returns the charge.refunded event
+// of its intent. It must be called with the lock held.
+func (f *Fake) refundSucceeded(refund *fakeRefund) *Event {
+	f.settled[refund.intentId] += refund.Amount
+	return f.newEvent(Event{
+		Type:            EventRefunded,
+		PaymentIntentId: refund.intentId,
+		ChargeId:        "ch_" + refund.intentId,
+		Amount:          f.settled[refund.intentId],
+		PaymentAmount:   f.intents[refund.intentId].AmountReceived,
+	})
+}
+
+// newEvent gives the event an ID and records it. It must be called with the lock held.
+func (f *Fake) newEvent(e Event) *Event {
+	e.ID = f.nextID("evt")
+	f.events = append(f.events, e)
+	return &e
+}
+
+// deliver sends the event to the handler, after the webhook delay. It must be called
+// without the lock, the handler may call the fake.
+func (f *Fake) deliver(e *Event) {
+	if e == nil {
+		return
+	}
+	f.mu.Lock()
+	handler, delay := f.handler, f.delay
+	f.mu.Unlock()
+	if handler == nil {
+		return
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, func() { handler(e) })
+		return
+	}
+	handler(e)
+}
+
+// SignWebhook returns the body and the headers of a webhook request for the event, for
+// sending the event over HTTP.
+func (f *Fake) SignWebhook(e Event) ([]byte, http.Header, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := http.Header{}
+	header.Set(fakeSignatureHeader, f.sign(payload))
+	return payload, header, nil
+}
+
+func (f *Fake) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(f.secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f *Fake) ParseWebhook(payload []byte, header http.Header) (*Event, error) {
+	if !hmac.Equal([]byte(header.Get(fakeSignatureHeader)), []byte(f.sign(payload))) {
+		return nil, ErrInvalidSignature
+	}
+	var e Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
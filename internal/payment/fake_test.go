@@ -0,0 +1,274 @@
+package payment
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFakeOutcomes(t *testing.T) {
+	tests := []struct {
+		name         string
+		outcome      Outcome
+		authenticate *bool
+		wantStatus   string
+		wantEvents   []string
+	}{
+		{
+			name:       "success",
+			outcome:    OutcomeSucceed,
+			wantStatus: StatusSucceeded,
+			wantEvents: []string{EventPaymentSucceeded},
+		},
+		{
+			name:       "failure",
+			outcome:    OutcomeFail,
+			wantStatus: StatusRequiresPaymentMethod,
+			wantEvents: []string{EventPaymentFailed},
+		},
+		{
+			name:       "3ds pending",
+			outcome:    OutcomeRequiresAction,
+			wantStatus: StatusRequiresAction,
+		},
+		{
+			name:         "3ds passed",
+			outcome:      OutcomeRequiresAction,
+			authenticate: ptr(true),
+			wantStatus:   StatusSucceeded,
+			wantEvents:   []string{EventPaymentSucceeded},
+		},
+		{
+			name:         "3ds failed",
+			outcome:      OutcomeRequiresAction,
+			authenticate: ptr(false),
+			wantStatus:   StatusRequiresPaymentMethod,
+			wantEvents:   []string{EventPaymentFailed},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := NewFake("secret")
+			fake.SetOutcome(tt.outcome)
+			var delivered []string
+			fake.OnEvent(func(e *Event) { delivered = append(delivered, e.Type) })
+
+			intent, err := fake.CreateIntent(IntentParams{Amount: 1000, Currency: "usd"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if intent, err = fake.Confirm(intent.ID); err != nil {
+				t.Fatal(err)
+			}
+			if tt.authenticate != nil {
+				if intent, err = fake.Authenticate(intent.ID, *tt.authenticate); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if intent.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", intent.Status, tt.wantStatus)
+			}
+			if len(delivered) != len(tt.wantEvents) {
+				t.Fatalf("events = %v, want %v", delivered, tt.wantEvents)
+			}
+			for i := range delivered {
+				if delivered[i] != tt.wantEvents[i] {
+					t.Errorf("events = %v, want %v", delivered, tt.wantEvents)
+				}
+			}
+		})
+	}
+}
+
+func TestFakeRefund(t *testing.T) {
+	fake := NewFake("secret")
+	intent, _ := fake.CreateIntent(IntentParams{Amount: 1000, Currency: "usd"})
+
+	if _, err := fake.Refund(RefundParams{PaymentIntentId: intent.ID}); !errors.Is(err, ErrNotRefundable) {
+		t.Errorf("refund of an unpaid intent: err = %v, want ErrNotRefundable", err)
+	}
+	if _, err := fake.Confirm(intent.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := fake.Refund(RefundParams{PaymentIntentId: intent.ID, Amount: 400, IdempotencyKey: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retry, err := fake.Refund(RefundParams{PaymentIntentId: intent.ID, Amount: 400, IdempotencyKey: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry.ID != first.ID {
+		t.Errorf("retry refund ID = %q, want %q", retry.ID, first.ID)
+	}
+	if _, err := fake.Refund(RefundParams{PaymentIntentId: intent.ID, Amount: 700}); !errors.Is(err, ErrNotRefundable) {
+		t.Errorf("over-refund: err = %v, want ErrNotRefundable", err)
+	}
+	rest, err := fake.Refund(RefundParams{PaymentIntentId: intent.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rest.Amount != 600 {
+		t.Errorf("refund of the rest = %d, want 600", rest.Amount)
+	}
+}
+
+func TestFakePendingRefund(t *testing.T) {
+	tests := []struct {
+		name         string
+		succeeded    bool
+		wantStatus   string
+		wantEvents   []string
+		wantRefunded int64
+	}{
+		{
+			name:         "succeeded",
+			succeeded:    true,
+			wantStatus:   RefundStatusSucceeded,
+			wantEvents:   []string{EventRefundUpdated, EventRefunded},
+			wantRefunded: 1000,
+		},
+		{
+			name:       "failed",
+			wantStatus: RefundStatusFailed,
+			wantEvents: []string{EventRefundUpdated},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := NewFake("secret")
+			intent, _ := fake.CreateIntent(IntentParams{Amount: 1000, Currency: "usd"})
+			if _, err := fake.Confirm(intent.ID); err != nil {
+				t.Fatal(err)
+			}
+			var delivered []*Event
+			fake.OnEvent(func(e *Event) { delivered = append(delivered, e) })
+			fake.SetRefundsPending(true)
+
+			refund, err := fake.Refund(RefundParams{PaymentIntentId: intent.ID, Metadata: map[string]string{"refund_id": "r1"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if refund.Status != RefundStatusPending || len(delivered) != 0 {
+				t.Fatalf("refund status = %q with events %v, want pending without events", refund.Status, delivered)
+			}
+
+			if refund, err = fake.SettleRefund(refund.ID, tt.succeeded); err != nil {
+				t.Fatal(err)
+			}
+			if refund.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", refund.Status, tt.wantStatus)
+			}
+			if len(delivered) != len(tt.wantEvents) {
+				t.Fatalf("events = %d, want %v", len(delivered), tt.wantEvents)
+			}
+			for i, e := range delivered {
+				if e.Type != tt.wantEvents[i] {
+					t.Errorf("event %d = %q, want %q", i, e.Type, tt.wantEvents[i])
+				}
+			}
+			updated := delivered[0]
+			if updated.RefundId != refund.ID || updated.RefundStatus != tt.wantStatus || updated.Metadata["refund_id"] != "r1" {
+				t.Errorf("refund.updated = %+v, want refund %q %q with its metadata", updated, refund.ID, tt.wantStatus)
+			}
+			if tt.succeeded && delivered[1].Amount != tt.wantRefunded {
+				t.Errorf("refunded = %d, want %d", delivered[1].Amount, tt.wantRefunded)
+			}
+
+			// a failed refund gives its amount back to the payment
+			_, err = fake.Refund(RefundParams{PaymentIntentId: intent.ID})
+			if tt.succeeded != errors.Is(err, ErrNotRefundable) {
+				t.Errorf("refund after settling: err = %v", err)
+			}
+		})
+	}
+}
+
+func TestFakeRefundErrors(t *testing.T) {
+	fake := NewFake("secret")
+	intent, _ := fake.CreateIntent(IntentParams{Amount: 1000, Currency: "usd"})
+	if _, err := fake.Confirm(intent.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fake.Refund(RefundParams{PaymentIntentId: intent.ID, Amount: 2000}); !errors.Is(err, ErrRefundDeclined) {
+		t.Errorf("over-refund: err = %v, want ErrRefundDeclined", err)
+	}
+	if _, err := fake.Refund(RefundParams{PaymentIntentId: "pi_unknown"}); !errors.Is(err, ErrRefundDeclined) {
+		t.Errorf("unknown intent: err = %v, want ErrRefundDeclined", err)
+	}
+
+	timeout := errors.New("timeout")
+	fake.SetRefundError(timeout)
+	if _, err := fake.Refund(RefundParams{PaymentIntentId: intent.ID, IdempotencyKey: "k"}); !errors.Is(err, timeout) || errors.Is(err, ErrRefundDeclined) {
+		t.Errorf("failing provider: err = %v, want the timeout", err)
+	}
+	fake.SetRefundError(nil)
+	refund, err := fake.Refund(RefundParams{PaymentIntentId: intent.ID, IdempotencyKey: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refund.Amount != 1000 {
+		t.Errorf("retried refund = %d, want 1000", refund.Amount)
+	}
+}
+
+func TestFakeDelayedWebhook(t *testing.T) {
+	fake := NewFake("secret")
+	fake.SetWebhookDelay(20 * time.Millisecond)
+	delivered := make(chan *Event, 1)
+	fake.OnEvent(func(e *Event) { delivered <- e })
+
+	intent, _ := fake.CreateIntent(IntentParams{Amount: 1000, Currency: "usd"})
+	if _, err := fake.Confirm(intent.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-delivered:
+		t.Fatal("event delivered before the delay")
+	default:
+	}
+	select {
+	case e := <-delivered:
+		if e.PaymentIntentId != intent.ID {
+			t.Errorf("event intent = %q, want %q", e.PaymentIntentId, intent.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event never delivered")
+	}
+}
+
+func TestFakeParseWebhook(t *testing.T) {
+	fake := NewFake("secret")
+	sent := Event{ID: "evt_1", Type: EventPaymentSucceeded, PaymentIntentId: "pi_1", Amount: 1000}
+	payload, header, err := fake.SignWebhook(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := fake.ParseWebhook(payload, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*got, sent) {
+		t.Errorf("event = %+v, want %+v", *got, sent)
+	}
+
+	if _, err := NewFake("other").ParseWebhook(payload, header); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("other secret: err = %v, want ErrInvalidSignature", err)
+	}
+	if _, err := fake.ParseWebhook(payload, http.Header{}); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("unsigned: err = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,118 @@
+// Package payment talks to the payment provider. The API only uses the Provider
+// interface, implemented by Stripe for real payments and by Fake for tests and local
+// development.
+package payment
+
+import (
+	"errors"
+	"net/http"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrUnknownIntent    = errors.New("unknown payment intent")
+	// the intent was paid, or is being paid, and can't be canceled anymore
+	ErrNotCancelable = errors.New("the payment intent can't be canceled in its status")
+	// the provider refused the refund and will refuse it again. Other refund errors,
+	// like timeouts, leave it unknown whether the refund was made.
+	ErrRefundDeclined = errors.New("the payment provider declined the refund")
+)
+
+// Intent statuses, the same as Stripe's.
+const (
+	StatusRequiresPaymentMethod = "requires_payment_method"
+	StatusRequiresConfirmation  = "requires_confirmation"
+	StatusRequiresAction        = "requires_action"
+	StatusRequiresCapture       = "requires_capture"
+	StatusProcessing            = "processing"
+	StatusSucceeded             = "succeeded"
+	StatusCanceled              = "canceled"
+)
+
+// Webhook event types that the API handles. Other events keep the type the provider
+// gave them.
+const (
+	EventPaymentSucceeded = "payment_intent.succeeded"
+	EventPaymentFailed    = "payment_intent.payment_failed"
+	EventRefunded         = "charge.refunded"
+	// the status of a refund changed, Stripe's charge.refund.updated has this type too
+	EventRefundUpdated = "refund.updated"
+)
+
+// Refund statuses, the same as Stripe's.
+const (
+	RefundStatusPending   = "pending"
+	RefundStatusSucceeded = "succeeded"
+	RefundStatusFailed    = "failed"
+	RefundStatusCanceled  = "canceled"
+)
+
+// Intent is a payment of an amount in cents. The client confirms it with the client
+// secret.
+type Intent struct {
+	ID             string
+	ClientSecret   string
+	Amount         int64
+	AmountReceived int64
+	Currency       string
+	Status         string
+}
+
+type IntentParams struct {
+	Amount   int64
+	Currency string
+	// ManualCapture only authorizes the payment, it is taken by Capture.
+	ManualCapture bool
+	Metadata      map[string]string
+	// requests with the same key return the intent of the first one
+	IdempotencyKey string
+}
+
+type Refund struct {
+	ID     string
+	Amount int64
+	Status string
+}
+
+type RefundParams struct {
+	PaymentIntentId string
+	// zero refunds whatever is left of the payment
+	Amount         int64
+	Metadata       map[string]string
+	IdempotencyKey string
+}
+
+// Event is a webhook event of the provider. Amount is the amount received for payment
+// events, the total refunded for charge.refunded and the amount of the refund for
+// refund.updated.
+type Event struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	PaymentIntentId string `json:"payment_intent_id"`
+	ChargeId        string `json:"charge_id,omitempty"`
+	Amount          int64  `json:"amount"`
+	// amount of the payment, for refund events
+	PaymentAmount int64  `json:"payment_amount"`
+	FailureReason string `json:"failure_reason,omitempty"`
+	// the refund of refund.updated, with the metadata it was created with
+	RefundId     string            `json:"refund_id,omitempty"`
+	RefundStatus string            `json:"refund_status,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+type Provider interface {
+	CreateIntent(params IntentParams) (*Intent, error)
+	GetIntent(id string) (*Intent, error)
+	// CaptureIntent takes an authorized payment, amount zero captures all of it.
+	CaptureIntent(id string, amount int64) (*Intent, error)
+	// CancelIntent cancels an intent that hasn't been paid, so that it can't be paid
+	// anymore. It returns ErrNotCancelable if the payment succeeded or is under way.
+	CancelIntent(id string) (*Intent, error)
+	// Refund refunds the payment of an intent. It returns ErrRefundDeclined if the
+	// provider refused the refund, retrying a refund that failed with another error
+	// with the same idempotency key never refunds twice.
+	Refund(params RefundParams) (*Refund, error)
+	// ParseWebhook verifies the signature of a webhook request and decodes its event.
+	// It returns ErrInvalidSignature if the request wasn't sent by the provider.
+	ParseWebhook(payload []byte, header http.Header) (*Event, error)
+}
@@ -0,0 +1,183 @@
+package payment
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/client"
+	"github.com/stripe/stripe-go/v81/webhook"
+)
+
+// Stripe is the Provider of real payments. It has its own API client, so that
+// nothing depends on the global key of the stripe package.
+type Stripe struct {
+	api           *client.API
+	webhookSecret string
+}
+
+func NewStripe(key, webhookSecret string) *Stripe {
+	return &Stripe{api: client.New(key, nil), webhookSecret: webhookSecret}
+}
+
+func newIntent(pi *stripe.PaymentIntent) *Intent {
+	return &Intent{
+		ID:             pi.ID,
+		ClientSecret:   pi.ClientSecret,
+		Amount:         pi.Amount,
+		AmountReceived: pi.AmountReceived,
+		Currency:       string(pi.Currency),
+		Status:         string(pi.Status),
+	}
+}
+
+func (s *Stripe) CreateIntent(p IntentParams) (*Intent, error) {
+	params := &stripe.PaymentIntentParams{
+		Amount:   stripe.Int64(p.Amount),
+		Currency: stripe.String(p.Currency),
+		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
+			Enabled: stripe.Bool(true),
+		},
+	}
+	if p.ManualCapture {
+		params.CaptureMethod = stripe.String(string(stripe.PaymentIntentCaptureMethodManual))
+	}
+	for k, v := range p.Metadata {
+		params.AddMetadata(k, v)
+	}
+	if p.IdempotencyKey != "" {
+		params.SetIdempotencyKey(p.IdempotencyKey)
+	}
+
+	pi, err := s.api.PaymentIntents.New(params)
+	if err != nil {
+		return nil, err
+	}
+	return newIntent(pi), nil
+}
+
+func (s *Stripe) GetIntent(id string) (*Intent, error) {
+	pi, err := s.api.PaymentIntents.Get(id, nil)
+	if err != nil {
+		var serr *stripe.Error
+		if errors.As(err, &serr) && serr.Code == stripe.ErrorCodeResourceMissing {
+			return nil, ErrUnknownIntent
+		}
+		return nil, err
+	}
+	return newIntent(pi), nil
+}
+
+func (s *Stripe) CaptureIntent(id string, amount int64) (*Intent, error) {
+	params := &stripe.PaymentIntentCaptureParams{}
+	if amount > 0 {
+		params.AmountToCapture = stripe.Int64(amount)
+	}
+	params.SetIdempotencyKey("capture-" + id)
+
+	pi, err := s.api.PaymentIntents.Capture(id, params)
+	if err != nil {
+		return nil, err
+	}
+	return newIntent(pi), nil
+}
+
+func (s *Stripe) CancelIntent(id string) (*Intent, error) {
+	params := &stripe.PaymentIntentCancelParams{
+		CancellationReason: stripe.String(string(stripe.PaymentIntentCancellationReasonAbandoned)),
+	}
+	params.SetIdempotencyKey("cancel-" + id)
+
+	pi, err := s.api.PaymentIntents.Cancel(id, params)
+	if err != nil {
+		var serr *stripe.Error
+		if errors.As(err, &serr) && serr.Code == stripe.ErrorCodePaymentIntentUnexpectedState {
+			return nil, ErrNotCancelable
+		}
+		return nil, err
+	}
+	return newIntent(pi), nil
+}
+
+func (s *Stripe) Refund(p RefundParams) (*Refund, error) {
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(p.PaymentIntentId),
+		Reason:        stripe.String(string(stripe.RefundReasonRequestedByCustomer)),
+	}
+	if p.Amount > 0 {
+		params.Amount = stripe.Int64(p.Amount)
+	}
+	for k, v := range p.Metadata {
+		params.AddMetadata(k, v)
+	}
+	if p.IdempotencyKey != "" {
+		params.SetIdempotencyKey(p.IdempotencyKey)
+	}
+
+	r, err := s.api.Refunds.New(params)
+	if err != nil {
+		// invalid requests, like refunding more than is left, and card errors are
+		// final, rate limits, conflicts and server errors are not
+		var serr *stripe.Error
+		if errors.As(err, &serr) && (serr.HTTPStatusCode == http.StatusBadRequest ||
+			serr.HTTPStatusCode == http.StatusPaymentRequired || serr.HTTPStatusCode == http.StatusNotFound) {
+			return nil, errors.Join(ErrRefundDeclined, err)
+		}
+		return nil, err
+	}
+	return &Refund{ID: r.ID, Amount: r.Amount, Status: string(r.Status)}, nil
+}
+
+func (s *Stripe) ParseWebhook(payload []byte, header http.Header) (*Event, error) {
+	se, err := webhook.ConstructEvent(payload, header.Get("Stripe-Signature"), s.webhookSecret)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidSignature, err)
+	}
+
+	event := &Event{ID: se.ID, Type: string(se.Type)}
+	switch event.Type {
+	case EventPaymentSucceeded, EventPaymentFailed:
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(se.Data.Raw, &pi); err != nil {
+			return nil, err
+		}
+		event.PaymentIntentId = pi.ID
+		event.Amount = pi.AmountReceived
+		event.PaymentAmount = pi.Amount
+		if pi.LastPaymentError != nil {
+			event.FailureReason = pi.LastPaymentError.Msg
+		}
+	case EventRefunded:
+		var ch stripe.Charge
+		if err := json.Unmarshal(se.Data.Raw, &ch); err != nil {
+			return nil, err
+		}
+		event.ChargeId = ch.ID
+		event.Amount = ch.AmountRefunded
+		event.PaymentAmount = ch.Amount
+		if ch.PaymentIntent != nil {
+			event.PaymentIntentId = ch.PaymentIntent.ID
+		}
+	case EventRefundUpdated, "charge.refund.updated":
+		var r stripe.Refund
+		if err := json.Unmarshal(se.Data.Raw, &r); err != nil {
+			return nil, err
+		}
+		event.Type = EventRefundUpdated
+		event.RefundId = r.ID
+		event.RefundStatus = string(r.Status)
+		event.Amount = r.Amount
+		event.Metadata = r.Metadata
+		if r.PaymentIntent != nil {
+			event.PaymentIntentId = r.PaymentIntent.ID
+		}
+		if r.Charge != nil {
+			event.ChargeId = r.Charge.ID
+		}
+		if r.FailureReason != "" {
+			event.FailureReason = string(r.FailureReason)
+		}
+	}
+	return event, nil
+}
@@ -0,0 +1,186 @@
+// Package pricing computes the price of orders from the catalog. It is the only
+// place where order totals are calculated, totals sent by clients are never trusted.
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/GiorgosMarga/ecom_go/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrEmptyOrder   = errors.New("order has no products")
+	ErrInvalidOrder = errors.New("order contains invalid or unavailable products")
+)
+
+// Catalog looks up the current price, stock and product info of variants.
+// models.VariantModel implements it.
+type Catalog interface {
+	GetCatalog(ids []primitive.ObjectID) (map[primitive.ObjectID]models.CatalogVariant, error)
+}
+
+// LineError explains why a line of an order can't be priced.
+type LineError struct {
+	VariantId primitive.ObjectID `json:"variant_id"`
+	Size      string             `json:"size"`
+	Reason    string             `json:"reason"`
+}
+
+// InvalidLinesError is returned when at least one line of an order is invalid.
+// It lists every invalid line so the client can fix them all at once.
+type InvalidLinesError struct {
+	Lines []LineError `json:"lines"`
+}
+
+func (e *InvalidLinesError) Error() string {
+	reasons := make([]string, 0, len(e.Lines))
+	for _, l := range e.Lines {
+		reasons = append(reasons, fmt.Sprintf("%s/%s: %s", l.VariantId.Hex(), l.Size, l.Reason))
+	}
+	return fmt.Sprintf("%s: %s", ErrInvalidOrder, strings.Join(reasons, ", "))
+}
+
+func (e *InvalidLinesError) Unwrap() error {
+	return ErrInvalidOrder
+}
+
+// Line is a priced line of a quote.
+type Line struct {
+	VariantId primitive.ObjectID `json:"variant_id"`
+	Size      string             `json:"size"`
+	Quantity  int                `json:"quantity"`
+	SKU       string             `json:"sku"`
+	Name      string             `json:"name"`
+	Color     string             `json:"color"`
+	Image     string             `json:"image,omitempty"`
+	UnitPrice int                `json:"unit_price"`
+	LineTotal int                `json:"line_total"`
+	// shipping weight of the line in grams
+	Weight   int    `json:"weight"`
+	TaxClass string `json:"tax_class"`
+}
+
+// Quote is the per line breakdown of the price of an order.
+type Quote struct {
+	Lines    []Line `json:"lines"`
+	Subtotal int    `json:"subtotal"`
+	Weight   int    `json:"weight"`
+}
+
+type Service struct {
+	catalog Catalog
+}
+
+func New(catalog Catalog) *Service {
+	return &Service{catalog: catalog}
+}
+
+// Quote prices the lines against the current catalog. Lines with the same variant and
+// size are merged into one, so that stock is checked against the total quantity. The
+// whole order is rejected if any line is invalid: unknown variant or size, non positive
+// quantity or not enough stock.
+func (s *Service) Quote(lines []models.OrderLinePayload) (*Quote, error) {
+	if len(lines) == 0 {
+		return nil, ErrEmptyOrder
+	}
+
+	type key struct {
+		variantId primitive.ObjectID
+		size      string
+	}
+	merged := make([]models.OrderLinePayload, 0, len(lines))
+	index := make(map[key]int)
+	ids := make([]primitive.ObjectID, 0, len(lines))
+	for _, line := range lines {
+		k := key{line.VariantId, line.Size}
+		if i, ok := index[k]; ok {
+			merged[i].Quantity += line.Quantity
+			continue
+		}
+		index[k] = len(merged)
+		merged = append(merged, line)
+		ids = append(ids, line.VariantId)
+	}
+
+	catalog, err := s.catalog.GetCatalog(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	quote := &Quote{Lines: make([]Line, 0, len(merged))}
+	invalid := &InvalidLinesError{}
+	for _, line := range merged {
+		lineErr := LineError{VariantId: line.VariantId, Size: line.Size}
+
+		if line.Quantity <= 0 {
+			lineErr.Reason = "quantity must be positive"
+			invalid.Lines = append(invalid.Lines, lineErr)
+			continue
+		}
+		cv, ok := catalog[line.VariantId]
+		if !ok {
+			lineErr.Reason = "unknown variant"
+			invalid.Lines = append(invalid.Lines, lineErr)
+			continue
+		}
+		size := cv.GetSize(line.Size)
+		if size == nil {
+			lineErr.Reason = "unknown size"
+			invalid.Lines = append(invalid.Lines, lineErr)
+			continue
+		}
+		if size.Stock < line.Quantity {
+			lineErr.Reason = fmt.Sprintf("only %d items in stock", size.Stock)
+			invalid.Lines = append(invalid.Lines, lineErr)
+			continue
+		}
+
+		priced := Line{
+			VariantId: line.VariantId,
+			Size:      line.Size,
+			Quantity:  line.Quantity,
+			SKU:       size.SKU,
+			Name:      cv.Name,
+			Color:     cv.Color,
+			UnitPrice: cv.Price,
+			LineTotal: cv.Price * line.Quantity,
+			Weight:    cv.Weight * line.Quantity,
+			TaxClass:  cv.TaxClass,
+		}
+		if len(cv.Img) > 0 {
+			priced.Image = cv.Img[0]
+		}
+		quote.Lines = append(quote.Lines, priced)
+		quote.Subtotal += priced.LineTotal
+		quote.Weight += priced.Weight
+	}
+
+	if len(invalid.Lines) > 0 {
+		return nil, invalid
+	}
+	return quote, nil
+}
+
+// Apply snapshots the priced lines onto the order and computes its total.
+func (q *Quote) Apply(order *models.Order) {
+	order.Products = make([]models.OrderProducts, 0, len(q.Lines))
+	for _, line := range q.Lines {
+		order.Products = append(order.Products, models.OrderProducts{
+			ID:        primitive.NewObjectID(),
+			Variant:   line.VariantId,
+			Size:      line.Size,
+			Quantity:  line.Quantity,
+			SKU:       line.SKU,
+			Name:      line.Name,
+			Color:     line.Color,
+			Image:     line.Image,
+			UnitPrice: line.UnitPrice,
+			LineTotal: line.LineTotal,
+			TaxClass:  line.TaxClass,
+		})
+	}
+	order.ComputeTotal()
+}
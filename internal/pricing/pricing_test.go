@@ -0,0 +1,247 @@
+package pricing
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/GiorgosMarga/ecom_go/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type fakeCatalog map[primitive.ObjectID]models.CatalogVariant
+
+func (f fakeCatalog) GetCatalog(ids []primitive.ObjectID) (map[primitive.ObjectID]models.CatalogVariant, error) {
+	catalog := make(map[primitive.ObjectID]models.CatalogVariant)
+	for _, id := range ids {
+		if cv, ok := f[id]; ok {
+			catalog[id] = cv
+		}
+	}
+	return catalog, nil
+}
+
+type failingCatalog struct{}
+
+func (failingCatalog) GetCatalog([]primitive.ObjectID) (map[primitive.ObjectID]models.CatalogVariant, error) {
+	return nil, errors.New("database is down")
+}
+
+func TestQuote(t *testing.T) {
+	shirt := primitive.NewObjectID()
+	shoes := primitive.NewObjectID()
+	unknown := primitive.NewObjectID()
+
+	catalog := fakeCatalog{
+		shirt: {
+			VariantId: shirt,
+			Name:      "Shirt",
+			Color:     "red",
+			Img:       []string{"shirt.png"},
+			Price:     1500,
+			Sizes: []models.SizesAndStock{
+				{Size: "M", Stock: 5, SKU: "SHIRT-RED-M"},
+				{Size: "L", Stock: 0, SKU: "SHIRT-RED-L"},
+			},
+		},
+		shoes: {
+			VariantId: shoes,
+			Name:      "Shoes",
+			Color:     "black",
+			Price:     8000,
+			Sizes: []models.SizesAndStock{
+				{Size: "42", Stock: 1000, SKU: "SHOES-BLK-42"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		lines        []models.OrderLinePayload
+		wantSubtotal int
+		wantLines    int
+		wantErr      error
+		wantInvalid  []string
+	}{
+		{
+			name:    "empty order",
+			lines:   nil,
+			wantErr: ErrEmptyOrder,
+		},
+		{
+			name: "single line",
+			lines: []models.OrderLinePayload{
+				{VariantId: shirt, Size: "M", Quantity: 2},
+			},
+			wantSubtotal: 3000,
+			wantLines:    1,
+		},
+		{
+			name: "total does not depend on stock",
+			lines: []models.OrderLinePayload{
+				{VariantId: shoes, Size: "42", Quantity: 1},
+			},
+			wantSubtotal: 8000,
+			wantLines:    1,
+		},
+		{
+			name: "multiple lines",
+			lines: []models.OrderLinePayload{
+				{VariantId: shirt, Size: "M", Quantity: 1},
+				{VariantId: shoes, Size: "42", Quantity: 2},
+			},
+			wantSubtotal: 17500,
+			wantLines:    2,
+		},
+		{
+			name: "duplicate lines are merged",
+			lines: []models.OrderLinePayload{
+				{VariantId: shirt, Size: "M", Quantity: 2},
+				{VariantId: shirt, Size: "M", Quantity: 3},
+			},
+			wantSubtotal: 7500,
+			wantLines:    1,
+		},
+		{
+			name: "duplicate lines exceeding stock together",
+			lines: []models.OrderLinePayload{
+				{VariantId: shirt, Size: "M", Quantity: 3},
+				{VariantId: shirt, Size: "M", Quantity: 3},
+			},
+			wantErr:     ErrInvalidOrder,
+			wantInvalid: []string{"only 5 items in stock"},
+		},
+		{
+			name: "quantity equal to stock",
+			lines: []models.OrderLinePayload{
+				{VariantId: shirt, Size: "M", Quantity: 5},
+			},
+			wantSubtotal: 7500,
+			wantLines:    1,
+		},
+		{
+			name: "quantity above stock",
+			lines: []models.OrderLinePayload{
+				{VariantId: shirt, Size: "M", Quantity: 6},
+			},
+			wantErr:     ErrInvalidOrder,
+			wantInvalid: []string{"only 5 items in stock"},
+		},
+		{
+			name: "size out of stock",
+			lines: []models.OrderLinePayload{
+				{VariantId: shirt, Size: "L", Quantity: 1},
+			},
+			wantErr:     ErrInvalidOrder,
+			wantInvalid: []string{"only 0 items in stock"},
+		},
+		{
+			name: "missing variant",
+			lines: []models.OrderLinePayload{
+				{VariantId: unknown, Size: "M", Quantity: 1},
+			},
+			wantErr:     ErrInvalidOrder,
+			wantInvalid: []string{"unknown variant"},
+		},
+		{
+			name: "missing size",
+			lines: []models.OrderLinePayload{
+				{VariantId: shirt, Size: "XXL", Quantity: 1},
+			},
+			wantErr:     ErrInvalidOrder,
+			wantInvalid: []string{"unknown size"},
+		},
+		{
+			name: "zero quantity",
+			lines: []models.OrderLinePayload{
+				{VariantId: shirt, Size: "M", Quantity: 0},
+			},
+			wantErr:     ErrInvalidOrder,
+			wantInvalid: []string{"quantity must be positive"},
+		},
+		{
+			name: "one invalid line rejects the whole order",
+			lines: []models.OrderLinePayload{
+				{VariantId: shirt, Size: "M", Quantity: 1},
+				{VariantId: unknown, Size: "M", Quantity: 1},
+				{VariantId: shoes, Size: "41", Quantity: 1},
+			},
+			wantErr:     ErrInvalidOrder,
+			wantInvalid: []string{"unknown variant", "unknown size"},
+		},
+	}
+
+	s := New(catalog)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quote, err := s.Quote(tt.lines)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				if tt.wantInvalid == nil {
+					return
+				}
+				var linesErr *InvalidLinesError
+				if !errors.As(err, &linesErr) {
+					t.Fatalf("expected an InvalidLinesError, got %T", err)
+				}
+				if len(linesErr.Lines) != len(tt.wantInvalid) {
+					t.Fatalf("expected %d invalid lines, got %d", len(tt.wantInvalid), len(linesErr.Lines))
+				}
+				for i, reason := range tt.wantInvalid {
+					if linesErr.Lines[i].Reason != reason {
+						t.Errorf("line %d: expected reason %q, got %q", i, reason, linesErr.Lines[i].Reason)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if quote.Subtotal != tt.wantSubtotal {
+				t.Errorf("expected subtotal %d, got %d", tt.wantSubtotal, quote.Subtotal)
+			}
+			if len(quote.Lines) != tt.wantLines {
+				t.Errorf("expected %d lines, got %d", tt.wantLines, len(quote.Lines))
+			}
+		})
+	}
+}
+
+func TestQuoteCatalogError(t *testing.T) {
+	_, err := New(failingCatalog{}).Quote([]models.OrderLinePayload{
+		{VariantId: primitive.NewObjectID(), Size: "M", Quantity: 1},
+	})
+	if err == nil || errors.Is(err, ErrInvalidOrder) {
+		t.Fatalf("expected the catalog error, got %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	shirt := primitive.NewObjectID()
+	quote := &Quote{
+		Lines: []Line{
+			{VariantId: shirt, Size: "M", Quantity: 2, SKU: "SHIRT-RED-M", Name: "Shirt", UnitPrice: 1500, LineTotal: 3000},
+		},
+		Subtotal: 3000,
+	}
+	order := models.Order{ShippingCost: 500, Discount: 200, Tax: 100}
+	quote.Apply(&order)
+
+	if len(order.Products) != 1 {
+		t.Fatalf("expected 1 line, got %d", len(order.Products))
+	}
+	line := order.Products[0]
+	if line.ID.IsZero() {
+		t.Error("expected the line to have an id")
+	}
+	if line.SKU != "SHIRT-RED-M" || line.UnitPrice != 1500 || line.LineTotal != 3000 {
+		t.Errorf("line was not snapshotted: %+v", line)
+	}
+	if order.Subtotal != 3000 {
+		t.Errorf("expected subtotal 3000, got %d", order.Subtotal)
+	}
+	if order.Total != 3400 {
+		t.Errorf("expected total 3400, got %d", order.Total)
+	}
+}
@@ -0,0 +1,151 @@
+// Package tax computes the tax of carts and orders from the rates of their destination.
+// Prices in the catalog either include the tax (inclusive pricing) or not (exclusive
+// pricing). With inclusive pricing the tax is extracted from the price and the total
+// doesn't change, with exclusive pricing the tax is added on top.
+package tax
+
+import (
+	"github.com/GiorgosMarga/ecom_go/models"
+)
+
+// Rates looks up the tax rates of a destination. models.TaxRateModel implements it.
+type Rates interface {
+	GetForDestination(country, region string) ([]models.TaxRate, error)
+}
+
+// Line is an amount to tax, in the tax class of its product.
+type Line struct {
+	TaxClass string
+	Amount   int
+}
+
+// LineTax is the tax of a Line. Net is the amount without the tax.
+type LineTax struct {
+	TaxClass string `json:"tax_class"`
+	Name     string `json:"name,omitempty"`
+	Rate     int    `json:"rate"`
+	Net      int    `json:"net"`
+	Tax      int    `json:"tax"`
+}
+
+// Result is the tax of a set of lines. Lines are in the order of the input and
+// Breakdown groups them by rate.
+type Result struct {
+	Inclusive bool             `json:"inclusive"`
+	Lines     []LineTax        `json:"lines"`
+	Breakdown []models.TaxLine `json:"breakdown"`
+	Tax       int              `json:"tax"`
+}
+
+type Engine struct {
+	rates     Rates
+	inclusive bool
+}
+
+func New(rates Rates, inclusive bool) *Engine {
+	return &Engine{rates: rates, inclusive: inclusive}
+}
+
+// Calculate taxes the lines with the rates of the destination. A rate of the region
+// takes precedence over the rate of the whole country, classes without a rate aren't taxed.
+func (e *Engine) Calculate(country, region string, lines []Line) (*Result, error) {
+	rates, err := e.rates.GetForDestination(country, region)
+	if err != nil {
+		return nil, err
+	}
+
+	byClass := make(map[string]models.TaxRate)
+	for _, r := range rates {
+		if current, ok := byClass[r.TaxClass]; ok && current.Region != "" {
+			continue
+		}
+		byClass[r.TaxClass] = r
+	}
+
+	result := &Result{Inclusive: e.inclusive, Lines: make([]LineTax, 0, len(lines)), Breakdown: []models.TaxLine{}}
+	groups := make(map[string]int)
+	for _, line := range lines {
+		class := line.TaxClass
+		if class == "" {
+			class = models.DefaultTaxClass
+		}
+		lt := LineTax{TaxClass: class, Net: line.Amount}
+		if r, ok := byClass[class]; ok {
+			lt.Name = r.Name
+			lt.Rate = r.Rate
+			if e.inclusive {
+				lt.Net = extract(line.Amount, r.Rate)
+				lt.Tax = line.Amount - lt.Net
+			} else {
+				lt.Tax = apply(line.Amount, r.Rate)
+			}
+
+			key := r.Name + "/" + r.TaxClass
+			i, ok := groups[key]
+			if !ok {
+				i = len(result.Breakdown)
+				groups[key] = i
+				result.Breakdown = append(result.Breakdown, models.TaxLine{Name: r.Name, Rate: r.Rate})
+			}
+			result.Breakdown[i].Taxable += lt.Net
+			result.Breakdown[i].Tax += lt.Tax
+		}
+		result.Lines = append(result.Lines, lt)
+		result.Tax += lt.Tax
+	}
+	return result, nil
+}
+
+// apply returns the tax of a net amount, rounded half up.
+func apply(amount, rate int) int {
+	return (amount*rate + 5000) / 10000
+}
+
+// extract returns the net amount of a gross amount that includes the tax, rounded half up.
+func extract(amount, rate int) int {
+	return (amount*10000 + (10000+rate)/2) / (10000 + rate)
+}
+
+// ApplyToOrder stores the tax of every line and the breakdown on the order and
+// recomputes its total. The result must have been calculated from the lines of the order.
+func (r *Result) ApplyToOrder(order *models.Order) {
+	for i := range order.Products {
+		order.Products[i].TaxRate = r.Lines[i].Rate
+		order.Products[i].Tax = r.Lines[i].Tax
+	}
+	order.Tax = r.Tax
+	order.TaxInclusive = r.Inclusive
+	order.TaxBreakdown = r.Breakdown
+	order.ComputeTotal()
+}
+
+// OrderLines returns the lines of the order to tax.
+func OrderLines(order *models.Order) []Line {
+	lines := make([]Line, 0, len(order.Products))
+	for _, op := range order.Products {
+		lines = append(lines, Line{TaxClass: op.TaxClass, Amount: op.LineTotal})
+	}
+	return lines
+}
+
+// CartLines returns the lines of the cart to tax. Lines that can't be bought have
+// no line total and so no tax.
+func CartLines(cart *models.Cart) []Line {
+	lines := make([]Line, 0, len(cart.Items))
+	for _, item := range cart.Items {
+		lines = append(lines, Line{TaxClass: item.TaxClass, Amount: item.LineTotal})
+	}
+	return lines
+}
+
+// ApplyToCart stores the tax of every item and the breakdown on the cart. The result
+// must have been calculated from CartLines.
+func (r *Result) ApplyToCart(cart *models.Cart) {
+	for i := range cart.Items {
+		cart.Items[i].TaxRate = r.Lines[i].Rate
+		cart.Items[i].Tax = r.Lines[i].Tax
+	}
+	cart.Tax = r.Tax
+	cart.TaxInclusive = r.Inclusive
+	cart.TaxBreakdown = r.Breakdown
+}
@@ -0,0 +1,284 @@
+package tax
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/GiorgosMarga/ecom_go/models"
+)
+
+// fakeRates returns the rates of the country that have no region or the given region,
+// in the order they are listed, like models.TaxRateModel does.
+type fakeRates []models.TaxRate
+
+func (f fakeRates) GetForDestination(country, region string) ([]models.TaxRate, error) {
+	rates := make([]models.TaxRate, 0)
+	for _, r := range f {
+		if r.Country == country && (r.Region == "" || r.Region == region) {
+			rates = append(rates, r)
+		}
+	}
+	return rates, nil
+}
+
+type failingRates struct{}
+
+func (failingRates) GetForDestination(string, string) ([]models.TaxRate, error) {
+	return nil, errors.New("database is down")
+}
+
+var rates = fakeRates{
+	{Country: "GR", TaxClass: "standard", Name: "VAT", Rate: 2400},
+	{Country: "GR", TaxClass: "reduced", Name: "VAT reduced", Rate: 1300},
+	{Country: "GR", TaxClass: "books", Name: "VAT books", Rate: 1000},
+	{Country: "GR", Region: "Dodecanese", TaxClass: "standard", Name: "VAT islands", Rate: 1700},
+}
+
+func TestApplyAndExtract(t *testing.T) {
+	tests := []struct {
+		name   string
+		fn     func(amount, rate int) int
+		amount int
+		rate   int
+		want   int
+	}{
+		{name: "apply exact", fn: apply, amount: 1000, rate: 2400, want: 240},
+		{name: "apply rounds half up", fn: apply, amount: 25, rate: 1000, want: 3},
+		{name: "apply rounds down below half", fn: apply, amount: 24, rate: 1000, want: 2},
+		{name: "apply zero amount", fn: apply, amount: 0, rate: 2400, want: 0},
+		{name: "apply zero rate", fn: apply, amount: 1000, rate: 0, want: 0},
+		{name: "extract exact", fn: extract, amount: 1240, rate: 2400, want: 1000},
+		{name: "extract rounds half up", fn: extract, amount: 101, rate: 10000, want: 51},
+		{name: "extract rounds down below half", fn: extract, amount: 105, rate: 1000, want: 95},
+		{name: "extract zero rate", fn: extract, amount: 1000, rate: 0, want: 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fn(tt.amount, tt.rate); got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCalculate(t *testing.T) {
+	tests := []struct {
+		name      string
+		inclusive bool
+		country   string
+		region    string
+		lines     []Line
+		wantLines []LineTax
+		wantTax   int
+	}{
+		{
+			name:    "exclusive adds the tax on top",
+			country: "GR",
+			lines:   []Line{{TaxClass: "standard", Amount: 1000}},
+			wantLines: []LineTax{
+				{TaxClass: "standard", Name: "VAT", Rate: 2400, Net: 1000, Tax: 240},
+			},
+			wantTax: 240,
+		},
+		{
+			name:      "inclusive extracts the tax from the price",
+			inclusive: true,
+			country:   "GR",
+			lines:     []Line{{TaxClass: "standard", Amount: 1240}},
+			wantLines: []LineTax{
+				{TaxClass: "standard", Name: "VAT", Rate: 2400, Net: 1000, Tax: 240},
+			},
+			wantTax: 240,
+		},
+		{
+			name:    "exclusive rounds half up",
+			country: "GR",
+			lines:   []Line{{TaxClass: "books", Amount: 25}},
+			wantLines: []LineTax{
+				{TaxClass: "books", Name: "VAT books", Rate: 1000, Net: 25, Tax: 3},
+			},
+			wantTax: 3,
+		},
+		{
+			name:      "inclusive rounds the net half up",
+			inclusive: true,
+			country:   "GR",
+			lines:     []Line{{TaxClass: "books", Amount: 105}},
+			wantLines: []LineTax{
+				{TaxClass: "books", Name: "VAT books", Rate: 1000, Net: 95, Tax: 10},
+			},
+			wantTax: 10,
+		},
+		{
+			name:    "lines without a class are in the default class",
+			country: "GR",
+			lines:   []Line{{Amount: 1000}},
+			wantLines: []LineTax{
+				{TaxClass: models.DefaultTaxClass, Name: "VAT", Rate: 2400, Net: 1000, Tax: 240},
+			},
+			wantTax: 240,
+		},
+		{
+			name:    "classes without a rate are not taxed",
+			country: "GR",
+			lines:   []Line{{TaxClass: "gift_card", Amount: 5000}},
+			wantLines: []LineTax{
+				{TaxClass: "gift_card", Net: 5000},
+			},
+		},
+		{
+			name:      "inclusive classes without a rate keep their price",
+			inclusive: true,
+			country:   "GR",
+			lines:     []Line{{TaxClass: "gift_card", Amount: 5000}},
+			wantLines: []LineTax{
+				{TaxClass: "gift_card", Net: 5000},
+			},
+		},
+		{
+			name:    "destinations without rates are not taxed",
+			country: "US",
+			lines:   []Line{{TaxClass: "standard", Amount: 1000}},
+			wantLines: []LineTax{
+				{TaxClass: "standard", Net: 1000},
+			},
+		},
+		{
+			name:    "the rate of the region overrides the rate of the country",
+			country: "GR",
+			region:  "Dodecanese",
+			lines:   []Line{{TaxClass: "standard", Amount: 1000}},
+			wantLines: []LineTax{
+				{TaxClass: "standard", Name: "VAT islands", Rate: 1700, Net: 1000, Tax: 170},
+			},
+			wantTax: 170,
+		},
+		{
+			name:    "classes without a rate in the region use the rate of the country",
+			country: "GR",
+			region:  "Dodecanese",
+			lines:   []Line{{TaxClass: "reduced", Amount: 1000}},
+			wantLines: []LineTax{
+				{TaxClass: "reduced", Name: "VAT reduced", Rate: 1300, Net: 1000, Tax: 130},
+			},
+			wantTax: 130,
+		},
+		{
+			name:    "rates of other regions are ignored",
+			country: "GR",
+			region:  "Crete",
+			lines:   []Line{{TaxClass: "standard", Amount: 1000}},
+			wantLines: []LineTax{
+				{TaxClass: "standard", Name: "VAT", Rate: 2400, Net: 1000, Tax: 240},
+			},
+			wantTax: 240,
+		},
+		{
+			name:    "the tax is the sum of the lines",
+			country: "GR",
+			lines: []Line{
+				{TaxClass: "standard", Amount: 1000},
+				{TaxClass: "reduced", Amount: 2000},
+				{TaxClass: "gift_card", Amount: 500},
+			},
+			wantLines: []LineTax{
+				{TaxClass: "standard", Name: "VAT", Rate: 2400, Net: 1000, Tax: 240},
+				{TaxClass: "reduced", Name: "VAT reduced", Rate: 1300, Net: 2000, Tax: 260},
+				{TaxClass: "gift_card", Net: 500},
+			},
+			wantTax: 500,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := New(rates, tt.inclusive).Calculate(tt.country, tt.region, tt.lines)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Inclusive != tt.inclusive {
+				t.Errorf("expected inclusive %v, got %v", tt.inclusive, result.Inclusive)
+			}
+			if !slices.Equal(result.Lines, tt.wantLines) {
+				t.Errorf("expected lines %+v, got %+v", tt.wantLines, result.Lines)
+			}
+			if result.Tax != tt.wantTax {
+				t.Errorf("expected tax %d, got %d", tt.wantTax, result.Tax)
+			}
+		})
+	}
+}
+
+func TestCalculateRegionOverridesCountryInAnyOrder(t *testing.T) {
+	reversed := slices.Clone(rates)
+	slices.Reverse(reversed)
+
+	for _, r := range []fakeRates{rates, reversed} {
+		result, err := New(r, false).Calculate("GR", "Dodecanese", []Line{{TaxClass: "standard", Amount: 1000}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result.Lines[0].Rate != 1700 {
+			t.Errorf("expected the rate of the region 1700, got %d", result.Lines[0].Rate)
+		}
+	}
+}
+
+func TestCalculateBreakdown(t *testing.T) {
+	lines := []Line{
+		{TaxClass: "standard", Amount: 1000},
+		{TaxClass: "reduced", Amount: 2000},
+		{TaxClass: "standard", Amount: 500},
+		{TaxClass: "gift_card", Amount: 700},
+	}
+	result, err := New(rates, false).Calculate("GR", "", lines)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []models.TaxLine{
+		{Name: "VAT", Rate: 2400, Taxable: 1500, Tax: 360},
+		{Name: "VAT reduced", Rate: 1300, Taxable: 2000, Tax: 260},
+	}
+	if !slices.Equal(result.Breakdown, want) {
+		t.Errorf("expected breakdown %+v, got %+v", want, result.Breakdown)
+	}
+}
+
+func TestCalculateRatesError(t *testing.T) {
+	_, err := New(failingRates{}, false).Calculate("GR", "", []Line{{TaxClass: "standard", Amount: 1000}})
+	if err == nil {
+		t.Fatal("expected the error of the rates")
+	}
+}
+
+func TestApplyToOrder(t *testing.T) {
+	order := &models.Order{
+		Products: []models.OrderProducts{
+			{TaxClass: "standard", LineTotal: 1000},
+			{TaxClass: "reduced", LineTotal: 2000},
+		},
+		Subtotal:     3000,
+		ShippingCost: 500,
+	}
+	result, err := New(rates, false).Calculate("GR", "", OrderLines(order))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result.ApplyToOrder(order)
+
+	if order.Products[0].Tax != 240 || order.Products[1].Tax != 260 {
+		t.Errorf("expected line taxes 240 and 260, got %d and %d", order.Products[0].Tax, order.Products[1].Tax)
+	}
+	if order.Products[0].TaxRate != 2400 || order.Products[1].TaxRate != 1300 {
+		t.Errorf("expected line rates 2400 and 1300, got %d and %d", order.Products[0].TaxRate, order.Products[1].TaxRate)
+	}
+	if order.Tax != 500 {
+		t.Errorf("expected tax 500, got %d", order.Tax)
+	}
+	if order.Total != 4000 {
+		t.Errorf("expected total 4000, got %d", order.Total)
+	}
+}
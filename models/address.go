@@ -0,0 +1,339 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type Address struct {
+	Name       string `json:"name" bson:"name"`
+	Line1      string `json:"line1" bson:"line1"`
+	Line2      string `json:"line2,omitempty" bson:"line2,omitempty"`
+	City       string `json:"city" bson:"city"`
+	Region     string `json:"region,omitempty" bson:"region,omitempty"`
+	PostalCode string `json:"postal_code" bson:"postal_code"`
+	Country    string `json:"country" bson:"country"`
+	Phone      string `json:"phone,omitempty" bson:"phone,omitempty"`
+}
+
+// countryRules are the address rules of a country. A nil postalCode means that the
+// country doesn't use postal codes.
+type countryRules struct {
+	postalCode    *regexp.Regexp
+	requireRegion bool
+	requirePhone  bool
+}
+
+var addressRules = map[string]countryRules{
+	"US": {postalCode: regexp.MustCompile(`^\d{5}(-\d{4})?$`), requireRegion: true},
+	"CA": {postalCode: regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`), requireRegion: true},
+	"AU": {postalCode: regexp.MustCompile(`^\d{4}$`), requireRegion: true},
+	"BR": {postalCode: regexp.MustCompile(`^\d{5}-?\d{3}$`), requireRegion: true},
+	"IN": {postalCode: regexp.MustCompile(`^\d{6}$`), requireRegion: true, requirePhone: true},
+	"GB": {postalCode: regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`)},
+	"IE": {postalCode: regexp.MustCompile(`^[A-Z]\d[\dW] ?[A-Z\d]{4}$`)},
+	"NL": {postalCode: regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`)},
+	"GR": {postalCode: regexp.MustCompile(`^\d{3} ?\d{2}$`), requirePhone: true},
+	"CY": {postalCode: regexp.MustCompile(`^\d{4}$`)},
+	"DE": {postalCode: regexp.MustCompile(`^\d{5}$`)},
+	"FR": {postalCode: regexp.MustCompile(`^\d{5}$`)},
+	"IT": {postalCode: regexp.MustCompile(`^\d{5}$`)},
+	"ES": {postalCode: regexp.MustCompile(`^\d{5}$`)},
+	"JP": {postalCode: regexp.MustCompile(`^\d{3}-?\d{4}$`), requireRegion: true},
+	"HK": {},
+	"AE": {requirePhone: true},
+}
+
+var countryCodeRX = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// Normalize trims the fields and upper cases the country and the postal code so
+// that they can be validated and compared.
+func (a *Address) Normalize() {
+	a.Name = strings.TrimSpace(a.Name)
+	a.Line1 = strings.TrimSpace(a.Line1)
+	a.Line2 = strings.TrimSpace(a.Line2)
+	a.City = strings.TrimSpace(a.City)
+	a.Region = strings.TrimSpace(a.Region)
+	a.PostalCode = strings.ToUpper(strings.TrimSpace(a.PostalCode))
+	a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+	a.Phone = strings.TrimSpace(a.Phone)
+}
+
+// ValidateAddress checks the fields every address needs and the rules of its country.
+// Countries without rules only need a postal code.
+func ValidateAddress(v *validator.Validator, a Address) {
+	v.Validate(validator.CheckLength(a.Name, 1, 100), "name", "must be provided")
+	v.Validate(validator.CheckLength(a.Line1, 1, 200), "line1", "must be provided")
+	v.Validate(len(a.Line2) <= 200, "line2", "must not be more than 200 bytes long")
+	v.Validate(validator.CheckLength(a.City, 1, 100), "city", "must be provided")
+	v.Validate(len(a.Region) <= 100, "region", "must not be more than 100 bytes long")
+	v.Validate(len(a.Phone) <= 30, "phone", "must not be more than 30 bytes long")
+	if !countryCodeRX.MatchString(a.Country) {
+		v.AddError("country", "must be a 2 letter country code")
+		return
+	}
+
+	rules, ok := addressRules[a.Country]
+	if !ok {
+		v.Validate(!validator.IsEmpty(a.PostalCode), "postal_code", "must be provided")
+		return
+	}
+	if rules.postalCode != nil {
+		v.Validate(rules.postalCode.MatchString(a.PostalCode), "postal_code", "invalid postal code for "+a.Country)
+	}
+	if rules.requireRegion {
+		v.Validate(!validator.IsEmpty(a.Region), "region", "must be provided for "+a.Country)
+	}
+	if rules.requirePhone {
+		v.Validate(!validator.IsEmpty(a.Phone), "phone", "must be provided for "+a.Country)
+	}
+}
+
+// SavedAddress is an entry of the address book of a user. Orders copy the Address
+// so that editing the book doesn't change past orders.
+type SavedAddress struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserId    primitive.ObjectID `json:"-" bson:"user_id"`
+	Label     string             `json:"label,omitempty" bson:"label,omitempty"`
+	Address   `bson:",inline"`
+	IsDefault bool      `json:"is_default" bson:"is_default"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+type AddressModel struct {
+	coll *mongo.Collection
+}
+
+type SavedAddressPayload struct {
+	Label      *string `json:"label"`
+	Name       *string `json:"name"`
+	Line1      *string `json:"line1"`
+	Line2      *string `json:"line2"`
+	City       *string `json:"city"`
+	Region     *string `json:"region"`
+	PostalCode *string `json:"postal_code"`
+	Country    *string `json:"country"`
+	Phone      *string `json:"phone"`
+	IsDefault  *bool   `json:"is_default"`
+}
+
+// Apply copies the fields that are set in the payload onto the address.
+func (p SavedAddressPayload) Apply(sa *SavedAddress) {
+	set := func(dst *string, src *string) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	set(&sa.Label, p.Label)
+	set(&sa.Name, p.Name)
+	set(&sa.Line1, p.Line1)
+	set(&sa.Line2, p.Line2)
+	set(&sa.City, p.City)
+	set(&sa.Region, p.Region)
+	set(&sa.PostalCode, p.PostalCode)
+	set(&sa.Country, p.Country)
+	set(&sa.Phone, p.Phone)
+	sa.Label = strings.TrimSpace(sa.Label)
+	sa.Normalize()
+}
+
+func ValidateSavedAddress(v *validator.Validator, sa SavedAddress) {
+	v.Validate(len(sa.Label) <= 50, "label", "must not be more than 50 bytes long")
+	ValidateAddress(v, sa.Address)
+}
+
+func (m AddressModel) createIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: 1}}},
+		// a user has at most one default address
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}},
+			Options: options.Index().
+				SetName("one_default_address_per_user").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"is_default": true}),
+		},
+	})
+	return err
+}
+
+// Insert saves the address. The first address of a user becomes the default one.
+// The unique index on the default address decides between concurrent first inserts:
+// the address that loses is saved without being the default.
+func (m AddressModel) Insert(sa *SavedAddress) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	count, err := m.coll.CountDocuments(ctx, bson.M{"user_id": sa.UserId})
+	if err != nil {
+		return err
+	}
+
+	sa.ID = primitive.NewObjectID()
+	sa.CreatedAt = time.Now()
+	sa.UpdatedAt = sa.CreatedAt
+	makeDefault := sa.IsDefault
+	sa.IsDefault = count == 0
+
+	_, err = m.coll.InsertOne(ctx, sa)
+	if sa.IsDefault && mongo.IsDuplicateKeyError(err) {
+		sa.IsDefault = false
+		_, err = m.coll.InsertOne(ctx, sa)
+	}
+	if err != nil {
+		return err
+	}
+	if makeDefault && !sa.IsDefault {
+		return m.SetDefault(sa)
+	}
+	return nil
+}
+
+func (m AddressModel) Get(id, userId primitive.ObjectID) (*SavedAddress, error) {
+	return m.getOne(bson.M{"_id": id, "user_id": userId})
+}
+
+// GetDefault returns the default address of the user or ErrNotFound if there is none.
+func (m AddressModel) GetDefault(userId primitive.ObjectID) (*SavedAddress, error) {
+	return m.getOne(bson.M{"user_id": userId, "is_default": true})
+}
+
+func (m AddressModel) getOne(filter bson.M) (*SavedAddress, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	sa := &SavedAddress{}
+	if err := m.coll.FindOne(ctx, filter).Decode(sa); err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+	return sa, nil
+}
+
+// GetForUser returns the address book of the user, the default address first.
+func (m AddressModel) GetForUser(userId primitive.ObjectID) ([]SavedAddress, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "is_default", Value: -1}, {Key: "created_at", Value: 1}})
+	cursor, err := m.coll.Find(ctx, bson.M{"user_id": userId}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	addresses := make([]SavedAddress, 0)
+	if err := cursor.All(ctx, &addresses); err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+// Update saves the fields of the address. The default address is changed through SetDefault.
+func (m AddressModel) Update(sa *SavedAddress) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	sa.UpdatedAt = time.Now()
+	update := bson.M{"$set": bson.M{
+		"label":       sa.Label,
+		"name":        sa.Name,
+		"line1":       sa.Line1,
+		"line2":       sa.Line2,
+		"city":        sa.City,
+		"region":      sa.Region,
+		"postal_code": sa.PostalCode,
+		"country":     sa.Country,
+		"phone":       sa.Phone,
+		"updated_at":  sa.UpdatedAt,
+	}}
+	res, err := m.coll.UpdateOne(ctx, bson.M{"_id": sa.ID, "user_id": sa.UserId}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetDefault makes the address the default one of its user. The previous default is
+// cleared first so that the unique index is never violated. A concurrent SetDefault can
+// set its address between the two writes, so the index rejects ours and it is retried:
+// the user ends up with exactly one default, the address of the last call.
+func (m AddressModel) SetDefault(sa *SavedAddress) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		now := time.Now()
+		filter := bson.M{"user_id": sa.UserId, "is_default": true, "_id": bson.M{"$ne": sa.ID}}
+		if _, err := m.coll.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"is_default": false, "updated_at": now}}); err != nil {
+			return err
+		}
+
+		update := bson.M{"$set": bson.M{"is_default": true, "updated_at": now}}
+		res, err := m.coll.UpdateOne(ctx, bson.M{"_id": sa.ID, "user_id": sa.UserId}, update)
+		if err != nil {
+			if mongo.IsDuplicateKeyError(err) && attempt < 3 {
+				continue
+			}
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return ErrNotFound
+		}
+		sa.IsDefault = true
+		sa.UpdatedAt = now
+		return nil
+	}
+}
+
+// Delete removes the address. If it was the default one, the oldest remaining address
+// becomes the default.
+func (m AddressModel) Delete(id, userId primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	sa := &SavedAddress{}
+	err := m.coll.FindOneAndDelete(ctx, bson.M{"_id": id, "user_id": userId}).Decode(sa)
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return ErrNotFound
+		default:
+			return err
+		}
+	}
+	if !sa.IsDefault {
+		return nil
+	}
+
+	opts := options.FindOne().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	next := &SavedAddress{}
+	err = m.coll.FindOne(ctx, bson.M{"user_id": userId}, opts).Decode(next)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		return err
+	}
+	return m.SetDefault(next)
+}
@@ -5,42 +5,300 @@ import (
 	"errors"
 	"time"
 
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
-type CartProduct struct {
-	Product
-	Quantity int `json:"quantity" bson:"quantity"`
+// CartItem is a single line of a cart. Only the variant, size and quantity are
+// provided by the client, everything else is computed by the server.
+type CartItem struct {
+	ID         primitive.ObjectID `json:"id" bson:"id"`
+	VariantId  primitive.ObjectID `json:"variant_id" bson:"variant_id"`
+	Size       string             `json:"size" bson:"size"`
+	Quantity   int                `json:"quantity" bson:"quantity"`
+	AddedPrice int                `json:"added_price" bson:"added_price"`
+	AddedAt    time.Time          `json:"added_at" bson:"added_at"`
+
+	// the fields below are recomputed from the catalog on every read and write
+	Name         string `json:"name" bson:"-"`
+	Color        string `json:"color" bson:"-"`
+	Img          string `json:"img,omitempty" bson:"-"`
+	UnitPrice    int    `json:"unit_price" bson:"-"`
+	LineTotal    int    `json:"line_total" bson:"-"`
+	Available    bool   `json:"available" bson:"-"`
+	OutOfStock   bool   `json:"out_of_stock" bson:"-"`
+	PriceChanged bool   `json:"price_changed" bson:"-"`
+	TaxClass     string `json:"tax_class" bson:"-"`
+	TaxRate      int    `json:"tax_rate" bson:"-"`
+	Tax          int    `json:"tax" bson:"-"`
 }
 
 type Cart struct {
 	ID        primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
-	UserId    primitive.ObjectID `json:"-" bson:"user_id"`
-	Products  []CartProduct      `json:"products" bson:"products"`
-	Total     float64            `json:"total" bson:"total"`
+	UserId    primitive.ObjectID `json:"-" bson:"user_id,omitempty"`
+	Items     []CartItem         `json:"items" bson:"items"`
+	Total     int                `json:"total" bson:"-"`
 	Active    int                `json:"-" bson:"active"`
+	Version   int                `json:"-" bson:"version"`
 	CreatedAt time.Time          `json:"-" bson:"created_at"`
 	UpdatedAt time.Time          `json:"-" bson:"updated_at"`
+	// set when the abandoned cart event was emitted. A cart that is updated
+	// afterwards can be reported again.
+	AbandonedAt *time.Time `json:"-" bson:"abandoned_at,omitempty"`
+	// set when the cart was checked out or merged, closed carts can't be reopened
+	ClosedAt *time.Time `json:"-" bson:"closed_at,omitempty"`
+	// the tax is only computed when the destination of the cart is known
+	Tax          int       `json:"tax" bson:"-"`
+	TaxInclusive bool      `json:"tax_inclusive" bson:"-"`
+	TaxBreakdown []TaxLine `json:"tax_breakdown,omitempty" bson:"-"`
 }
 
+// strategies for lines that exist in both carts when a guest cart is merged into a user cart
+const (
+	MergeSum       = "sum"
+	MergeMax       = "max"
+	MergeKeepUser  = "keep_user"
+	MergeKeepGuest = "keep_guest"
+)
+
+var (
+	ErrCartChanged = errors.New("the cart was changed by another request")
+	ErrCartClosed  = errors.New("the cart is closed")
+)
+
 type CartModel struct {
-	coll        *mongo.Collection
-	productColl *mongo.Collection
+	coll *mongo.Collection
+}
+
+type CartItemPayload struct {
+	VariantId primitive.ObjectID `json:"variant_id"`
+	Size      string             `json:"size"`
+	Quantity  int                `json:"quantity"`
 }
 
 type CartPayload struct {
-	Products []primitive.ObjectID `json:"products" bson:"products"`
+	Items []CartItemPayload `json:"items"`
+}
+
+type CartItemUpdatePayload struct {
+	Quantity int `json:"quantity"`
+}
+
+func ValidateCartItem(v *validator.Validator, item CartItemPayload, catalog map[primitive.ObjectID]CatalogVariant) {
+	v.Validate(!item.VariantId.IsZero(), "variant_id", "must be provided")
+	v.Validate(item.Quantity > 0, "quantity", "must be positive")
+
+	cv, ok := catalog[item.VariantId]
+	if !ok {
+		v.AddError("variant_id", "unknown variant")
+		return
+	}
+	v.Validate(cv.GetSize(item.Size) != nil, "size", "unknown size")
+}
+
+func ValidateCartPayload(v *validator.Validator, payload CartPayload, catalog map[primitive.ObjectID]CatalogVariant) {
+	for _, item := range payload.Items {
+		ValidateCartItem(v, item, catalog)
+	}
+}
+
+// ValidateCartAvailability must be called after the cart has been priced. It
+// rejects carts with lines that can't be fulfilled.
+func ValidateCartAvailability(v *validator.Validator, c *Cart) {
+	for _, item := range c.Items {
+		v.Validate(item.Available, "items", "contains unavailable items")
+		v.Validate(!item.OutOfStock, "quantity", "not enough items in stock")
+	}
+}
+
+// VariantIds returns the ids of all the variants referenced by the payload.
+func (p CartPayload) VariantIds() []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, 0, len(p.Items))
+	for _, item := range p.Items {
+		ids = append(ids, item.VariantId)
+	}
+	return ids
 }
 
-func getIds(products []CartProduct) []primitive.ObjectID {
-	ids := make([]primitive.ObjectID, len(products))
-	for i, product := range products {
-		ids[i] = product.ID
+func (c *Cart) VariantIds() []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, 0, len(c.Items))
+	for _, item := range c.Items {
+		ids = append(ids, item.VariantId)
 	}
 	return ids
 }
+
+// OrderLines returns the variant, size and quantity of every item, ready to be priced
+// as an order.
+func (c *Cart) OrderLines() []OrderLinePayload {
+	lines := make([]OrderLinePayload, 0, len(c.Items))
+	for _, item := range c.Items {
+		lines = append(lines, OrderLinePayload{
+			VariantId: item.VariantId,
+			Size:      item.Size,
+			Quantity:  item.Quantity,
+		})
+	}
+	return lines
+}
+
+func (c *Cart) GetItem(id primitive.ObjectID) *CartItem {
+	for i := range c.Items {
+		if c.Items[i].ID == id {
+			return &c.Items[i]
+		}
+	}
+	return nil
+}
+
+func (c *Cart) FindItem(variantId primitive.ObjectID, size string) *CartItem {
+	for i := range c.Items {
+		if c.Items[i].VariantId == variantId && c.Items[i].Size == size {
+			return &c.Items[i]
+		}
+	}
+	return nil
+}
+
+// SetItems replaces the lines of the cart with the ones of the payload. Lines that
+// were already in the cart keep their id and the price they were added with, so that
+// price changes can still be detected. Duplicate lines are merged.
+func (c *Cart) SetItems(items []CartItemPayload, catalog map[primitive.ObjectID]CatalogVariant) {
+	old := &Cart{Items: c.Items}
+	c.Items = make([]CartItem, 0, len(items))
+	for _, p := range items {
+		if existing := c.FindItem(p.VariantId, p.Size); existing != nil {
+			existing.Quantity += p.Quantity
+			continue
+		}
+		item := CartItem{
+			ID:         primitive.NewObjectID(),
+			VariantId:  p.VariantId,
+			Size:       p.Size,
+			Quantity:   p.Quantity,
+			AddedPrice: catalog[p.VariantId].Price,
+			AddedAt:    time.Now(),
+		}
+		if prev := old.FindItem(p.VariantId, p.Size); prev != nil {
+			item.ID = prev.ID
+			item.AddedPrice = prev.AddedPrice
+			item.AddedAt = prev.AddedAt
+		}
+		c.Items = append(c.Items, item)
+	}
+}
+
+// IsGuest reports whether the cart belongs to an anonymous shopper.
+func (c *Cart) IsGuest() bool {
+	return c.UserId.IsZero()
+}
+
+// Merge moves the lines of the guest cart into c. Lines that exist in both carts
+// are resolved according to strategy, unknown strategies fall back to MergeSum.
+func (c *Cart) Merge(guest *Cart, strategy string) {
+	for _, item := range guest.Items {
+		existing := c.FindItem(item.VariantId, item.Size)
+		if existing == nil {
+			c.Items = append(c.Items, item)
+			continue
+		}
+		switch strategy {
+		case MergeKeepUser:
+		case MergeKeepGuest:
+			existing.Quantity = item.Quantity
+		case MergeMax:
+			existing.Quantity = max(existing.Quantity, item.Quantity)
+		default:
+			existing.Quantity += item.Quantity
+		}
+	}
+}
+
+// Price recomputes the price, the availability and the total of the cart from the
+// catalog. Lines whose variant or size no longer exist are marked unavailable and
+// lines that can't be fulfilled are marked out of stock, none of them count towards
+// the total.
+func (c *Cart) Price(catalog map[primitive.ObjectID]CatalogVariant) {
+	c.Total = 0
+	for i := range c.Items {
+		item := &c.Items[i]
+		item.Available = false
+		item.OutOfStock = false
+		item.PriceChanged = false
+		item.LineTotal = 0
+
+		cv, ok := catalog[item.VariantId]
+		if !ok {
+			continue
+		}
+		item.Name = cv.Name
+		item.Color = cv.Color
+		item.UnitPrice = cv.Price
+		item.TaxClass = cv.TaxClass
+		if len(cv.Img) > 0 {
+			item.Img = cv.Img[0]
+		}
+		item.PriceChanged = item.AddedPrice != cv.Price
+
+		size := cv.GetSize(item.Size)
+		if size == nil {
+			continue
+		}
+		item.Available = true
+		if size.Stock < item.Quantity {
+			item.OutOfStock = true
+			continue
+		}
+		item.LineTotal = cv.Price * item.Quantity
+		c.Total += item.LineTotal
+	}
+}
+
+func (m CartModel) createIndexes(ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// inactive carts are removed by mongo ttl after they were closed. Active carts are
+	// left alone, idle ones are closed first by DeactivateIdle. It replaces the expiry
+	// of all carts.
+	if err := dropIndex(ctx, m.coll, "cart_expiry"); err != nil {
+		return err
+	}
+	err := createTTLIndex(ctx, m.coll, "inactive_cart_expiry", bson.D{{Key: "updated_at", Value: 1}}, ttl, bson.M{"active": 0})
+	if err != nil {
+		return err
+	}
+
+	// a user can have only one active cart, carts that were converted to orders are kept inactive.
+	// Guest carts have no user so they are left out of the index. It replaces the index of the
+	// same purpose that covered guest carts too.
+	if err := dropIndex(ctx, m.coll, "one_active_cart_per_user"); err != nil {
+		return err
+	}
+	_, err = m.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}},
+		Options: options.Index().
+			SetName("one_active_user_cart").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"active": 1, "user_id": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		return err
+	}
+
+	// the abandoned cart job walks the active carts from the least recently updated
+	_, err = m.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "updated_at", Value: 1}, {Key: "_id", Value: 1}},
+		Options: options.Index().
+			SetName("active_cart_updated_at").
+			SetPartialFilterExpression(bson.M{"active": 1}),
+	})
+	return err
+}
+
 func (m CartModel) Insert(c *Cart) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -49,7 +307,76 @@ func (m CartModel) Insert(c *Cart) error {
 	c.Active = 1
 	c.CreatedAt = time.Now()
 	c.UpdatedAt = time.Now()
+	if c.Items == nil {
+		c.Items = make([]CartItem, 0)
+	}
 	_, err := m.coll.InsertOne(ctx, c)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrActiveCartExists
+		}
+		return err
+	}
+	return nil
+}
+
+// GetActiveForUser returns the active cart of the user, creating an empty one if
+// the user doesn't have one yet.
+func (m CartModel) GetActiveForUser(userId primitive.ObjectID) (*Cart, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{"user_id": userId, "active": 1}
+	update := bson.M{"$setOnInsert": bson.M{
+		"_id":        primitive.NewObjectID(),
+		"items":      bson.A{},
+		"version":    0,
+		"created_at": time.Now(),
+		"updated_at": time.Now(),
+	}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	c := &Cart{}
+	err := m.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(c)
+	if err != nil {
+		// a concurrent request created the cart first
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+		if err := m.coll.FindOne(ctx, filter).Decode(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Deactivate closes the cart once it has been converted into an order.
+func (m CartModel) Deactivate(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": id}
+	update := bson.M{"$set": bson.M{"active": 0, "closed_at": time.Now(), "updated_at": time.Now()}}
+	res, err := m.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeactivateIdle makes the active carts that haven't been updated since before inactive,
+// which starts their expiry. They can still be reopened from an abandoned cart link
+// until they expire.
+func (m CartModel) DeactivateIdle(before time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"active": 1, "updated_at": bson.M{"$lt": before}}
+	update := bson.M{"$set": bson.M{"active": 0, "updated_at": time.Now()}}
+	_, err := m.coll.UpdateMany(ctx, filter, update)
 	return err
 }
 
@@ -67,55 +394,261 @@ func (m CartModel) Get(id primitive.ObjectID) (*Cart, error) {
 			return nil, err
 		}
 	}
-	filter = bson.M{"_id": bson.M{"$in": getIds(c.Products)}}
+	return c, nil
+}
+
+// Update replaces the items of the cart. It returns ErrCartChanged if the items were
+// changed since the cart was read, so that concurrent line updates aren't overwritten,
+// and ErrCartClosed if the cart was closed.
+func (m CartModel) Update(c *Cart) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	c.UpdatedAt = time.Now()
+	filter := bson.M{"_id": c.ID, "active": 1, "version": c.Version}
+	if c.Version == 0 {
+		// carts created before versioning don't have the field
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	update := bson.M{
+		"$set": bson.M{"items": c.Items, "updated_at": c.UpdatedAt},
+		"$inc": bson.M{"version": 1},
+	}
+	res, err := m.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		count, err := m.coll.CountDocuments(ctx, bson.M{"_id": c.ID, "active": 1})
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return m.closedOrNotFound(ctx, c.ID)
+		}
+		return ErrCartChanged
+	}
+	c.Version++
+	return nil
+}
+
+// Delete deletes an active cart of the user. Closed carts are kept with the orders
+// they were checked out into, ErrCartClosed is returned for them.
+func (m CartModel) Delete(id, userId primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	filter := bson.M{"_id": id, "user_id": userId, "active": 1}
+	res, err := m.coll.DeleteOne(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		count, err := m.coll.CountDocuments(ctx, bson.M{"_id": id, "user_id": userId})
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrNotFound
+		}
+		return ErrCartClosed
+	}
+	return nil
+}
 
-	cursor, err := m.productColl.Find(ctx, filter)
+// closedOrNotFound tells why a write to the active cart matched nothing: ErrCartClosed
+// if the cart exists but is closed, ErrNotFound otherwise.
+func (m CartModel) closedOrNotFound(ctx context.Context, id primitive.ObjectID) error {
+	count, err := m.coll.CountDocuments(ctx, bson.M{"_id": id, "active": bson.M{"$ne": 1}})
 	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrCartClosed
+	}
+	return ErrNotFound
+}
+
+// AddItem adds a line to the cart atomically. If the cart already contains the
+// same variant and size, the quantity of that line is increased instead. It returns
+// ErrCartClosed if the cart was closed.
+func (m CartModel) AddItem(id primitive.ObjectID, item CartItem) (*Cart, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	match := bson.M{"variant_id": item.VariantId, "size": item.Size}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	// two concurrent requests may both miss the existing line and then race to push it,
+	// the filter on the push makes the loser retry as an increment
+	for range 2 {
+		c := &Cart{}
+		filter := bson.M{"_id": id, "active": 1, "items": bson.M{"$elemMatch": match}}
+		update := bson.M{
+			"$inc": bson.M{"items.$.quantity": item.Quantity, "version": 1},
+			"$set": bson.M{"updated_at": time.Now()},
+		}
+		err := m.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(c)
+		if err == nil {
+			return c, nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+
+		filter = bson.M{"_id": id, "active": 1, "items": bson.M{"$not": bson.M{"$elemMatch": match}}}
+		update = bson.M{
+			"$push": bson.M{"items": item},
+			"$inc":  bson.M{"version": 1},
+			"$set":  bson.M{"updated_at": time.Now()},
+		}
+		err = m.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(c)
+		if err == nil {
+			return c, nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+	}
+	return nil, m.closedOrNotFound(ctx, id)
+}
+
+func (m CartModel) UpdateItemQuantity(id, lineId primitive.ObjectID, quantity int) (*Cart, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": id, "active": 1, "items.id": lineId}
+	update := bson.M{
+		"$set": bson.M{
+			"items.$.quantity": quantity,
+			"updated_at":       time.Now(),
+		},
+		"$inc": bson.M{"version": 1},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	c := &Cart{}
+	if err := m.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(c); err != nil {
 		switch {
 		case errors.Is(err, mongo.ErrNoDocuments):
-			return nil, ErrNotFound
+			return nil, m.closedOrNotFound(ctx, id)
 		default:
 			return nil, err
 		}
 	}
-	defer cursor.Close(ctx)
+	return c, nil
+}
 
-	if err := cursor.All(ctx, &c.Products); err != nil {
-		return nil, err
+func (m CartModel) RemoveItem(id, lineId primitive.ObjectID) (*Cart, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": id, "active": 1, "items.id": lineId}
+	update := bson.M{
+		"$pull": bson.M{"items": bson.M{"id": lineId}},
+		"$inc":  bson.M{"version": 1},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	c := &Cart{}
+	if err := m.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(c); err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, m.closedOrNotFound(ctx, id)
+		default:
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// GetAbandoned returns up to limit active user carts with items that haven't been
+// updated since before and haven't been reported as abandoned since their last update,
+// least recently updated first. Only the carts after the given cart in that order are
+// returned, so that carts the caller skipped don't come back in the next batch; a nil
+// after starts from the first cart.
+func (m CartModel) GetAbandoned(before time.Time, after *Cart, limit int64) ([]Cart, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"active":     1,
+		"user_id":    bson.M{"$exists": true},
+		"items.0":    bson.M{"$exists": true},
+		"updated_at": bson.M{"$lt": before},
+		"$or": bson.A{
+			bson.M{"abandoned_at": bson.M{"$exists": false}},
+			bson.M{"$expr": bson.M{"$lt": bson.A{"$abandoned_at", "$updated_at"}}},
+		},
 	}
-	if err := cursor.Err(); err != nil {
+	if after != nil {
+		filter["$and"] = bson.A{bson.M{"$or": bson.A{
+			bson.M{"updated_at": bson.M{"$gt": after.UpdatedAt}},
+			bson.M{"updated_at": after.UpdatedAt, "_id": bson.M{"$gt": after.ID}},
+		}}}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "updated_at", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(limit)
+	cursor, err := m.coll.Find(ctx, filter, opts)
+	if err != nil {
 		return nil, err
 	}
+	defer cursor.Close(ctx)
 
-	return c, nil
+	carts := make([]Cart, 0)
+	if err := cursor.All(ctx, &carts); err != nil {
+		return nil, err
+	}
+	return carts, nil
 }
 
-func (m CartModel) Update(c *Cart) error {
+// MarkAbandoned flags the cart as reported. It returns ErrNotFound if the cart was
+// updated or reported in the meantime so that the event is emitted only once.
+func (m CartModel) MarkAbandoned(c *Cart) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	c.UpdatedAt = time.Now()
-	filter := bson.M{"_id": c.ID}
-	update := bson.D{{Key: "$set", Value: c}}
+
+	filter := bson.M{"_id": c.ID, "updated_at": c.UpdatedAt}
+	if c.AbandonedAt == nil {
+		filter["abandoned_at"] = bson.M{"$exists": false}
+	} else {
+		filter["abandoned_at"] = c.AbandonedAt
+	}
+	// updated_at is left untouched so that the cart keeps expiring
+	update := bson.M{"$set": bson.M{"abandoned_at": time.Now()}}
 	res, err := m.coll.UpdateOne(ctx, filter, update)
 	if err != nil {
 		return err
 	}
-	if res.ModifiedCount == 0 {
+	if res.MatchedCount == 0 {
 		return ErrNotFound
 	}
 	return nil
 }
 
-func (m CartModel) Delete(id, userId primitive.ObjectID) error {
+// Reopen brings an abandoned cart back to life, making it active again if it was
+// deactivated for being idle. Touching updated_at stops its expiry. Carts that were
+// checked out or merged can't be reopened, and ErrActiveCartExists is returned if the
+// user has started another cart in the meantime.
+func (m CartModel) Reopen(id primitive.ObjectID) (*Cart, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	filter := bson.M{"_id": id, "user_id": userId}
-	res, err := m.coll.DeleteOne(ctx, filter)
-	if err != nil {
-		return err
+
+	filter := bson.M{"_id": id, "closed_at": bson.M{"$exists": false}}
+	update := bson.M{
+		"$set":   bson.M{"active": 1, "updated_at": time.Now()},
+		"$unset": bson.M{"abandoned_at": ""},
 	}
-	if res.DeletedCount == 0 {
-		return ErrNotFound
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	c := &Cart{}
+	if err := m.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(c); err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrNotFound
+		case mongo.IsDuplicateKeyError(err):
+			return nil, ErrActiveCartExists
+		default:
+			return nil, err
+		}
 	}
-	return nil
+	return c, nil
 }
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// CounterModel hands out sequential numbers, one sequence per name.
+type CounterModel struct {
+	coll *mongo.Collection
+}
+
+// Next returns the next number of the sequence, starting from 1.
+func (m CounterModel) Next(name string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.next(ctx, name)
+}
+
+// next increments the sequence within ctx, so that it is rolled back together with the
+// rest of a transaction that carries it.
+func (m CounterModel) next(ctx context.Context, name string) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	update := bson.M{"$inc": bson.M{"seq": int64(1)}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	if err := m.coll.FindOneAndUpdate(ctx, bson.M{"_id": name}, update, opts).Decode(&counter); err != nil {
+		return 0, err
+	}
+	return counter.Seq, nil
+}
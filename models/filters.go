@@ -0,0 +1,69 @@
+package models
+
+import (
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Filters holds the pagination and sorting of a list request. Sort is a field of
+// SortSafelist, prefixed with "-" for descending order.
+type Filters struct {
+	Page         int
+	PageSize     int
+	Sort         string
+	SortSafelist []string
+}
+
+type Metadata struct {
+	CurrentPage  int   `json:"current_page,omitempty"`
+	PageSize     int   `json:"page_size,omitempty"`
+	FirstPage    int   `json:"first_page,omitempty"`
+	LastPage     int   `json:"last_page,omitempty"`
+	TotalRecords int64 `json:"total_records"`
+}
+
+func ValidateFilters(v *validator.Validator, f Filters) {
+	v.Validate(f.Page > 0, "page", "must be greater than zero")
+	v.Validate(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
+	v.Validate(f.PageSize > 0, "page_size", "must be greater than zero")
+	v.Validate(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+	v.Validate(slices.Contains(f.SortSafelist, f.Sort), "sort", "invalid sort value")
+}
+
+func (f Filters) sortField() string {
+	return strings.TrimPrefix(f.Sort, "-")
+}
+
+func (f Filters) sortDirection() int {
+	if strings.HasPrefix(f.Sort, "-") {
+		return -1
+	}
+	return 1
+}
+
+// findOptions returns the sort, skip and limit of the page. _id is used as a
+// tie breaker so that pages are stable.
+func (f Filters) findOptions() *options.FindOptionsBuilder {
+	return options.Find().
+		SetSort(bson.D{{Key: f.sortField(), Value: f.sortDirection()}, {Key: "_id", Value: 1}}).
+		SetSkip(int64((f.Page - 1) * f.PageSize)).
+		SetLimit(int64(f.PageSize))
+}
+
+func calculateMetadata(totalRecords int64, page, pageSize int) Metadata {
+	if totalRecords == 0 {
+		return Metadata{}
+	}
+	return Metadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
+		TotalRecords: totalRecords,
+	}
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+var (
+	ErrIdempotencyKeyReused     = errors.New("the idempotency key was already used for a different request")
+	ErrIdempotencyKeyInProgress = errors.New("a request with this idempotency key is still in progress")
+)
+
+// IdempotentRequest is a request made with an idempotency key. Once the request
+// completes it holds the response, which is replayed to retries of the request.
+type IdempotentRequest struct {
+	ID          string    `bson:"_id"`
+	Fingerprint string    `bson:"fingerprint"`
+	Completed   bool      `bson:"completed"`
+	Status      int       `bson:"status,omitempty"`
+	ContentType string    `bson:"content_type,omitempty"`
+	Body        []byte    `bson:"body,omitempty"`
+	CreatedAt   time.Time `bson:"created_at"`
+	// the headers of the response that are replayed with it
+	Headers map[string][]string `bson:"headers,omitempty"`
+}
+
+type IdempotencyModel struct {
+	coll *mongo.Collection
+}
+
+func (m IdempotencyModel) createIndexes(ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// keys can be reused once they have expired
+	return createTTLIndex(ctx, m.coll, "idempotency_key_expiry", bson.D{{Key: "created_at", Value: 1}}, ttl, nil)
+}
+
+// Begin records that the request with the key started. If the key was used before it
+// returns the recorded request when it has the same fingerprint and has completed,
+// ErrIdempotencyKeyInProgress when it hasn't completed yet, and ErrIdempotencyKeyReused
+// when the fingerprint differs. It returns nil, nil for a new key.
+func (m IdempotencyModel) Begin(id, fingerprint string) (*IdempotentRequest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	req := IdempotentRequest{ID: id, Fingerprint: fingerprint, CreatedAt: time.Now()}
+	_, err := m.coll.InsertOne(ctx, req)
+	if err == nil {
+		return nil, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	prev := &IdempotentRequest{}
+	if err := m.coll.FindOne(ctx, bson.M{"_id": id}).Decode(prev); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// released or expired in the meantime, the retry has to start over
+			return nil, ErrIdempotencyKeyInProgress
+		}
+		return nil, err
+	}
+	switch {
+	case prev.Fingerprint != fingerprint:
+		return nil, ErrIdempotencyKeyReused
+	case !prev.Completed:
+		return nil, ErrIdempotencyKeyInProgress
+	}
+	return prev, nil
+}
+
+// Complete stores the response of the request, with the headers to replay.
+func (m IdempotencyModel) Complete(id string, status int, contentType string, headers map[string][]string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{
+		"completed":    true,
+		"status":       status,
+		"content_type": contentType,
+		"headers":      headers,
+		"body":         body,
+	}}
+	_, err := m.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+	return err
+}
+
+// Release forgets the key, so that the request can be retried.
+func (m IdempotencyModel) Release(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.coll.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
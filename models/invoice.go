@@ -0,0 +1,328 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	InvoiceTypeInvoice    = "invoice"
+	InvoiceTypeCreditNote = "credit_note"
+)
+
+var ErrDuplicateInvoice = errors.New("the document has already been issued")
+
+type InvoiceLine struct {
+	Description string `json:"description" bson:"description"`
+	SKU         string `json:"sku,omitempty" bson:"sku,omitempty"`
+	Quantity    int    `json:"quantity" bson:"quantity"`
+	UnitPrice   int    `json:"unit_price" bson:"unit_price"`
+	TaxRate     int    `json:"tax_rate" bson:"tax_rate"`
+	Tax         int    `json:"tax" bson:"tax"`
+	Total       int    `json:"total" bson:"total"`
+}
+
+// Invoice is an invoice or a credit note. Its number is sequential and gap free per
+// type, and it never changes once issued.
+type Invoice struct {
+	ID             primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Type           string             `json:"type" bson:"type"`
+	Number         int64              `json:"-" bson:"number"`
+	DisplayNumber  string             `json:"number" bson:"display_number"`
+	OrderId        primitive.ObjectID `json:"order_id" bson:"order_id"`
+	OrderNumber    int64              `json:"order_number,omitempty" bson:"order_number,omitempty"`
+	UserId         primitive.ObjectID `json:"user_id" bson:"user_id"`
+	RefundId       string             `json:"refund_id,omitempty" bson:"refund_id,omitempty"`
+	BillingAddress *Address           `json:"billing_address,omitempty" bson:"billing_address,omitempty"`
+	Lines          []InvoiceLine      `json:"lines" bson:"lines"`
+	Subtotal       int                `json:"subtotal" bson:"subtotal"`
+	ShippingCost   int                `json:"shipping_cost" bson:"shipping_cost"`
+	Discount       int                `json:"discount" bson:"discount"`
+	Tax            int                `json:"tax" bson:"tax"`
+	TaxInclusive   bool               `json:"tax_inclusive" bson:"tax_inclusive"`
+	TaxBreakdown   []TaxLine          `json:"tax_breakdown" bson:"tax_breakdown"`
+	Total          int                `json:"total" bson:"total"`
+	Currency       string             `json:"currency" bson:"currency"`
+	// key of the PDF in object storage, empty until it has been stored
+	PDFKey   string    `json:"-" bson:"pdf_key,omitempty"`
+	IssuedAt time.Time `json:"issued_at" bson:"issued_at"`
+}
+
+// IsPaid reports whether the order has been paid, which is when it gets its invoice.
+func (o *Order) IsPaid() bool {
+	switch o.Status {
+	case StatusPayed, StatusShipped, StatusDelivered, StatusRefunded:
+		return true
+	case StatusCanceled:
+		return o.Cancellation != nil && o.Cancellation.WasPaid
+	}
+	return false
+}
+
+type InvoiceModel struct {
+	coll     *mongo.Collection
+	counters CounterModel
+}
+
+func invoiceLine(op OrderProducts, quantity int) InvoiceLine {
+	line := InvoiceLine{
+		Description: strings.Join([]string{op.Name, op.Color, op.Size}, " / "),
+		SKU:         op.SKU,
+		Quantity:    quantity,
+		UnitPrice:   op.UnitPrice,
+		TaxRate:     op.TaxRate,
+		Total:       op.UnitPrice * quantity,
+	}
+	if op.Quantity > 0 {
+		line.Tax = op.Tax * quantity / op.Quantity
+	}
+	return line
+}
+
+// NewInvoice builds the invoice of the order from its snapshotted lines. Orders
+// placed before they had a billing address are billed to their shipping address.
+func NewInvoice(order *Order) *Invoice {
+	billing := order.BillingAddress
+	if billing == nil {
+		billing = order.ShippingAddress
+	}
+	inv := &Invoice{
+		Type:           InvoiceTypeInvoice,
+		OrderId:        order.ID,
+		OrderNumber:    order.Number,
+		UserId:         order.UserId,
+		BillingAddress: billing,
+		Lines:          make([]InvoiceLine, 0, len(order.Products)),
+		Subtotal:       order.Subtotal,
+		ShippingCost:   order.ShippingCost,
+		Discount:       order.Discount,
+		Tax:            order.Tax,
+		TaxInclusive:   order.TaxInclusive,
+		TaxBreakdown:   order.TaxBreakdown,
+		Total:          order.Total,
+		Currency:       "USD",
+	}
+	for _, op := range order.Products {
+		inv.Lines = append(inv.Lines, invoiceLine(op, op.Quantity))
+	}
+	if inv.TaxBreakdown == nil {
+		inv.TaxBreakdown = []TaxLine{}
+	}
+	return inv
+}
+
+// NewCreditNote builds the credit note of a refund of amount. With quantities, the
+// refunded quantity of every order line, the note lists those lines. Without, it
+// credits the whole order when amount is its total, or a share of it otherwise.
+func NewCreditNote(order *Order, refundId string, amount int, quantities map[primitive.ObjectID]int) *Invoice {
+	note := NewInvoice(order)
+	note.Type = InvoiceTypeCreditNote
+	note.RefundId = refundId
+	note.Total = amount
+
+	switch {
+	case quantities != nil:
+		note.Lines = note.Lines[:0]
+		note.ShippingCost = 0
+		note.Discount = 0
+		note.Subtotal = 0
+		note.Tax = 0
+		names := make(map[int]string)
+		for _, tl := range order.TaxBreakdown {
+			names[tl.Rate] = tl.Name
+		}
+		breakdown := make(map[int]*TaxLine)
+		note.TaxBreakdown = []TaxLine{}
+		for _, op := range order.Products {
+			quantity := quantities[op.ID]
+			if quantity == 0 {
+				continue
+			}
+			line := invoiceLine(op, quantity)
+			note.Lines = append(note.Lines, line)
+			note.Subtotal += line.Total
+			note.Tax += line.Tax
+			if line.TaxRate == 0 {
+				continue
+			}
+			if _, ok := breakdown[line.TaxRate]; !ok {
+				note.TaxBreakdown = append(note.TaxBreakdown, TaxLine{Name: names[line.TaxRate], Rate: line.TaxRate})
+				breakdown[line.TaxRate] = &note.TaxBreakdown[len(note.TaxBreakdown)-1]
+			}
+			taxable := line.Total
+			if order.TaxInclusive {
+				taxable -= line.Tax
+			}
+			breakdown[line.TaxRate].Taxable += taxable
+			breakdown[line.TaxRate].Tax += line.Tax
+		}
+	case amount != order.Total && order.Total > 0:
+		// a partial refund that isn't tied to lines credits the same share of every amount
+		share := func(v int) int { return v * amount / order.Total }
+		note.Lines = []InvoiceLine{{
+			Description: "Partial refund of order " + order.Reference(),
+			Quantity:    1,
+			UnitPrice:   amount,
+			Tax:         share(order.Tax),
+			Total:       amount,
+		}}
+		note.Subtotal = amount
+		note.ShippingCost = 0
+		note.Discount = 0
+		note.Tax = share(order.Tax)
+		note.TaxBreakdown = make([]TaxLine, 0, len(order.TaxBreakdown))
+		for _, tl := range order.TaxBreakdown {
+			note.TaxBreakdown = append(note.TaxBreakdown, TaxLine{Name: tl.Name, Rate: tl.Rate, Taxable: share(tl.Taxable), Tax: share(tl.Tax)})
+		}
+		if !order.TaxInclusive {
+			note.Subtotal -= note.Tax
+			note.Lines[0].UnitPrice -= note.Tax
+			note.Lines[0].Total -= note.Tax
+		}
+	}
+	return note
+}
+
+func (m InvoiceModel) createIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "type", Value: 1}, {Key: "number", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		// an order has one invoice
+		{
+			Keys: bson.D{{Key: "order_id", Value: 1}},
+			Options: options.Index().
+				SetName("one_invoice_per_order").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"type": InvoiceTypeInvoice}),
+		},
+		// and one credit note per refund
+		{
+			Keys: bson.D{{Key: "refund_id", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"refund_id": bson.M{"$exists": true}}),
+		},
+		{Keys: bson.D{{Key: "order_id", Value: 1}, {Key: "type", Value: 1}, {Key: "number", Value: 1}}},
+	})
+	return err
+}
+
+// Insert numbers and saves the document. The number is taken from the counter of the
+// type in the same transaction as the insert, so a failed insert doesn't leave a gap.
+// Transactions need mongo to run as a replica set, the api checks it when it connects.
+// It returns ErrDuplicateInvoice if the order already has an invoice or the refund
+// already has a credit note.
+func (m InvoiceModel) Insert(inv *Invoice) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	session, err := m.coll.Database().Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	inv.ID = primitive.NewObjectID()
+	inv.IssuedAt = time.Now()
+	_, err = session.WithTransaction(ctx, func(ctx context.Context) (any, error) {
+		number, err := m.counters.next(ctx, inv.Type)
+		if err != nil {
+			return nil, err
+		}
+		inv.Number = number
+		inv.DisplayNumber = invoiceDisplayNumber(inv.Type, number)
+		return m.coll.InsertOne(ctx, inv)
+	})
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicateInvoice
+		}
+		return err
+	}
+	return nil
+}
+
+func invoiceDisplayNumber(kind string, number int64) string {
+	prefix := "INV"
+	if kind == InvoiceTypeCreditNote {
+		prefix = "CN"
+	}
+	return fmt.Sprintf("%s-%06d", prefix, number)
+}
+
+func (m InvoiceModel) Get(id primitive.ObjectID) (*Invoice, error) {
+	return m.getOne(bson.M{"_id": id})
+}
+
+// GetForOrder returns the invoice of the order.
+func (m InvoiceModel) GetForOrder(orderId primitive.ObjectID) (*Invoice, error) {
+	return m.getOne(bson.M{"order_id": orderId, "type": InvoiceTypeInvoice})
+}
+
+func (m InvoiceModel) GetByRefund(refundId string) (*Invoice, error) {
+	return m.getOne(bson.M{"refund_id": refundId})
+}
+
+func (m InvoiceModel) getOne(filter bson.M) (*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	inv := &Invoice{}
+	if err := m.coll.FindOne(ctx, filter).Decode(inv); err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+	return inv, nil
+}
+
+// GetCreditNotes returns the credit notes of the order, oldest first.
+func (m InvoiceModel) GetCreditNotes(orderId primitive.ObjectID) ([]Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{"order_id": orderId, "type": InvoiceTypeCreditNote}
+	opts := options.Find().SetSort(bson.D{{Key: "number", Value: 1}})
+	cursor, err := m.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	notes := make([]Invoice, 0)
+	if err := cursor.All(ctx, &notes); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// SetPDF records where the PDF of the document is stored.
+func (m InvoiceModel) SetPDF(id primitive.ObjectID, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"pdf_key": key}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -1,37 +1,163 @@
 package models
 
 import (
+	"context"
 	"errors"
+	"time"
 
+	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
 var (
 	ErrUsedEmail = errors.New("email already in use")
 	ErrInvalidID = errors.New("invalid id")
 	ErrNotFound  = errors.New("resource doesn't exist")
+
+	ErrActiveCartExists  = errors.New("user already has an active cart")
+	ErrOutOfStock        = errors.New("not enough items in stock")
+	ErrDuplicateOrder    = errors.New("order already exists")
+	ErrInvalidTransition = errors.New("order status can't be changed to the requested status")
 )
 
 type Models struct {
-	User    UserModel
-	Product ProductModel
-	Cart    CartModel
-	Token   TokenModel
-	Order   OrderModel
-	Review  ReviewModel
-	Variant VariantModel
+	User              UserModel
+	Product           ProductModel
+	Cart              CartModel
+	Token             TokenModel
+	Order             OrderModel
+	Review            ReviewModel
+	Variant           VariantModel
+	StockSubscription StockSubscriptionModel
+	Wishlist          WishlistModel
+	Return            ReturnModel
+	Address           AddressModel
+	ShippingZone      ShippingZoneModel
+	Shipment          ShipmentModel
+	TaxRate           TaxRateModel
+	Counter           CounterModel
+	Invoice           InvoiceModel
+	OrderEvent        OrderEventModel
+	WebhookEvent      WebhookEventModel
+	Idempotency       IdempotencyModel
 }
 
 func NewModels(db *mongo.Database) Models {
+	counters := CounterModel{coll: db.Collection("counters", nil)}
+	variants := VariantModel{coll: db.Collection("variants", nil), infoColl: db.Collection("sizes", nil)}
 	return Models{
 		User:    UserModel{coll: db.Collection("users", nil)},
 		Product: ProductModel{coll: db.Collection("products", nil)},
 		Token:   TokenModel{coll: db.Collection("tokens", nil)},
-		Cart:    CartModel{coll: db.Collection("products", nil)},
-		Order: OrderModel{ // no need
-			coll: db.Collection("orders", nil),
+		Cart:    CartModel{coll: db.Collection("carts", nil)},
+		Order: OrderModel{
+			coll:     db.Collection("orders", nil),
+			counters: counters,
+			variants: variants,
 		},
-		Review:  ReviewModel{coll: db.Collection("review", nil)},
-		Variant: VariantModel{coll: db.Collection("variants", nil), infoColl: db.Collection("sizes", nil)},
+		Review:            ReviewModel{coll: db.Collection("review", nil)},
+		Variant:           variants,
+		StockSubscription: StockSubscriptionModel{coll: db.Collection("stock_subscriptions", nil)},
+		Wishlist:          WishlistModel{coll: db.Collection("wishlists", nil)},
+		Return:            ReturnModel{coll: db.Collection("returns", nil)},
+		Address:           AddressModel{coll: db.Collection("addresses", nil)},
+		ShippingZone:      ShippingZoneModel{coll: db.Collection("shipping_zones", nil)},
+		Shipment:          ShipmentModel{coll: db.Collection("shipments", nil)},
+		TaxRate:           TaxRateModel{coll: db.Collection("tax_rates", nil)},
+		Counter:           counters,
+		Invoice:           InvoiceModel{coll: db.Collection("invoices", nil), counters: counters},
+		OrderEvent:        OrderEventModel{coll: db.Collection("order_events", nil)},
+		WebhookEvent:      WebhookEventModel{coll: db.Collection("webhook_events", nil)},
+		Idempotency:       IdempotencyModel{coll: db.Collection("idempotency_keys", nil)},
+	}
+}
+
+type IndexConfig struct {
+	CartTTL time.Duration
+	// how long idempotency keys and their responses are kept
+	IdempotencyTTL time.Duration
+}
+
+// CreateIndexes creates the indexes the models rely on. Creating an index that
+// already exists is a no-op, indexes that were replaced are dropped and changed
+// ttls are applied in place, so it is safe to call on every start up.
+func (m Models) CreateIndexes(cfg IndexConfig) error {
+	if err := m.Cart.createIndexes(cfg.CartTTL); err != nil {
+		return err
+	}
+	if err := m.Order.createIndexes(); err != nil {
+		return err
+	}
+	if err := m.Wishlist.createIndexes(); err != nil {
+		return err
+	}
+	if err := m.Return.createIndexes(); err != nil {
+		return err
+	}
+	if err := m.Address.createIndexes(); err != nil {
+		return err
+	}
+	if err := m.ShippingZone.createIndexes(); err != nil {
+		return err
+	}
+	if err := m.Shipment.createIndexes(); err != nil {
+		return err
+	}
+	if err := m.TaxRate.createIndexes(); err != nil {
+		return err
+	}
+	if err := m.Invoice.createIndexes(); err != nil {
+		return err
+	}
+	if err := m.OrderEvent.createIndexes(); err != nil {
+		return err
+	}
+	if err := m.WebhookEvent.createIndexes(); err != nil {
+		return err
+	}
+	return m.Idempotency.createIndexes(cfg.IdempotencyTTL)
+}
+
+// error codes of the server for a missing collection or index, and for an index
+// that exists with different options
+const (
+	codeNamespaceNotFound    = 26
+	codeIndexNotFound        = 27
+	codeIndexOptionsConflict = 85
+)
+
+// dropIndex removes an index that has been replaced by one with a different definition.
+// Dropping an index that doesn't exist is a no-op.
+func dropIndex(ctx context.Context, coll *mongo.Collection, name string) error {
+	err := coll.Indexes().DropOne(ctx, name)
+	var se mongo.ServerError
+	if errors.As(err, &se) && (se.HasErrorCode(codeIndexNotFound) || se.HasErrorCode(codeNamespaceNotFound)) {
+		return nil
+	}
+	return err
+}
+
+// createTTLIndex creates an index that expires documents ttl after the time of keys.
+// If the index already exists with a different ttl, its ttl is changed in place.
+// The partial filter is optional.
+func createTTLIndex(ctx context.Context, coll *mongo.Collection, name string, keys bson.D, ttl time.Duration, partial bson.M) error {
+	opts := options.Index().SetName(name).SetExpireAfterSeconds(int32(ttl.Seconds()))
+	if partial != nil {
+		opts.SetPartialFilterExpression(partial)
+	}
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys, Options: opts})
+	var se mongo.ServerError
+	if !errors.As(err, &se) || !se.HasErrorCode(codeIndexOptionsConflict) {
+		return err
+	}
+
+	cmd := bson.D{
+		{Key: "collMod", Value: coll.Name()},
+		{Key: "index", Value: bson.D{
+			{Key: "name", Value: name},
+			{Key: "expireAfterSeconds", Value: int32(ttl.Seconds())},
+		}},
 	}
+	return coll.Database().RunCommand(ctx, cmd).Err()
 }
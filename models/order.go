@@ -6,12 +6,16 @@ package models
 import (
 	"context"
 	"errors"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/GiorgosMarga/ecom_go/internal/validator"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
 const (
@@ -20,32 +24,133 @@ const (
 	StatusShipped
 	StatusDelivered
 	StatusCanceled
+	// StatusRefunded is a paid order whose payment has been refunded in full.
+	StatusRefunded
 )
 
+// OrderProducts is a line of an order. Next to what was bought, it keeps a snapshot
+// of the product as it was when the order was created, so that later changes to the
+// catalog don't rewrite the history of the order.
 type OrderProducts struct {
+	ID       primitive.ObjectID `json:"id" bson:"id"`
 	Variant  primitive.ObjectID `json:"variant_id" bson:"variant_id"`
 	Size     string             `json:"size" bson:"size"`
 	Quantity int                `json:"quantity" bson:"quantity"`
+
+	SKU       string `json:"sku" bson:"sku"`
+	Name      string `json:"name" bson:"name"`
+	Color     string `json:"color" bson:"color"`
+	Image     string `json:"image,omitempty" bson:"image,omitempty"`
+	UnitPrice int    `json:"unit_price" bson:"unit_price"`
+	LineTotal int    `json:"line_total" bson:"line_total"`
+	TaxClass  string `json:"tax_class" bson:"tax_class"`
+	// tax rate in basis points and tax amount of the line
+	TaxRate int `json:"tax_rate" bson:"tax_rate"`
+	Tax     int `json:"tax" bson:"tax"`
+}
+
+type OrderLinePayload struct {
+	VariantId primitive.ObjectID `json:"variant_id"`
+	Size      string             `json:"size"`
+	Quantity  int                `json:"quantity"`
 }
 
 type Order struct {
 	ID              primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Number          int64              `json:"number,omitempty" bson:"number,omitempty"`
 	UserId          primitive.ObjectID `json:"user_id" bson:"user_id"`
+	CartId          primitive.ObjectID `json:"cart_id,omitempty" bson:"cart_id,omitempty"`
 	Products        []OrderProducts    `json:"products" bson:"products"`
+	ShippingAddress *Address           `json:"shipping_address,omitempty" bson:"shipping_address,omitempty"`
+	BillingAddress  *Address           `json:"billing_address,omitempty" bson:"billing_address,omitempty"`
+	ShippingMethod  string             `json:"shipping_method,omitempty" bson:"shipping_method,omitempty"`
+	Subtotal        int                `json:"subtotal" bson:"subtotal"`
+	ShippingCost    int                `json:"shipping_cost" bson:"shipping_cost"`
+	Tax             int                `json:"tax" bson:"tax"`
+	TaxInclusive    bool               `json:"tax_inclusive" bson:"tax_inclusive"` // the prices of the lines include the tax
+	TaxBreakdown    []TaxLine          `json:"tax_breakdown,omitempty" bson:"tax_breakdown,omitempty"`
+	Discount        int                `json:"discount" bson:"discount"`
 	Total           int                `json:"total" bson:"total"`
 	Status          int                `json:"status" bson:"status"`
+	StatusHistory   []StatusChange     `json:"status_history" bson:"status_history"`
 	PaymentIntentId string             `json:"payment_intent_id" bson:"payment_intent_id"`
-	CreatedAt       time.Time          `json:"created_at" bson:"created_at"`
-	UpdatedAt       time.Time          `json:"updated_at" bson:"updated_at"`
+	AmountRefunded  int                `json:"amount_refunded" bson:"amount_refunded"`
+	Refunds         []OrderRefund      `json:"refunds,omitempty" bson:"refunds,omitempty"`
+	Cancellation    *Cancellation      `json:"cancellation,omitempty" bson:"cancellation,omitempty"`
+	// AmountRefunded is the sum of the refunds made through the API that didn't fail,
+	// AmountReceived what the provider received for the order and ProviderRefunded the
+	// total the provider reports refunded, refunds made from its dashboard included
+	AmountReceived   int `json:"amount_received" bson:"amount_received,omitempty"`
+	ProviderRefunded int `json:"provider_refunded" bson:"provider_refunded,omitempty"`
+	// true when the stock of the products was taken out at checkout
+	StockReserved bool      `json:"-" bson:"stock_reserved"`
+	CreatedAt     time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at" bson:"updated_at"`
+	// when the pending order job last had to leave the order as it was
+	ExpiryCheckedAt *time.Time `json:"-" bson:"expiry_checked_at,omitempty"`
 }
 
 type OrderModel struct {
-	coll *mongo.Collection
+	coll     *mongo.Collection
+	counters CounterModel
+	variants VariantModel
+}
+
+// OrderRef identifies an order either by its ObjectID or by its number.
+type OrderRef struct {
+	ID     primitive.ObjectID
+	Number int64
+}
+
+// ParseOrderRef reads an ObjectID or an order number, optionally prefixed with #.
+func ParseOrderRef(s string) (OrderRef, error) {
+	if id, err := primitive.ObjectIDFromHex(s); err == nil {
+		return OrderRef{ID: id}, nil
+	}
+	number, err := strconv.ParseInt(strings.TrimPrefix(s, "#"), 10, 64)
+	if err != nil || number <= 0 {
+		return OrderRef{}, ErrInvalidID
+	}
+	return OrderRef{Number: number}, nil
+}
+
+func (r OrderRef) filter() bson.M {
+	if r.Number != 0 {
+		return bson.M{"number": r.Number}
+	}
+	return bson.M{"_id": r.ID}
 }
 
+// CheckoutPayload ships the order either to an address of the address book or to
+// the given address. If neither is set the default address of the user is used.
+// The billing address is chosen the same way and defaults to the shipping address.
+type CheckoutPayload struct {
+	CartId           primitive.ObjectID `json:"cart_id"`
+	AddressId        primitive.ObjectID `json:"address_id"`
+	ShippingAddress  *Address           `json:"shipping_address"`
+	BillingAddressId primitive.ObjectID `json:"billing_address_id"`
+	BillingAddress   *Address           `json:"billing_address"`
+	ShippingMethod   string             `json:"shipping_method"`
+}
+
+// OrderSearch holds the filters of the admin order search. Zero values are ignored.
+type OrderSearch struct {
+	Ref             *OrderRef
+	Status          *int
+	UserId          primitive.ObjectID
+	From            *time.Time
+	To              *time.Time
+	ToExclusive     bool // orders created exactly at To are left out
+	MinTotal        *int
+	MaxTotal        *int
+	PaymentIntentId string
+	Filters
+}
+
+var OrderSortSafelist = []string{"created_at", "total", "status", "-created_at", "-total", "-status"}
+
 type OrderUpdatePayload struct {
-	Products []OrderProducts `json:"products" bson:"products"`
-	Status   *int            `json:"status" bson:"status"`
+	Status *int `json:"status" bson:"status"`
 }
 
 func ValidateOrderUpdatePayload(v *validator.Validator, payload OrderUpdatePayload) {
@@ -58,19 +163,260 @@ func ValidateOrderUpdatePayload(v *validator.Validator, payload OrderUpdatePaylo
 	}
 }
 
-func (m OrderModel) Insert(order *Order) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// Reference returns how the order is shown to people: its number, or its ObjectID for
+// orders placed before orders were numbered.
+func (o *Order) Reference() string {
+	if o.Number == 0 {
+		return o.ID.Hex()
+	}
+	return "#" + strconv.FormatInt(o.Number, 10)
+}
+
+// ComputeTotal sums the snapshotted lines and adds shipping and tax minus discounts.
+// Tax that is included in the prices of the lines isn't added again.
+func (o *Order) ComputeTotal() {
+	o.Subtotal = 0
+	for _, line := range o.Products {
+		o.Subtotal += line.LineTotal
+	}
+	o.Total = o.Subtotal + o.ShippingCost - o.Discount
+	if !o.TaxInclusive {
+		o.Total += o.Tax
+	}
+}
+
+func ValidateCheckoutPayload(v *validator.Validator, payload CheckoutPayload) {
+	v.Validate(!payload.CartId.IsZero(), "cart_id", "must be provided")
+	v.Validate(!validator.IsEmpty(payload.ShippingMethod), "shipping_method", "must be provided")
+	v.Validate(payload.AddressId.IsZero() || payload.ShippingAddress == nil, "shipping_address", "can't be used together with address_id")
+	if payload.ShippingAddress != nil {
+		ValidateAddress(v, *payload.ShippingAddress)
+	}
+	v.Validate(payload.BillingAddressId.IsZero() || payload.BillingAddress == nil, "billing_address", "can't be used together with billing_address_id")
+	if payload.BillingAddress != nil {
+		ValidateAddress(v, *payload.BillingAddress)
+	}
+}
+
+func ValidateOrderSearch(v *validator.Validator, s OrderSearch) {
+	ValidateFilters(v, s.Filters)
+	if s.Status != nil {
+		v.Validate(validator.IsAllowedValue(*s.Status, []int{StatusPending,
+			StatusPayed,
+			StatusShipped,
+			StatusDelivered,
+			StatusCanceled,
+			StatusRefunded}), "status", "not allowed status")
+	}
+	if s.From != nil && s.To != nil {
+		v.Validate(!s.From.After(*s.To), "from", "must be before to")
+	}
+	if s.MinTotal != nil && s.MaxTotal != nil {
+		v.Validate(*s.MinTotal <= *s.MaxTotal, "min_total", "must be less than max_total")
+	}
+}
+
+func (m OrderModel) createIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	_, err := m.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		// a cart can be checked out only once
+		{
+			Keys: bson.D{{Key: "cart_id", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"cart_id": bson.M{"$exists": true}}),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "payment_intent_id", Value: 1}}},
+		// orders placed before numbers were introduced don't have one
+		{
+			Keys: bson.D{{Key: "number", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"number": bson.M{"$exists": true}}),
+		},
+	})
+	return err
+}
+
+func (s OrderSearch) filter() bson.M {
+	filter := bson.M{}
+	if s.Ref != nil {
+		filter = s.Ref.filter()
+	}
+	if s.Status != nil {
+		filter["status"] = *s.Status
+	}
+	if !s.UserId.IsZero() {
+		filter["user_id"] = s.UserId
+	}
+	if s.PaymentIntentId != "" {
+		filter["payment_intent_id"] = s.PaymentIntentId
+	}
+	createdAt := bson.M{}
+	if s.From != nil {
+		createdAt["$gte"] = *s.From
+	}
+	if s.To != nil && s.ToExclusive {
+		createdAt["$lt"] = *s.To
+	} else if s.To != nil {
+		createdAt["$lte"] = *s.To
+	}
+	if len(createdAt) > 0 {
+		filter["created_at"] = createdAt
+	}
+	total := bson.M{}
+	if s.MinTotal != nil {
+		total["$gte"] = *s.MinTotal
+	}
+	if s.MaxTotal != nil {
+		total["$lte"] = *s.MaxTotal
+	}
+	if len(total) > 0 {
+		filter["total"] = total
+	}
+	return filter
+}
+
+func (m OrderModel) find(filter bson.M, filters Filters) ([]Order, Metadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	total, err := m.coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	cursor, err := m.coll.Find(ctx, filter, filters.findOptions())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer cursor.Close(ctx)
+
+	orders := make([]Order, 0)
+	if err := cursor.All(ctx, &orders); err != nil {
+		return nil, Metadata{}, err
+	}
+	return orders, calculateMetadata(total, filters.Page, filters.PageSize), nil
+}
+
+// GetAllForUser returns a page of the orders of the user.
+func (m OrderModel) GetAllForUser(userId primitive.ObjectID, filters Filters) ([]Order, Metadata, error) {
+	return m.find(bson.M{"user_id": userId}, filters)
+}
+
+// Search returns a page of the orders that match the search.
+func (m OrderModel) Search(s OrderSearch) ([]Order, Metadata, error) {
+	return m.find(s.filter(), s.Filters)
+}
+
+// Export calls fn for every order that matches the search, in the order of the
+// search sort. Pagination is ignored.
+func (m OrderModel) Export(s OrderSearch, fn func(Order) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: s.sortField(), Value: s.sortDirection()}, {Key: "_id", Value: 1}})
+	cursor, err := m.coll.Find(ctx, s.filter(), opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var order Order
+		if err := cursor.Decode(&order); err != nil {
+			return err
+		}
+		if err := fn(order); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// Place reserves the stock of the products of the order and inserts the order, in one
+// transaction so that stock is never taken without an order that holds it. Either the
+// order is placed with its stock reserved or nothing is written: ErrOutOfStock is
+// returned if a line doesn't have enough stock and ErrDuplicateOrder if the cart was
+// checked out already. On success the variants are returned as they are after the
+// reservation, in the order of the products.
+func (m OrderModel) Place(order *Order) ([]Variant, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	session, err := m.coll.Database().Client().StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	var variants []Variant
+	_, err = session.WithTransaction(ctx, func(ctx context.Context) (any, error) {
+		var err error
+		if variants, err = m.variants.reserveStock(ctx, order.Products); err != nil {
+			return nil, err
+		}
+		order.StockReserved = true
+		return nil, m.insert(ctx, order)
+	})
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrDuplicateOrder
+		}
+		return nil, err
+	}
+	return variants, nil
+}
+
+func (m OrderModel) insert(ctx context.Context, order *Order) error {
+	number, err := m.counters.next(ctx, "orders")
+	if err != nil {
+		return err
+	}
 	order.ID = primitive.NewObjectID()
+	order.Number = number
 	order.Status = StatusPending
+	order.StatusHistory = make([]StatusChange, 0)
 	order.CreatedAt = time.Now()
 	order.UpdatedAt = time.Now()
 
-	_, err := m.coll.InsertOne(ctx, order)
+	_, err = m.coll.InsertOne(ctx, order)
+	return err
+}
+
+func (m OrderModel) GetByCartId(cartId primitive.ObjectID) (*Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	order := &Order{}
+	err := m.coll.FindOne(ctx, bson.M{"cart_id": cartId}).Decode(order)
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+func (m OrderModel) SetPaymentIntent(id primitive.ObjectID, paymentIntentId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"payment_intent_id": paymentIntentId, "updated_at": time.Now()}}
+	res, err := m.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
 	if err != nil {
 		return err
 	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
 
@@ -93,6 +439,76 @@ func (m OrderModel) Get(id primitive.ObjectID) (*Order, error) {
 	return order, err
 }
 
+// GetByPaymentIntent returns the order that is paid with the payment intent.
+func (m OrderModel) GetByPaymentIntent(paymentIntentId string) (*Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	order := &Order{}
+	if err := m.coll.FindOne(ctx, bson.M{"payment_intent_id": paymentIntentId}).Decode(order); err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// SetAmountReceived records what the payment provider received for the order.
+func (m OrderModel) SetAmountReceived(id primitive.ObjectID, amount int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"amount_received": amount, "updated_at": time.Now()}}
+	res, err := m.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetProviderRefunded records how much of the payment the provider reports refunded in
+// total. The amount only grows, so notifications that arrive late or twice don't lower it.
+func (m OrderModel) SetProviderRefunded(id primitive.ObjectID, amount int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	update := bson.M{
+		"$max": bson.M{"provider_refunded": amount},
+		"$set": bson.M{"updated_at": time.Now()},
+	}
+	res, err := m.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetByRef returns the order by its ObjectID or by its number.
+func (m OrderModel) GetByRef(ref OrderRef) (*Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	order := &Order{}
+	if err := m.coll.FindOne(ctx, ref.filter()).Decode(order); err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
 func (m OrderModel) Delete(id primitive.ObjectID) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -127,3 +543,53 @@ func (m OrderModel) Update(order *Order) error {
 	}
 	return nil
 }
+
+// reserveLineQuantities adds the quantities, keyed by order line, to the counter of the
+// order lines in field. The update only applies if no line ends up counting more items,
+// with the items taken otherwise, than were bought, otherwise errExceeds is returned.
+// Checking and counting in a single update keeps concurrent requests from going over
+// the order.
+func (m OrderModel) reserveLineQuantities(order *Order, field string, quantities, taken map[primitive.ObjectID]int, errExceeds error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	conditions := bson.A{}
+	inc := bson.M{}
+	for lineId, quantity := range quantities {
+		idx := slices.IndexFunc(order.Products, func(op OrderProducts) bool { return op.ID == lineId })
+		if idx == -1 {
+			return errExceeds
+		}
+		counter := field + "." + lineId.Hex()
+		conditions = append(conditions, bson.M{"$lte": bson.A{
+			bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$" + counter, 0}}, quantity + taken[lineId]}},
+			order.Products[idx].Quantity,
+		}})
+		inc[counter] = quantity
+	}
+
+	filter := bson.M{"_id": order.ID, "$expr": bson.M{"$and": conditions}}
+	update := bson.M{"$inc": inc, "$set": bson.M{"updated_at": time.Now()}}
+	res, err := m.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errExceeds
+	}
+	return nil
+}
+
+// releaseLineQuantities undoes reserveLineQuantities.
+func (m OrderModel) releaseLineQuantities(orderId primitive.ObjectID, field string, quantities map[primitive.ObjectID]int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	inc := bson.M{}
+	for lineId, quantity := range quantities {
+		inc[field+"."+lineId.Hex()] = -quantity
+	}
+	update := bson.M{"$inc": inc, "$set": bson.M{"updated_at": time.Now()}}
+	_, err := m.coll.UpdateOne(ctx, bson.M{"_id": orderId}, update)
+	return err
+}
@@ -0,0 +1,203 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Cancellation records why and by whom an order was canceled, and how far the
+// follow up work (restocking and refunding) has gone, so that a retried
+// cancellation only does what is left.
+type Cancellation struct {
+	Reason        string             `json:"reason" bson:"reason"`
+	ActorId       primitive.ObjectID `json:"actor_id,omitempty" bson:"actor_id,omitempty"`
+	ActorRole     Role               `json:"actor_role" bson:"actor_role"`
+	CanceledAt    time.Time          `json:"canceled_at" bson:"canceled_at"`
+	WasPaid       bool               `json:"was_paid" bson:"was_paid"`
+	StockRestored bool               `json:"stock_restored" bson:"stock_restored"`
+	RefundId      string             `json:"refund_id,omitempty" bson:"refund_id,omitempty"`
+	RefundStatus  string             `json:"refund_status,omitempty" bson:"refund_status,omitempty"`
+	RefundedAt    *time.Time         `json:"refunded_at,omitempty" bson:"refunded_at,omitempty"`
+	// indexes of the lines whose stock has been put back
+	RestockedLines []int `json:"-" bson:"restocked_lines,omitempty"`
+}
+
+type CancelOrderPayload struct {
+	Reason string `json:"reason"`
+}
+
+func ValidateCancelOrderPayload(v *validator.Validator, payload CancelOrderPayload) {
+	v.Validate(!validator.IsEmpty(payload.Reason), "reason", "must be provided")
+	v.Validate(len(payload.Reason) <= 500, "reason", "must not be more than 500 bytes long")
+}
+
+// NeedsRestock reports whether the stock taken out for the order still has to be put back.
+func (c *Cancellation) NeedsRestock(order *Order) bool {
+	return order.StockReserved && !c.StockRestored
+}
+
+// NeedsRefund reports whether the payment of the order still has to be refunded.
+func (c *Cancellation) NeedsRefund(order *Order) bool {
+	return c.WasPaid && order.PaymentIntentId != "" && c.RefundId == ""
+}
+
+// Cancel moves the order to StatusCanceled and records the cancellation in the same update.
+func (m OrderModel) Cancel(order *Order, change StatusChange, reason string) error {
+	change.To = StatusCanceled
+	cancellation := &Cancellation{
+		Reason:     reason,
+		ActorId:    change.ActorId,
+		ActorRole:  change.ActorRole,
+		CanceledAt: time.Now(),
+		WasPaid:    change.From == StatusPayed,
+	}
+	if err := m.transition(order, change, bson.M{"cancellation": cancellation}); err != nil {
+		return err
+	}
+	order.Cancellation = cancellation
+	return nil
+}
+
+// ClaimLineRestock marks line i of a canceled order as restocked. It returns false if
+// another request already did, in which case the caller must not restock it again.
+func (m OrderModel) ClaimLineRestock(id primitive.ObjectID, i int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":                          id,
+		"status":                       StatusCanceled,
+		"cancellation.stock_restored":  false,
+		"cancellation.restocked_lines": bson.M{"$ne": i},
+	}
+	update := bson.M{
+		"$push": bson.M{"cancellation.restocked_lines": i},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	res, err := m.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// UnclaimLineRestock undoes ClaimLineRestock when putting the stock of the line back failed.
+func (m OrderModel) UnclaimLineRestock(id primitive.ObjectID, i int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	update := bson.M{
+		"$pull": bson.M{"cancellation.restocked_lines": i},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	_, err := m.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+	return err
+}
+
+// SetStockRestored marks the stock of a canceled order as put back once all of its
+// lines have been restocked. It returns false while some lines are left.
+func (m OrderModel) SetStockRestored(id primitive.ObjectID, lines int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":                          id,
+		"status":                       StatusCanceled,
+		"cancellation.restocked_lines": bson.M{"$size": lines},
+	}
+	update := bson.M{"$set": bson.M{"cancellation.stock_restored": true, "updated_at": time.Now()}}
+	res, err := m.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// SetCancellationRefund records the refund issued for a canceled order.
+func (m OrderModel) SetCancellationRefund(id primitive.ObjectID, refundId, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	update := bson.M{"$set": bson.M{
+		"cancellation.refund_id":     refundId,
+		"cancellation.refund_status": status,
+		"cancellation.refunded_at":   now,
+		"updated_at":                 now,
+	}}
+	res, err := m.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetCancellationPaid records that the order was paid after it was canceled, so that
+// the payment is refunded like the payment of a paid order that is canceled.
+func (m OrderModel) SetCancellationPaid(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": id, "status": StatusCanceled, "cancellation": bson.M{"$ne": nil}}
+	update := bson.M{"$set": bson.M{"cancellation.was_paid": true, "updated_at": time.Now()}}
+	res, err := m.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetHoldingStock returns up to limit orders that hold stock they shouldn't: orders that
+// reserved stock at checkout and are still pending since before, and canceled orders
+// whose stock hasn't been put back yet. The oldest orders come first, orders the job
+// had to leave as they were are returned again only once they were checked before
+// retryBefore, so that they don't hold up the others.
+func (m OrderModel) GetHoldingStock(before, retryBefore time.Time, limit int64) ([]Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"stock_reserved": true,
+		"$or": bson.A{
+			bson.M{"status": StatusPending, "created_at": bson.M{"$lt": before}},
+			bson.M{"status": StatusCanceled, "cancellation.stock_restored": false},
+		},
+		"$and": bson.A{bson.M{"$or": bson.A{
+			bson.M{"expiry_checked_at": bson.M{"$exists": false}},
+			bson.M{"expiry_checked_at": bson.M{"$lt": retryBefore}},
+		}}},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetLimit(limit)
+	cursor, err := m.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	orders := make([]Order, 0)
+	if err := cursor.All(ctx, &orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// SetExpiryChecked records that the pending order job looked at the order and had to
+// leave it as it was.
+func (m OrderModel) SetExpiryChecked(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"expiry_checked_at": time.Now()}})
+	return err
+}
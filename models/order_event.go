@@ -0,0 +1,101 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	OrderEventCreated           = "created"
+	OrderEventPaymentStarted    = "payment_started"
+	OrderEventPaymentSucceeded  = "payment_succeeded"
+	OrderEventPaymentFailed     = "payment_failed"
+	OrderEventStatusChanged     = "status_changed"
+	OrderEventShipmentCreated   = "shipment_created"
+	OrderEventShipmentUpdated   = "shipment_updated"
+	OrderEventShipmentDelivered = "shipment_delivered"
+	OrderEventRefunded          = "refunded"
+	OrderEventNote              = "note"
+)
+
+// OrderEvent is an entry of the timeline of an order. Events are only ever appended,
+// so the timeline keeps the history that updates of the order overwrite. Internal
+// events are only shown to admins.
+type OrderEvent struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	OrderId   primitive.ObjectID `json:"order_id" bson:"order_id"`
+	Type      string             `json:"type" bson:"type"`
+	Message   string             `json:"message" bson:"message"`
+	Data      map[string]any     `json:"data,omitempty" bson:"data,omitempty"`
+	ActorId   primitive.ObjectID `json:"actor_id,omitempty" bson:"actor_id,omitempty"`
+	ActorRole Role               `json:"actor_role" bson:"actor_role"`
+	Internal  bool               `json:"internal" bson:"internal"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+type OrderEventModel struct {
+	coll *mongo.Collection
+}
+
+// OrderNotePayload adds a note to the timeline of an order. Notes are internal unless
+// Internal is set to false.
+type OrderNotePayload struct {
+	Message  string `json:"message"`
+	Internal *bool  `json:"internal"`
+}
+
+func ValidateOrderNotePayload(v *validator.Validator, p OrderNotePayload) {
+	v.Validate(validator.CheckLength(p.Message, 1, 2000), "message", "must be between 1 and 2000 bytes long")
+}
+
+func (m OrderEventModel) createIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "order_id", Value: 1}, {Key: "created_at", Value: 1}},
+	})
+	return err
+}
+
+func (m OrderEventModel) Insert(e *OrderEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	e.ID = primitive.NewObjectID()
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	_, err := m.coll.InsertOne(ctx, e)
+	return err
+}
+
+// GetForOrder returns the timeline of the order, oldest first. Internal events are
+// left out unless withInternal is set.
+func (m OrderEventModel) GetForOrder(orderId primitive.ObjectID, withInternal bool) ([]OrderEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{"order_id": orderId}
+	if !withInternal {
+		filter["internal"] = false
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := m.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	events := make([]OrderEvent, 0)
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,340 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	RefundPending   = "pending"
+	RefundSucceeded = "succeeded"
+	RefundFailed    = "failed"
+)
+
+// Where refunds come from.
+const (
+	RefundSourceAdmin        = "admin"
+	RefundSourceReturn       = "return"
+	RefundSourceCancellation = "cancellation"
+)
+
+var ErrRefundExceedsPayment = errors.New("the refund is more than what is left of the payment")
+
+type RefundLine struct {
+	LineId   primitive.ObjectID `json:"line_id" bson:"line_id"`
+	Quantity int                `json:"quantity" bson:"quantity"`
+}
+
+// OrderRefund is a refund of the payment of an order. Refunds are recorded before the
+// payment provider is called, so that concurrent refunds can't add up to more than
+// the payment.
+type OrderRefund struct {
+	ID               primitive.ObjectID `json:"id" bson:"id"`
+	Source           string             `json:"source" bson:"source"`
+	ProviderRefundId string             `json:"provider_refund_id,omitempty" bson:"provider_refund_id,omitempty"`
+	Amount           int                `json:"amount" bson:"amount"`
+	Lines            []RefundLine       `json:"lines,omitempty" bson:"lines,omitempty"`
+	Reason           string             `json:"reason,omitempty" bson:"reason,omitempty"`
+	Status           string             `json:"status" bson:"status"`
+	ActorId          primitive.ObjectID `json:"actor_id,omitempty" bson:"actor_id,omitempty"`
+	ActorRole        Role               `json:"actor_role" bson:"actor_role"`
+	CreatedAt        time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt        time.Time          `json:"updated_at" bson:"updated_at"`
+	// true once the credit note of a succeeded refund has been issued
+	CreditNoteIssued bool `json:"-" bson:"credit_note_issued,omitempty"`
+}
+
+// RefundPayload refunds an amount, or the given lines, of an order. Without either
+// everything that is left of the payment is refunded.
+type RefundPayload struct {
+	Amount *int         `json:"amount"`
+	Lines  []RefundLine `json:"lines"`
+	Reason string       `json:"reason"`
+}
+
+func ValidateRefundPayload(v *validator.Validator, p RefundPayload) {
+	v.Validate(p.Amount == nil || len(p.Lines) == 0, "amount", "can't be used together with lines")
+	if p.Amount != nil {
+		v.Validate(*p.Amount > 0, "amount", "must be positive")
+	}
+	v.Validate(len(p.Reason) <= 500, "reason", "must not be more than 500 bytes long")
+}
+
+// PaidAmount is what the payment provider received for the order. Orders paid before
+// it was recorded fall back to their total.
+func (o *Order) PaidAmount() int {
+	if o.AmountReceived > 0 {
+		return o.AmountReceived
+	}
+	return o.Total
+}
+
+// RefundableAmount is what is left of the payment of the order to refund: the payment
+// less the refunds that are pending or succeeded, or less what the provider reports
+// refunded when that is more.
+func (o *Order) RefundableAmount() int {
+	return max(o.PaidAmount()-max(o.AmountRefunded, o.ProviderRefunded), 0)
+}
+
+// IsFullyRefunded reports whether all of the payment of the order has been refunded,
+// counting the refunds that succeeded and the total the provider reports.
+func (o *Order) IsFullyRefunded() bool {
+	succeeded := 0
+	for _, r := range o.Refunds {
+		if r.Status == RefundSucceeded {
+			succeeded += r.Amount
+		}
+	}
+	paid := o.PaidAmount()
+	return paid > 0 && max(succeeded, o.ProviderRefunded) >= paid
+}
+
+// RefundByProviderId returns the refund of the order the provider knows by the ID, nil
+// if there is none.
+func (o *Order) RefundByProviderId(id string) *OrderRefund {
+	for i := range o.Refunds {
+		if o.Refunds[i].ProviderRefundId == id {
+			return &o.Refunds[i]
+		}
+	}
+	return nil
+}
+
+// Refund returns the refund of the order with the ID, nil if there is none.
+func (o *Order) Refund(id primitive.ObjectID) *OrderRefund {
+	for i := range o.Refunds {
+		if o.Refunds[i].ID == id {
+			return &o.Refunds[i]
+		}
+	}
+	return nil
+}
+
+// RefundLinesAmount checks that the lines belong to the order and that no more items
+// are refunded than were bought. The items refunded by lines before and the items of
+// the returns of the order that weren't rejected, which are refunded once received,
+// are counted too. It returns what the lines cost, with their tax when it isn't
+// included in the prices.
+func RefundLinesAmount(v *validator.Validator, order *Order, returns []Return, lines []RefundLine) int {
+	refunded := order.refundedLines()
+	for lineId, quantity := range returnedLines(returns) {
+		refunded[lineId] += quantity
+	}
+
+	amount := 0
+	for _, line := range lines {
+		idx := slices.IndexFunc(order.Products, func(op OrderProducts) bool { return op.ID == line.LineId })
+		if idx == -1 {
+			v.AddError("line_id", "line "+line.LineId.Hex()+" is not part of the order")
+			continue
+		}
+		if line.Quantity <= 0 {
+			v.AddError("quantity", "must be positive")
+			continue
+		}
+		op := order.Products[idx]
+		refunded[line.LineId] += line.Quantity
+		if refunded[line.LineId] > op.Quantity {
+			v.AddError("quantity", "more items of line "+line.LineId.Hex()+" are refunded than were bought")
+			continue
+		}
+		amount += order.LineAmount(op, line.Quantity)
+	}
+	return amount
+}
+
+// refundedLines sums the items refunded by lines per order line, counting the refunds
+// that didn't fail. Refunds of returns are left out, their returns count their items.
+func (o *Order) refundedLines() map[primitive.ObjectID]int {
+	refunded := make(map[primitive.ObjectID]int)
+	for _, r := range o.Refunds {
+		if r.Status == RefundFailed || r.Source == RefundSourceReturn {
+			continue
+		}
+		for _, line := range r.Lines {
+			refunded[line.LineId] += line.Quantity
+		}
+	}
+	return refunded
+}
+
+// LineAmount returns what quantity items of the line cost, with their share of the tax
+// of the line when it isn't included in the prices.
+func (o *Order) LineAmount(op OrderProducts, quantity int) int {
+	amount := op.UnitPrice * quantity
+	if !o.TaxInclusive && op.Quantity > 0 {
+		amount += op.Tax * quantity / op.Quantity
+	}
+	return amount
+}
+
+// ReserveRefund records the pending refund on the order and adds its amount to the
+// refunded amount, as long as it fits in what is left of the payment. Otherwise it
+// returns ErrRefundExceedsPayment. Reserving a refund that is already recorded, a
+// retry, loads the recorded refund into r.
+func (m OrderModel) ReserveRefund(order *Order, r *OrderRefund) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	r.Status = RefundPending
+	r.CreatedAt = now
+	r.UpdatedAt = now
+	filter := bson.M{
+		"_id":        order.ID,
+		"refunds.id": bson.M{"$ne": r.ID},
+		"$expr":      refundFitsExpr(r.Amount),
+	}
+	update := bson.M{
+		"$push": bson.M{"refunds": r},
+		"$inc":  bson.M{"amount_refunded": r.Amount},
+		"$set":  bson.M{"updated_at": now},
+	}
+	res, err := m.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 1 {
+		order.Refunds = append(order.Refunds, *r)
+		order.AmountRefunded += r.Amount
+		order.UpdatedAt = now
+		return nil
+	}
+
+	// a failed refund that is retried is reserved again
+	filter = bson.M{
+		"_id":     order.ID,
+		"refunds": bson.M{"$elemMatch": bson.M{"id": r.ID, "status": RefundFailed}},
+		"$expr":   filter["$expr"],
+	}
+	update = bson.M{
+		"$set": bson.M{"refunds.$.status": RefundPending, "refunds.$.updated_at": now, "updated_at": now},
+		"$inc": bson.M{"amount_refunded": r.Amount},
+	}
+	if _, err := m.coll.UpdateOne(ctx, filter, update); err != nil {
+		return err
+	}
+
+	current, err := m.Get(order.ID)
+	if err != nil {
+		return err
+	}
+	*order = *current
+	recorded := order.Refund(r.ID)
+	if recorded == nil || recorded.Status == RefundFailed {
+		return ErrRefundExceedsPayment
+	}
+	*r = *recorded
+	return nil
+}
+
+// refundFitsExpr matches orders where amount fits in what is left of the payment, the
+// same as RefundableAmount.
+func refundFitsExpr(amount int) bson.M {
+	paid := bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$amount_received", 0}}, "$amount_received", "$total"}}
+	refunded := bson.M{"$max": bson.A{"$amount_refunded", "$provider_refunded"}}
+	return bson.M{"$lte": bson.A{bson.M{"$add": bson.A{refunded, amount}}, paid}}
+}
+
+// CompleteRefund records the outcome of a pending refund. A failed refund gives its
+// amount back to what is left of the payment.
+func (m OrderModel) CompleteRefund(order *Order, r *OrderRefund, providerRefundId, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{"_id": order.ID, "refunds": bson.M{"$elemMatch": bson.M{"id": r.ID, "status": RefundPending}}}
+	update := bson.M{"$set": bson.M{
+		"refunds.$.status":             status,
+		"refunds.$.provider_refund_id": providerRefundId,
+		"refunds.$.updated_at":         now,
+		"updated_at":                   now,
+	}}
+	if status == RefundFailed {
+		update["$inc"] = bson.M{"amount_refunded": -r.Amount}
+	}
+	res, err := m.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		// completed concurrently
+		return nil
+	}
+
+	r.Status = status
+	r.ProviderRefundId = providerRefundId
+	r.UpdatedAt = now
+	if status == RefundFailed {
+		order.AmountRefunded -= r.Amount
+	}
+	if recorded := order.Refund(r.ID); recorded != nil {
+		*recorded = *r
+	}
+	return nil
+}
+
+// GetMissingCreditNotes returns up to limit orders with refunds that succeeded before
+// before and don't have their credit note yet.
+func (m OrderModel) GetMissingCreditNotes(before time.Time, limit int64) ([]Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"refunds": bson.M{"$elemMatch": bson.M{
+		"status":             RefundSucceeded,
+		"credit_note_issued": bson.M{"$ne": true},
+		"updated_at":         bson.M{"$lt": before},
+	}}}
+	cursor, err := m.coll.Find(ctx, filter, options.Find().SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	orders := make([]Order, 0)
+	if err := cursor.All(ctx, &orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// SetCreditNoteIssued records that the credit note of the refund has been issued.
+func (m OrderModel) SetCreditNoteIssued(orderId, refundId primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": orderId, "refunds.id": refundId}
+	_, err := m.coll.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"refunds.$.credit_note_issued": true}})
+	return err
+}
+
+// GetStuckRefunds returns up to limit orders with refunds that have been pending since
+// before without the provider having answered, so that they can be made again.
+func (m OrderModel) GetStuckRefunds(before time.Time, limit int64) ([]Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"refunds": bson.M{"$elemMatch": bson.M{
+		"status":             RefundPending,
+		"provider_refund_id": bson.M{"$exists": false},
+		"updated_at":         bson.M{"$lt": before},
+	}}}
+	cursor, err := m.coll.Find(ctx, filter, options.Find().SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	orders := make([]Order, 0)
+	if err := cursor.All(ctx, &orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
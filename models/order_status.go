@@ -0,0 +1,119 @@
+package models
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// StatusChange records a transition of the status of an order.
+type StatusChange struct {
+	From      int                `json:"from" bson:"from"`
+	To        int                `json:"to" bson:"to"`
+	At        time.Time          `json:"at" bson:"at"`
+	ActorId   primitive.ObjectID `json:"actor_id,omitempty" bson:"actor_id,omitempty"`
+	ActorRole Role               `json:"actor_role" bson:"actor_role"`
+}
+
+// orderTransitions lists, for every status, the statuses an order can move to
+// and the roles that are allowed to make each move. Customers can only cancel
+// orders that haven't been paid yet. Only refunds move orders to refunded.
+var orderTransitions = map[int]map[int][]Role{
+	StatusPending: {
+		StatusPayed:    {GetRole(AdminRole), GetRole(SystemRole)},
+		StatusCanceled: {GetRole(AdminRole), GetRole(UserRole), GetRole(SystemRole)},
+	},
+	StatusPayed: {
+		StatusShipped:  {GetRole(AdminRole), GetRole(SystemRole)},
+		StatusCanceled: {GetRole(AdminRole), GetRole(SystemRole)},
+		StatusRefunded: {GetRole(SystemRole)},
+	},
+	StatusShipped: {
+		StatusDelivered: {GetRole(AdminRole), GetRole(SystemRole)},
+		StatusRefunded:  {GetRole(SystemRole)},
+	},
+	StatusDelivered: {
+		StatusRefunded: {GetRole(SystemRole)},
+	},
+}
+
+func StatusName(status int) string {
+	switch status {
+	case StatusPending:
+		return "pending"
+	case StatusPayed:
+		return "payed"
+	case StatusShipped:
+		return "shipped"
+	case StatusDelivered:
+		return "delivered"
+	case StatusCanceled:
+		return "canceled"
+	case StatusRefunded:
+		return "refunded"
+	default:
+		return ""
+	}
+}
+
+// CanTransitionOrder returns ErrInvalidTransition if the role isn't allowed to move
+// an order from one status to the other.
+func CanTransitionOrder(from, to int, role Role) error {
+	roles, ok := orderTransitions[from][to]
+	if !ok || !slices.Contains(roles, role) {
+		return ErrInvalidTransition
+	}
+	return nil
+}
+
+// StatusChangedAt returns when the order last moved to status, or nil if it never did.
+func (o *Order) StatusChangedAt(status int) *time.Time {
+	for i := len(o.StatusHistory) - 1; i >= 0; i-- {
+		if o.StatusHistory[i].To == status {
+			return &o.StatusHistory[i].At
+		}
+	}
+	return nil
+}
+
+// Transition moves the order to change.To and records the change. The update only
+// applies if the order is still in change.From, otherwise ErrInvalidTransition is returned.
+func (m OrderModel) Transition(order *Order, change StatusChange) error {
+	return m.transition(order, change, nil)
+}
+
+// transition is Transition that also sets the given fields in the same update.
+func (m OrderModel) transition(order *Order, change StatusChange, set bson.M) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if err := CanTransitionOrder(change.From, change.To, change.ActorRole); err != nil {
+		return err
+	}
+
+	change.At = time.Now()
+	fields := bson.M{"status": change.To, "updated_at": change.At}
+	for k, v := range set {
+		fields[k] = v
+	}
+	filter := bson.M{"_id": order.ID, "status": change.From}
+	update := bson.M{
+		"$set":  fields,
+		"$push": bson.M{"status_history": change},
+	}
+	res, err := m.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrInvalidTransition
+	}
+
+	order.Status = change.To
+	order.UpdatedAt = change.At
+	order.StatusHistory = append(order.StatusHistory, change)
+	return nil
+}
@@ -17,6 +17,10 @@ type Product struct {
 	Tags        string             `json:"tags" bson:"tags"`
 	Description string             `json:"description" bson:"description"`
 	Price       int                `json:"price" bson:"price"`
+	// shipping weight in grams
+	Weight int `json:"weight" bson:"weight"`
+	// empty means DefaultTaxClass
+	TaxClass string `json:"tax_class,omitempty" bson:"tax_class,omitempty"`
 
 	Variants  []Variant `json:"variants,omitempty" bson:"variants,omitmepty"`
 	CreatedAt time.Time `json:"-" bson:"created_at"`
@@ -32,6 +36,8 @@ type ProductUpdatePayload struct {
 	Price       *int    `json:"price" bson:"price"`
 	Name        *string `json:"name" bson:"name"`
 	Tags        *string `json:"tags" bson:"tags"`
+	Weight      *int    `json:"weight" bson:"weight"`
+	TaxClass    *string `json:"tax_class" bson:"tax_class"`
 }
 
 func validateDescription(v *validator.Validator, desc string) {
@@ -41,6 +47,10 @@ func validatePrice(v *validator.Validator, price int) {
 	v.Validate(price > 0, "price", "must be positive")
 }
 
+func validateWeight(v *validator.Validator, weight int) {
+	v.Validate(weight >= 0, "weight", "cant be negative")
+}
+
 func validateImg(v *validator.Validator, img string) {
 	v.Validate(len(img) > 0, "img", "must be provided")
 }
@@ -54,6 +64,8 @@ func validateTags(v *validator.Validator, tags string) {
 func ValidateProduct(v *validator.Validator, p Product) {
 	validateDescription(v, p.Description)
 	validatePrice(v, p.Price)
+	validateWeight(v, p.Weight)
+	v.Validate(len(p.TaxClass) <= 50, "tax_class", "must not be more than 50 bytes long")
 	// validateImg(v, p.Img)
 	validateName(v, p.Name)
 	validateTags(v, p.Tags)
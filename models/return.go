@@ -0,0 +1,439 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	ReturnRequested = iota
+	ReturnApproved
+	ReturnRejected
+	ReturnReceived
+)
+
+var (
+	ErrReturnWindowClosed = errors.New("the return window of the order has closed")
+	ErrReturnExceedsOrder = errors.New("more items are returned than were bought")
+)
+
+// returnTransitions lists the statuses a return can move to. Only admins and the
+// system can decide on returns.
+var returnTransitions = map[int][]int{
+	ReturnRequested: {ReturnApproved, ReturnRejected},
+	ReturnApproved:  {ReturnReceived},
+}
+
+// ReturnLine is a line of the order that is sent back. The unit price is copied
+// from the order line, and the amount is what the returned items cost with their
+// tax, so that the refund matches what was charged.
+type ReturnLine struct {
+	LineId    primitive.ObjectID `json:"line_id" bson:"line_id"`
+	VariantId primitive.ObjectID `json:"variant_id" bson:"variant_id"`
+	Size      string             `json:"size" bson:"size"`
+	Quantity  int                `json:"quantity" bson:"quantity"`
+	UnitPrice int                `json:"unit_price" bson:"unit_price"`
+	Amount    int                `json:"amount" bson:"amount"`
+}
+
+type Return struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	OrderId       primitive.ObjectID `json:"order_id" bson:"order_id"`
+	UserId        primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Lines         []ReturnLine       `json:"lines" bson:"lines"`
+	Reason        string             `json:"reason" bson:"reason"`
+	Photo         string             `json:"photo,omitempty" bson:"photo,omitempty"`
+	Note          string             `json:"note,omitempty" bson:"note,omitempty"`
+	Status        int                `json:"status" bson:"status"`
+	StatusHistory []StatusChange     `json:"status_history" bson:"status_history"`
+	RefundAmount  int                `json:"refund_amount" bson:"refund_amount"`
+	RefundId      string             `json:"refund_id,omitempty" bson:"refund_id,omitempty"`
+	RefundStatus  string             `json:"refund_status,omitempty" bson:"refund_status,omitempty"`
+	StockRestored bool               `json:"stock_restored" bson:"stock_restored"`
+	CreatedAt     time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt     time.Time          `json:"updated_at" bson:"updated_at"`
+	// indexes of the lines whose stock has been put back
+	RestockedLines []int `json:"-" bson:"restocked_lines,omitempty"`
+	// set once the items of a rejected return were given back to the order
+	Released bool `json:"-" bson:"released,omitempty"`
+}
+
+type ReturnModel struct {
+	coll *mongo.Collection
+}
+
+type ReturnLinePayload struct {
+	LineId   primitive.ObjectID `json:"line_id"`
+	Quantity int                `json:"quantity"`
+}
+
+type ReturnPayload struct {
+	Reason string              `json:"reason"`
+	Lines  []ReturnLinePayload `json:"lines"`
+}
+
+type ReturnDecisionPayload struct {
+	Note string `json:"note"`
+}
+
+var ReturnSortSafelist = []string{"created_at", "-created_at", "status", "-status"}
+
+func ReturnStatusName(status int) string {
+	switch status {
+	case ReturnRequested:
+		return "requested"
+	case ReturnApproved:
+		return "approved"
+	case ReturnRejected:
+		return "rejected"
+	case ReturnReceived:
+		return "received"
+	default:
+		return ""
+	}
+}
+
+func ValidateReturnPayload(v *validator.Validator, payload ReturnPayload) {
+	v.Validate(!validator.IsEmpty(payload.Reason), "reason", "must be provided")
+	v.Validate(len(payload.Reason) <= 1000, "reason", "must not be more than 1000 bytes long")
+	v.Validate(len(payload.Lines) > 0, "lines", "must be provided")
+	for _, line := range payload.Lines {
+		v.Validate(!line.LineId.IsZero(), "line_id", "must be provided")
+		v.Validate(line.Quantity > 0, "quantity", "must be positive")
+	}
+}
+
+func ValidateReturnDecisionPayload(v *validator.Validator, payload ReturnDecisionPayload) {
+	v.Validate(len(payload.Note) <= 1000, "note", "must not be more than 1000 bytes long")
+}
+
+// CheckReturnWindow returns ErrReturnWindowClosed if the order wasn't delivered or
+// was delivered more than window ago.
+func CheckReturnWindow(order *Order, window time.Duration) error {
+	if order.Status != StatusDelivered {
+		return ErrReturnWindowClosed
+	}
+	deliveredAt := order.StatusChangedAt(StatusDelivered)
+	if deliveredAt == nil || time.Since(*deliveredAt) > window {
+		return ErrReturnWindowClosed
+	}
+	return nil
+}
+
+// NewReturnLines builds the lines of a return from the payload. It checks that every
+// line belongs to the order and that no more items are returned than were bought,
+// counting the items of the previous returns that weren't rejected and the items that
+// were refunded by lines without being returned.
+func NewReturnLines(v *validator.Validator, order *Order, previous []Return, payload []ReturnLinePayload) []ReturnLine {
+	returned := order.refundedLines()
+	for lineId, quantity := range returnedLines(previous) {
+		returned[lineId] += quantity
+	}
+
+	lines := make([]ReturnLine, 0, len(payload))
+	for _, p := range payload {
+		idx := slices.IndexFunc(order.Products, func(op OrderProducts) bool { return op.ID == p.LineId })
+		if idx == -1 {
+			v.AddError("line_id", "line "+p.LineId.Hex()+" is not part of the order")
+			continue
+		}
+		line := order.Products[idx]
+		returned[line.ID] += p.Quantity
+		if returned[line.ID] > line.Quantity {
+			v.AddError("quantity", "more items of line "+line.ID.Hex()+" are returned or refunded than were bought")
+			continue
+		}
+		lines = append(lines, ReturnLine{
+			LineId:    line.ID,
+			VariantId: line.Variant,
+			Size:      line.Size,
+			Quantity:  p.Quantity,
+			UnitPrice: line.UnitPrice,
+			Amount:    order.LineAmount(line, p.Quantity),
+		})
+	}
+	return lines
+}
+
+// ComputeRefund sets the amount that is refunded when the return is received.
+func (r *Return) ComputeRefund() {
+	r.RefundAmount = 0
+	for _, line := range r.Lines {
+		r.RefundAmount += line.Amount
+	}
+}
+
+// StockLines returns the lines of the return in the form the stock methods of
+// VariantModel expect.
+func (r *Return) StockLines() []OrderProducts {
+	lines := make([]OrderProducts, 0, len(r.Lines))
+	for _, line := range r.Lines {
+		lines = append(lines, OrderProducts{Variant: line.VariantId, Size: line.Size, Quantity: line.Quantity})
+	}
+	return lines
+}
+
+func (m ReturnModel) createIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "order_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	return err
+}
+
+func (m ReturnModel) Insert(r *Return) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if r.ID.IsZero() {
+		r.ID = primitive.NewObjectID()
+	}
+	r.Status = ReturnRequested
+	r.StatusHistory = []StatusChange{}
+	r.CreatedAt = time.Now()
+	r.UpdatedAt = r.CreatedAt
+	r.ComputeRefund()
+
+	_, err := m.coll.InsertOne(ctx, r)
+	return err
+}
+
+func (m ReturnModel) Get(id primitive.ObjectID) (*Return, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	r := &Return{}
+	if err := m.coll.FindOne(ctx, bson.M{"_id": id}).Decode(r); err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// GetForOrder returns every return of the order, oldest first.
+func (m ReturnModel) GetForOrder(orderId primitive.ObjectID) ([]Return, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	cursor, err := m.coll.Find(ctx, bson.M{"order_id": orderId})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	returns := make([]Return, 0)
+	if err := cursor.All(ctx, &returns); err != nil {
+		return nil, err
+	}
+	return returns, nil
+}
+
+// Search returns a page of returns, optionally of a user or in a status.
+func (m ReturnModel) Search(userId primitive.ObjectID, status *int, filters Filters) ([]Return, Metadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	if !userId.IsZero() {
+		filter["user_id"] = userId
+	}
+	if status != nil {
+		filter["status"] = *status
+	}
+
+	total, err := m.coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	cursor, err := m.coll.Find(ctx, filter, filters.findOptions())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer cursor.Close(ctx)
+
+	returns := make([]Return, 0)
+	if err := cursor.All(ctx, &returns); err != nil {
+		return nil, Metadata{}, err
+	}
+	return returns, calculateMetadata(total, filters.Page, filters.PageSize), nil
+}
+
+// Transition moves the return to change.To, records the change and sets the admin note.
+// It returns ErrInvalidTransition if the move isn't allowed or the return is no longer
+// in change.From.
+func (m ReturnModel) Transition(r *Return, change StatusChange, note string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if !slices.Contains(returnTransitions[change.From], change.To) {
+		return ErrInvalidTransition
+	}
+
+	change.At = time.Now()
+	set := bson.M{"status": change.To, "updated_at": change.At}
+	if note != "" {
+		set["note"] = note
+	}
+	filter := bson.M{"_id": r.ID, "status": change.From}
+	update := bson.M{"$set": set, "$push": bson.M{"status_history": change}}
+	res, err := m.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrInvalidTransition
+	}
+
+	r.Status = change.To
+	r.UpdatedAt = change.At
+	r.StatusHistory = append(r.StatusHistory, change)
+	if note != "" {
+		r.Note = note
+	}
+	return nil
+}
+
+// ClaimLineRestock marks line i of a received return as restocked. It returns false if
+// another request already did, in which case the caller must not restock it again.
+func (m ReturnModel) ClaimLineRestock(id primitive.ObjectID, i int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":             id,
+		"status":          ReturnReceived,
+		"stock_restored":  false,
+		"restocked_lines": bson.M{"$ne": i},
+	}
+	update := bson.M{
+		"$push": bson.M{"restocked_lines": i},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	res, err := m.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// UnclaimLineRestock undoes ClaimLineRestock when putting the stock of the line back failed.
+func (m ReturnModel) UnclaimLineRestock(id primitive.ObjectID, i int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	update := bson.M{
+		"$pull": bson.M{"restocked_lines": i},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	_, err := m.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+	return err
+}
+
+// SetStockRestored marks the items of a received return as restocked once all of its
+// lines have been. It returns false while some lines are left.
+func (m ReturnModel) SetStockRestored(id primitive.ObjectID, lines int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": id, "status": ReturnReceived, "restocked_lines": bson.M{"$size": lines}}
+	update := bson.M{"$set": bson.M{"stock_restored": true, "updated_at": time.Now()}}
+	res, err := m.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// SetRefund records the refund issued for a received return.
+func (m ReturnModel) SetRefund(id primitive.ObjectID, refundId, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"refund_id": refundId, "refund_status": status, "updated_at": time.Now()}}
+	res, err := m.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// returnedLines sums the items of the returns that weren't rejected per order line.
+func returnedLines(returns []Return) map[primitive.ObjectID]int {
+	returned := make(map[primitive.ObjectID]int)
+	for _, r := range returns {
+		if r.Status == ReturnRejected {
+			continue
+		}
+		for _, line := range r.Lines {
+			returned[line.LineId] += line.Quantity
+		}
+	}
+	return returned
+}
+
+// returnedQuantities sums the quantities of the lines per order line.
+func returnedQuantities(lines []ReturnLine) map[primitive.ObjectID]int {
+	quantities := make(map[primitive.ObjectID]int)
+	for _, line := range lines {
+		quantities[line.LineId] += line.Quantity
+	}
+	return quantities
+}
+
+// ReserveReturn adds the quantities of the return lines to the items returned of the
+// order lines. It returns ErrReturnExceedsOrder if a line would have more items
+// returned, counting the items refunded by lines, than were bought, so concurrent
+// returns can't return more than the order.
+func (m OrderModel) ReserveReturn(order *Order, lines []ReturnLine) error {
+	return m.reserveLineQuantities(order, "returned", returnedQuantities(lines), order.refundedLines(), ErrReturnExceedsOrder)
+}
+
+// ReleaseReturn takes the quantities of a return that was rejected, or couldn't be
+// recorded, back out of the items returned of the order lines.
+func (m OrderModel) ReleaseReturn(orderId primitive.ObjectID, lines []ReturnLine) error {
+	return m.releaseLineQuantities(orderId, "returned", returnedQuantities(lines))
+}
+
+// ClaimRelease marks the items of a rejected return as given back to the order. It
+// returns false if another request already did, in which case the caller must not
+// release them again.
+func (m ReturnModel) ClaimRelease(id primitive.ObjectID) (bool, error) {
+	return m.setReleased(id, true)
+}
+
+// UnclaimRelease undoes ClaimRelease when releasing the items failed.
+func (m ReturnModel) UnclaimRelease(id primitive.ObjectID) error {
+	_, err := m.setReleased(id, false)
+	return err
+}
+
+func (m ReturnModel) setReleased(id primitive.ObjectID, released bool) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": id, "status": ReturnRejected, "released": bson.M{"$ne": released}}
+	update := bson.M{"$set": bson.M{"released": released, "updated_at": time.Now()}}
+	res, err := m.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
@@ -0,0 +1,258 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+var ErrShipmentExceedsOrder = errors.New("more items are shipped than were bought")
+
+// ShipmentLine is a quantity of an order line that is sent in a shipment.
+type ShipmentLine struct {
+	LineId   primitive.ObjectID `json:"line_id" bson:"line_id"`
+	Quantity int                `json:"quantity" bson:"quantity"`
+}
+
+// Shipment is a parcel of an order. An order can be split into many shipments.
+type Shipment struct {
+	ID             primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	OrderId        primitive.ObjectID `json:"order_id" bson:"order_id"`
+	Carrier        string             `json:"carrier" bson:"carrier"`
+	TrackingNumber string             `json:"tracking_number" bson:"tracking_number"`
+	TrackingURL    string             `json:"tracking_url,omitempty" bson:"tracking_url,omitempty"`
+	Lines          []ShipmentLine     `json:"lines" bson:"lines"`
+	ShippedAt      time.Time          `json:"shipped_at" bson:"shipped_at"`
+	DeliveredAt    *time.Time         `json:"delivered_at,omitempty" bson:"delivered_at,omitempty"`
+	CreatedAt      time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt      time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+type ShipmentModel struct {
+	coll *mongo.Collection
+}
+
+// ShipmentPayload creates a shipment. If Lines is empty every item of the order that
+// hasn't been shipped yet goes in the shipment.
+type ShipmentPayload struct {
+	Carrier        string         `json:"carrier"`
+	TrackingNumber string         `json:"tracking_number"`
+	TrackingURL    string         `json:"tracking_url"`
+	Lines          []ShipmentLine `json:"lines"`
+}
+
+type ShipmentUpdatePayload struct {
+	Carrier        *string `json:"carrier"`
+	TrackingNumber *string `json:"tracking_number"`
+	TrackingURL    *string `json:"tracking_url"`
+}
+
+func ValidateShipment(v *validator.Validator, s Shipment) {
+	v.Validate(validator.CheckLength(s.Carrier, 1, 100), "carrier", "must be provided")
+	v.Validate(validator.CheckLength(s.TrackingNumber, 1, 100), "tracking_number", "must be provided")
+	v.Validate(len(s.TrackingURL) <= 500, "tracking_url", "must not be more than 500 bytes long")
+	v.Validate(len(s.Lines) > 0, "lines", "nothing left to ship")
+}
+
+// shippedQuantities sums, per order line, the items that are in the shipments.
+func shippedQuantities(shipments []Shipment) map[primitive.ObjectID]int {
+	shipped := make(map[primitive.ObjectID]int)
+	for _, s := range shipments {
+		for _, line := range s.Lines {
+			shipped[line.LineId] += line.Quantity
+		}
+	}
+	return shipped
+}
+
+// NewShipmentLines checks that the lines belong to the order and that no more items
+// are shipped than were bought, counting the previous shipments. Without lines it
+// returns everything that is left to ship.
+func NewShipmentLines(v *validator.Validator, order *Order, previous []Shipment, lines []ShipmentLine) []ShipmentLine {
+	shipped := shippedQuantities(previous)
+
+	if len(lines) == 0 {
+		remaining := make([]ShipmentLine, 0, len(order.Products))
+		for _, op := range order.Products {
+			if left := op.Quantity - shipped[op.ID]; left > 0 {
+				remaining = append(remaining, ShipmentLine{LineId: op.ID, Quantity: left})
+			}
+		}
+		return remaining
+	}
+
+	for _, line := range lines {
+		idx := slices.IndexFunc(order.Products, func(op OrderProducts) bool { return op.ID == line.LineId })
+		if idx == -1 {
+			v.AddError("line_id", "line "+line.LineId.Hex()+" is not part of the order")
+			continue
+		}
+		if line.Quantity <= 0 {
+			v.AddError("quantity", "must be positive")
+			continue
+		}
+		shipped[line.LineId] += line.Quantity
+		if shipped[line.LineId] > order.Products[idx].Quantity {
+			v.AddError("quantity", "more items of line "+line.LineId.Hex()+" are shipped than were bought")
+		}
+	}
+	return lines
+}
+
+// ReserveShipment adds the quantities of the shipment lines to the items shipped of
+// the order lines. It returns ErrShipmentExceedsOrder if a line would have more items
+// shipped than were bought, so concurrent shipments can't ship more than the order.
+func (m OrderModel) ReserveShipment(order *Order, lines []ShipmentLine) error {
+	return m.reserveLineQuantities(order, "shipped", shipmentQuantities(lines), nil, ErrShipmentExceedsOrder)
+}
+
+// ReleaseShipment takes the quantities of a shipment that couldn't be recorded back out
+// of the items shipped of the order lines.
+func (m OrderModel) ReleaseShipment(orderId primitive.ObjectID, lines []ShipmentLine) error {
+	return m.releaseLineQuantities(orderId, "shipped", shipmentQuantities(lines))
+}
+
+func shipmentQuantities(lines []ShipmentLine) map[primitive.ObjectID]int {
+	return shippedQuantities([]Shipment{{Lines: lines}})
+}
+
+// IsFullyShipped reports whether every item of the order is in one of the shipments.
+func IsFullyShipped(order *Order, shipments []Shipment) bool {
+	shipped := shippedQuantities(shipments)
+	for _, op := range order.Products {
+		if shipped[op.ID] < op.Quantity {
+			return false
+		}
+	}
+	return true
+}
+
+// IsFullyDelivered reports whether every item of the order has been shipped and
+// every shipment has been delivered.
+func IsFullyDelivered(order *Order, shipments []Shipment) bool {
+	if len(shipments) == 0 || !IsFullyShipped(order, shipments) {
+		return false
+	}
+	for _, s := range shipments {
+		if s.DeliveredAt == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (m ShipmentModel) createIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "order_id", Value: 1}, {Key: "shipped_at", Value: 1}}},
+		{Keys: bson.D{{Key: "tracking_number", Value: 1}}},
+	})
+	return err
+}
+
+func (m ShipmentModel) Insert(s *Shipment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	s.ID = primitive.NewObjectID()
+	s.CreatedAt = time.Now()
+	s.UpdatedAt = s.CreatedAt
+	if s.ShippedAt.IsZero() {
+		s.ShippedAt = s.CreatedAt
+	}
+
+	_, err := m.coll.InsertOne(ctx, s)
+	return err
+}
+
+func (m ShipmentModel) Get(id primitive.ObjectID) (*Shipment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	s := &Shipment{}
+	if err := m.coll.FindOne(ctx, bson.M{"_id": id}).Decode(s); err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// GetForOrder returns the shipments of the order in the order they were shipped.
+func (m ShipmentModel) GetForOrder(orderId primitive.ObjectID) ([]Shipment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "shipped_at", Value: 1}})
+	cursor, err := m.coll.Find(ctx, bson.M{"order_id": orderId}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	shipments := make([]Shipment, 0)
+	if err := cursor.All(ctx, &shipments); err != nil {
+		return nil, err
+	}
+	return shipments, nil
+}
+
+// Update saves the carrier and the tracking info of the shipment.
+func (m ShipmentModel) Update(s *Shipment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	s.UpdatedAt = time.Now()
+	update := bson.M{"$set": bson.M{
+		"carrier":         s.Carrier,
+		"tracking_number": s.TrackingNumber,
+		"tracking_url":    s.TrackingURL,
+		"updated_at":      s.UpdatedAt,
+	}}
+	res, err := m.coll.UpdateOne(ctx, bson.M{"_id": s.ID}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// MarkDelivered sets when the shipment was delivered. Marking a delivered shipment
+// again keeps the first delivery time.
+func (m ShipmentModel) MarkDelivered(s *Shipment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{"_id": s.ID, "delivered_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"delivered_at": now, "updated_at": now}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := m.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(s)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+	// already delivered, or gone
+	delivered, err := m.Get(s.ID)
+	if err != nil {
+		return err
+	}
+	*s = *delivered
+	return nil
+}
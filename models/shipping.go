@@ -0,0 +1,281 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// The ways a shipping method can be priced:
+// RateFlat charges Price for every order,
+// RateWeight charges the price of the first bracket the weight of the order fits in,
+// RateFreeOver charges Price unless the subtotal reaches Threshold.
+const (
+	RateFlat     = "flat"
+	RateWeight   = "weight"
+	RateFreeOver = "free_over"
+)
+
+var ErrCountryInOtherZone = errors.New("a country can only belong to one shipping zone")
+
+// WeightRate is a bracket of a weight based method. It applies to orders up to
+// UpTo grams, brackets are sorted by UpTo.
+type WeightRate struct {
+	UpTo  int `json:"up_to" bson:"up_to"`
+	Price int `json:"price" bson:"price"`
+}
+
+type ShippingMethod struct {
+	Code        string       `json:"code" bson:"code"`
+	Name        string       `json:"name" bson:"name"`
+	RateType    string       `json:"rate_type" bson:"rate_type"`
+	Price       int          `json:"price" bson:"price"`
+	Threshold   int          `json:"threshold,omitempty" bson:"threshold,omitempty"`
+	WeightRates []WeightRate `json:"weight_rates,omitempty" bson:"weight_rates,omitempty"`
+}
+
+// ShippingZone is a set of countries that share the same shipping methods.
+type ShippingZone struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name      string             `json:"name" bson:"name"`
+	Countries []string           `json:"countries" bson:"countries"`
+	Methods   []ShippingMethod   `json:"methods" bson:"methods"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+// ShippingRate is the price of a method for a specific order.
+type ShippingRate struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Cost int    `json:"cost"`
+}
+
+type ShippingZoneModel struct {
+	coll *mongo.Collection
+}
+
+type ShippingZonePayload struct {
+	Name      *string          `json:"name"`
+	Countries []string         `json:"countries"`
+	Methods   []ShippingMethod `json:"methods"`
+}
+
+// Apply copies the fields that are set in the payload onto the zone.
+func (p ShippingZonePayload) Apply(z *ShippingZone) {
+	if p.Name != nil {
+		z.Name = strings.TrimSpace(*p.Name)
+	}
+	if p.Countries != nil {
+		z.Countries = make([]string, 0, len(p.Countries))
+		for _, country := range p.Countries {
+			z.Countries = append(z.Countries, strings.ToUpper(strings.TrimSpace(country)))
+		}
+	}
+	if p.Methods != nil {
+		z.Methods = p.Methods
+	}
+	for i := range z.Methods {
+		slices.SortFunc(z.Methods[i].WeightRates, func(a, b WeightRate) int { return a.UpTo - b.UpTo })
+	}
+}
+
+func ValidateShippingZone(v *validator.Validator, z ShippingZone) {
+	v.Validate(validator.CheckLength(z.Name, 1, 100), "name", "must be provided")
+	v.Validate(len(z.Countries) > 0, "countries", "must be provided")
+	for i, country := range z.Countries {
+		v.Validate(countryCodeRX.MatchString(country), "countries", "must be 2 letter country codes")
+		v.Validate(!slices.Contains(z.Countries[:i], country), "countries", "must not contain duplicates")
+	}
+
+	codes := make([]string, 0, len(z.Methods))
+	for _, m := range z.Methods {
+		v.Validate(!validator.IsEmpty(m.Code), "code", "must be provided")
+		v.Validate(!slices.Contains(codes, m.Code), "code", "must be unique in the zone")
+		codes = append(codes, m.Code)
+		v.Validate(!validator.IsEmpty(m.Name), "name", "must be provided")
+		v.Validate(m.Price >= 0, "price", "cant be negative")
+
+		switch m.RateType {
+		case RateFlat:
+		case RateFreeOver:
+			v.Validate(m.Threshold > 0, "threshold", "must be positive")
+		case RateWeight:
+			v.Validate(len(m.WeightRates) > 0, "weight_rates", "must be provided")
+			for _, r := range m.WeightRates {
+				v.Validate(r.UpTo > 0, "up_to", "must be positive")
+				v.Validate(r.Price >= 0, "price", "cant be negative")
+			}
+		default:
+			v.AddError("rate_type", "must be one of flat, weight or free_over")
+		}
+	}
+}
+
+// Cost returns the price of the method for an order with the given subtotal and
+// weight in grams. It returns false if the method can't ship the order, which
+// happens when the order is heavier than the last bracket of a weight based method.
+func (m ShippingMethod) Cost(subtotal, weight int) (int, bool) {
+	switch m.RateType {
+	case RateFlat:
+		return m.Price, true
+	case RateFreeOver:
+		if subtotal >= m.Threshold {
+			return 0, true
+		}
+		return m.Price, true
+	case RateWeight:
+		for _, r := range m.WeightRates {
+			if weight <= r.UpTo {
+				return r.Price, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Rates returns the methods of the zone that can ship the order with their cost.
+func (z *ShippingZone) Rates(subtotal, weight int) []ShippingRate {
+	rates := make([]ShippingRate, 0, len(z.Methods))
+	for _, m := range z.Methods {
+		if cost, ok := m.Cost(subtotal, weight); ok {
+			rates = append(rates, ShippingRate{Code: m.Code, Name: m.Name, Cost: cost})
+		}
+	}
+	return rates
+}
+
+// Rate returns the rate of the method with the given code, or false if the zone has
+// no such method or the method can't ship the order.
+func (z *ShippingZone) Rate(code string, subtotal, weight int) (ShippingRate, bool) {
+	for _, rate := range z.Rates(subtotal, weight) {
+		if rate.Code == code {
+			return rate, true
+		}
+	}
+	return ShippingRate{}, false
+}
+
+func (m ShippingZoneModel) createIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		// a country belongs to at most one zone
+		{
+			Keys:    bson.D{{Key: "countries", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	return err
+}
+
+func (m ShippingZoneModel) Insert(z *ShippingZone) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	z.ID = primitive.NewObjectID()
+	z.CreatedAt = time.Now()
+	z.UpdatedAt = z.CreatedAt
+	if z.Methods == nil {
+		z.Methods = make([]ShippingMethod, 0)
+	}
+
+	if _, err := m.coll.InsertOne(ctx, z); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrCountryInOtherZone
+		}
+		return err
+	}
+	return nil
+}
+
+func (m ShippingZoneModel) Get(id primitive.ObjectID) (*ShippingZone, error) {
+	return m.getOne(bson.M{"_id": id})
+}
+
+// GetForCountry returns the zone the country belongs to or ErrNotFound if it isn't
+// in any zone, meaning that we don't ship there.
+func (m ShippingZoneModel) GetForCountry(country string) (*ShippingZone, error) {
+	return m.getOne(bson.M{"countries": strings.ToUpper(country)})
+}
+
+func (m ShippingZoneModel) getOne(filter bson.M) (*ShippingZone, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	z := &ShippingZone{}
+	if err := m.coll.FindOne(ctx, filter).Decode(z); err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+	return z, nil
+}
+
+func (m ShippingZoneModel) GetAll() ([]ShippingZone, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := m.coll.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	zones := make([]ShippingZone, 0)
+	if err := cursor.All(ctx, &zones); err != nil {
+		return nil, err
+	}
+	return zones, nil
+}
+
+func (m ShippingZoneModel) Update(z *ShippingZone) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	z.UpdatedAt = time.Now()
+	update := bson.M{"$set": bson.M{
+		"name":       z.Name,
+		"countries":  z.Countries,
+		"methods":    z.Methods,
+		"updated_at": z.UpdatedAt,
+	}}
+	res, err := m.coll.UpdateOne(ctx, bson.M{"_id": z.ID}, update)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrCountryInOtherZone
+		}
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m ShippingZoneModel) Delete(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// StockSubscription is a "notify me" request for a size of a variant
+// that is currently out of stock.
+type StockSubscription struct {
+	ID         primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserId     primitive.ObjectID `json:"-" bson:"user_id"`
+	Email      string             `json:"-" bson:"email"`
+	VariantId  primitive.ObjectID `json:"variant_id" bson:"variant_id"`
+	Size       string             `json:"size" bson:"size"`
+	NotifiedAt *time.Time         `json:"notified_at,omitempty" bson:"notified_at,omitempty"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+}
+
+type StockSubscriptionModel struct {
+	coll *mongo.Collection
+}
+
+type StockSubscriptionPayload struct {
+	Size string `json:"size"`
+}
+
+// Insert subscribes the user to the given size. Subscribing twice to the same
+// size before being notified is a no-op.
+func (m StockSubscriptionModel) Insert(s *StockSubscription) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"user_id":     s.UserId,
+		"variant_id":  s.VariantId,
+		"size":        s.Size,
+		"notified_at": bson.M{"$exists": false},
+	}
+	update := bson.M{"$setOnInsert": bson.M{
+		"_id":        primitive.NewObjectID(),
+		"email":      s.Email,
+		"created_at": time.Now(),
+	}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	return m.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(s)
+}
+
+func (m StockSubscriptionModel) GetPending(variantId primitive.ObjectID, size string) ([]StockSubscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"variant_id":  variantId,
+		"size":        size,
+		"notified_at": bson.M{"$exists": false},
+	}
+	cursor, err := m.coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	subs := make([]StockSubscription, 0)
+	if err := cursor.All(ctx, &subs); err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+func (m StockSubscriptionModel) MarkNotified(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": id, "notified_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"notified_at": time.Now()}}
+	res, err := m.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// DefaultTaxClass is the tax class of products that don't set one.
+const DefaultTaxClass = "standard"
+
+var ErrDuplicateTaxRate = errors.New("a rate for this country, region and tax class already exists")
+
+// TaxRate is the rate of a tax class in a country, or in a region of it. Rates are in
+// basis points, 2400 is 24%. A rate without a region applies to the whole country
+// unless the region has its own rate for the class.
+type TaxRate struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Country   string             `json:"country" bson:"country"`
+	Region    string             `json:"region,omitempty" bson:"region"`
+	TaxClass  string             `json:"tax_class" bson:"tax_class"`
+	Name      string             `json:"name" bson:"name"`
+	Rate      int                `json:"rate" bson:"rate"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+// TaxLine is the tax of an order or a cart grouped by rate, as it is printed on invoices.
+type TaxLine struct {
+	Name    string `json:"name" bson:"name"`
+	Rate    int    `json:"rate" bson:"rate"`
+	Taxable int    `json:"taxable" bson:"taxable"`
+	Tax     int    `json:"tax" bson:"tax"`
+}
+
+type TaxRateModel struct {
+	coll *mongo.Collection
+}
+
+type TaxRatePayload struct {
+	Country  *string `json:"country"`
+	Region   *string `json:"region"`
+	TaxClass *string `json:"tax_class"`
+	Name     *string `json:"name"`
+	Rate     *int    `json:"rate"`
+}
+
+// Apply copies the fields that are set in the payload onto the rate.
+func (p TaxRatePayload) Apply(r *TaxRate) {
+	if p.Country != nil {
+		r.Country = strings.ToUpper(strings.TrimSpace(*p.Country))
+	}
+	if p.Region != nil {
+		r.Region = strings.TrimSpace(*p.Region)
+	}
+	if p.TaxClass != nil {
+		r.TaxClass = strings.TrimSpace(*p.TaxClass)
+	}
+	if p.Name != nil {
+		r.Name = strings.TrimSpace(*p.Name)
+	}
+	if p.Rate != nil {
+		r.Rate = *p.Rate
+	}
+	if r.TaxClass == "" {
+		r.TaxClass = DefaultTaxClass
+	}
+}
+
+func ValidateTaxRate(v *validator.Validator, r TaxRate) {
+	v.Validate(countryCodeRX.MatchString(r.Country), "country", "must be a 2 letter country code")
+	v.Validate(len(r.Region) <= 100, "region", "must not be more than 100 bytes long")
+	v.Validate(validator.CheckLength(r.TaxClass, 1, 50), "tax_class", "must be provided")
+	v.Validate(validator.CheckLength(r.Name, 1, 100), "name", "must be provided")
+	v.Validate(r.Rate >= 0, "rate", "cant be negative")
+	v.Validate(r.Rate <= 10000, "rate", "must not be more than 10000 basis points")
+}
+
+func (m TaxRateModel) createIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "country", Value: 1}, {Key: "region", Value: 1}, {Key: "tax_class", Value: 1}},
+		// a class has one rate per country and region
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func (m TaxRateModel) Insert(r *TaxRate) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	r.ID = primitive.NewObjectID()
+	r.CreatedAt = time.Now()
+	r.UpdatedAt = r.CreatedAt
+
+	if _, err := m.coll.InsertOne(ctx, r); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicateTaxRate
+		}
+		return err
+	}
+	return nil
+}
+
+func (m TaxRateModel) Get(id primitive.ObjectID) (*TaxRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	r := &TaxRate{}
+	if err := m.coll.FindOne(ctx, bson.M{"_id": id}).Decode(r); err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// GetAll returns the rates, optionally only the ones of a country.
+func (m TaxRateModel) GetAll(country string) ([]TaxRate, error) {
+	filter := bson.M{}
+	if country != "" {
+		filter["country"] = strings.ToUpper(country)
+	}
+	return m.find(filter)
+}
+
+// GetForDestination returns the rates of the country that apply to the whole country
+// or to the region.
+func (m TaxRateModel) GetForDestination(country, region string) ([]TaxRate, error) {
+	return m.find(bson.M{
+		"country": strings.ToUpper(country),
+		"region":  bson.M{"$in": []string{"", region}},
+	})
+}
+
+func (m TaxRateModel) find(filter bson.M) ([]TaxRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "country", Value: 1}, {Key: "region", Value: 1}, {Key: "tax_class", Value: 1}})
+	cursor, err := m.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	rates := make([]TaxRate, 0)
+	if err := cursor.All(ctx, &rates); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+func (m TaxRateModel) Update(r *TaxRate) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	r.UpdatedAt = time.Now()
+	update := bson.M{"$set": bson.M{
+		"country":    r.Country,
+		"region":     r.Region,
+		"tax_class":  r.TaxClass,
+		"name":       r.Name,
+		"rate":       r.Rate,
+		"updated_at": r.UpdatedAt,
+	}}
+	res, err := m.coll.UpdateOne(ctx, bson.M{"_id": r.ID}, update)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicateTaxRate
+		}
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m TaxRateModel) Delete(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -18,6 +18,8 @@ type Role string
 const (
 	AdminRole = iota
 	UserRole
+	// used for changes that are made by the system itself, e.g. payment webhooks
+	SystemRole
 )
 
 func GetRole(role int) Role {
@@ -26,6 +28,8 @@ func GetRole(role int) Role {
 		return "admin"
 	case UserRole:
 		return "user"
+	case SystemRole:
+		return "system"
 	default:
 		return ""
 	}
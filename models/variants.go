@@ -5,7 +5,6 @@ package models
 import (
 	"context"
 	"errors"
-	"fmt"
 	"slices"
 	"time"
 
@@ -19,8 +18,10 @@ import (
 var colors []string = []string{"red", "blue", "white", "black", "pink", "yellow", "gray"}
 
 type SizesAndStock struct {
-	Size  string `json:"size" bson:"size"`
-	Stock int    `json:"stock" bson:"stock"`
+	Size              string `json:"size" bson:"size"`
+	SKU               string `json:"sku" bson:"sku"`
+	Stock             int    `json:"stock" bson:"stock"`
+	LowStockThreshold int    `json:"low_stock_threshold" bson:"low_stock_threshold"`
 }
 type Variant struct {
 	ID        primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
@@ -37,10 +38,16 @@ type VariantModel struct {
 	infoColl *mongo.Collection
 }
 
+type VariantUpdatePayload struct {
+	Color *string         `json:"color"`
+	Sizes []SizesAndStock `json:"sizes"`
+}
+
 func validateSizesInfo(v *validator.Validator, sizesInfo []SizesAndStock) {
 	for _, info := range sizesInfo {
 		v.Validate(len(info.Size) > 0, "size", "cant be empty")
 		v.Validate(info.Stock >= 0, "stock", "cant be negative")
+		v.Validate(info.LowStockThreshold >= 0, "low_stock_threshold", "cant be negative")
 	}
 }
 func validateColor(v *validator.Validator, pv Variant) {
@@ -115,21 +122,102 @@ func (m VariantModel) GetById(id string) (*Variant, error) {
 	return &v, nil
 }
 
-func (m VariantModel) Update(pv Variant) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// Update saves the color and images of the variant and, when before isn't nil, changes
+// its sizes from before to the sizes of pv. Everything is written in one transaction,
+// so a failed stock change leaves the variant as it was. ErrOutOfStock is returned if a
+// size doesn't have enough stock left for a decrease.
+func (m VariantModel) Update(pv *Variant, before []SizesAndStock) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	filter := bson.M{"_id": pv.ID}
-	update := bson.D{
-		{Key: "$set", Value: pv},
-	}
-
-	res, err := m.coll.UpdateOne(ctx, filter, update)
+	session, err := m.coll.Database().Client().StartSession()
 	if err != nil {
 		return err
 	}
-	if res.ModifiedCount == 0 {
-		return ErrNotFound
+	defer session.EndSession(ctx)
+
+	pv.UpdatedAt = time.Now()
+	_, err = session.WithTransaction(ctx, func(ctx context.Context) (any, error) {
+		filter := bson.M{"_id": pv.ID}
+		update := bson.M{"$set": bson.M{
+			"color":      pv.Color,
+			"img":        pv.Img,
+			"updated_at": pv.UpdatedAt,
+		}}
+		res, err := m.coll.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return nil, err
+		}
+		if res.MatchedCount == 0 {
+			return nil, ErrNotFound
+		}
+		if before == nil {
+			return nil, nil
+		}
+		return nil, m.updateSizes(ctx, pv.ID, before, pv.Sizes)
+	})
+	return err
+}
+
+// updateSizes changes the sizes of a variant from before to after. The stock of a size
+// is moved by the difference between the two instead of being overwritten, so items
+// reserved by orders in the meantime stay reserved. Sizes missing from after are
+// removed and new ones are added.
+func (m VariantModel) updateSizes(ctx context.Context, id primitive.ObjectID, before, after []SizesAndStock) error {
+	for _, size := range after {
+		old := findSize(before, size.Size)
+		if old == nil {
+			filter := bson.M{"_id": id, "sizes.size": bson.M{"$ne": size.Size}}
+			update := bson.M{"$push": bson.M{"sizes": size}}
+			if _, err := m.coll.UpdateOne(ctx, filter, update); err != nil {
+				return err
+			}
+			continue
+		}
+
+		delta := size.Stock - old.Stock
+		filter := bson.M{
+			"_id": id,
+			"sizes": bson.M{"$elemMatch": bson.M{
+				"size":  size.Size,
+				"stock": bson.M{"$gte": -delta},
+			}},
+		}
+		update := bson.M{
+			"$inc": bson.M{"sizes.$.stock": delta},
+			"$set": bson.M{
+				"sizes.$.sku":                 size.SKU,
+				"sizes.$.low_stock_threshold": size.LowStockThreshold,
+			},
+		}
+		res, err := m.coll.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return ErrOutOfStock
+		}
+	}
+
+	removed := make([]string, 0)
+	for _, size := range before {
+		if findSize(after, size.Size) == nil {
+			removed = append(removed, size.Size)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	update := bson.M{"$pull": bson.M{"sizes": bson.M{"size": bson.M{"$in": removed}}}}
+	_, err := m.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+	return err
+}
+
+func findSize(sizes []SizesAndStock, size string) *SizesAndStock {
+	for i := range sizes {
+		if sizes[i].Size == size {
+			return &sizes[i]
+		}
 	}
 	return nil
 }
@@ -163,19 +251,86 @@ func (m VariantModel) Delete(id string) error {
 	return nil
 }
 
-func (m VariantModel) GetTotalPrice(order *Order) (int, error) {
+// reserveStock takes the quantities of the lines out of the stock. It returns
+// ErrOutOfStock if a line doesn't have enough stock, without giving back the lines it
+// reserved before, so it runs in the transaction of Order.Place that undoes them. The
+// variants are returned as they are after the reservation, in the order of the lines.
+func (m VariantModel) reserveStock(ctx context.Context, lines []OrderProducts) ([]Variant, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	variants := make([]Variant, 0, len(lines))
+	for _, line := range lines {
+		filter := bson.M{
+			"_id": line.Variant,
+			"sizes": bson.M{"$elemMatch": bson.M{
+				"size":  line.Size,
+				"stock": bson.M{"$gte": line.Quantity},
+			}},
+		}
+		update := bson.M{"$inc": bson.M{"sizes.$.stock": -line.Quantity}}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		var v Variant
+		if err := m.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&v); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return nil, ErrOutOfStock
+			}
+			return nil, err
+		}
+		variants = append(variants, v)
+	}
+	return variants, nil
+}
+
+// ReleaseStock puts the quantities of the lines back in stock.
+func (m VariantModel) ReleaseStock(lines []OrderProducts) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	variantsId := make([]primitive.ObjectID, 0)
+	for _, line := range lines {
+		filter := bson.M{"_id": line.Variant, "sizes.size": line.Size}
+		update := bson.M{"$inc": bson.M{"sizes.$.stock": line.Quantity}}
+		if _, err := m.coll.UpdateOne(ctx, filter, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CatalogVariant is a variant joined with the product it belongs to. It carries
+// everything needed to price a line of a cart or an order.
+type CatalogVariant struct {
+	VariantId primitive.ObjectID `bson:"_id"`
+	ProductId primitive.ObjectID `bson:"product_id"`
+	Name      string             `bson:"name"`
+	Price     int                `bson:"price"`
+	Weight    int                `bson:"weight"`
+	TaxClass  string             `bson:"tax_class"`
+	Color     string             `bson:"color"`
+	Img       []string           `bson:"img"`
+	Sizes     []SizesAndStock    `bson:"sizes"`
+}
 
-	for _, p := range order.Products {
-		variantsId = append(variantsId, p.Variant)
+func (cv CatalogVariant) GetSize(size string) *SizesAndStock {
+	for i := range cv.Sizes {
+		if cv.Sizes[i].Size == size {
+			return &cv.Sizes[i]
+		}
+	}
+	return nil
+}
+
+// GetCatalog returns the current price, stock and product info of the given variants
+// keyed by variant id. Unknown variants are simply missing from the map.
+func (m VariantModel) GetCatalog(ids []primitive.ObjectID) (map[primitive.ObjectID]CatalogVariant, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	catalog := make(map[primitive.ObjectID]CatalogVariant)
+	if len(ids) == 0 {
+		return catalog, nil
 	}
 
 	pipeline := mongo.Pipeline{
-		{{Key: "$match", Value: bson.M{"_id": bson.M{"$in": variantsId}}}},
+		{{Key: "$match", Value: bson.M{"_id": bson.M{"$in": ids}}}},
 		{{Key: "$lookup", Value: bson.M{
 			"from":         "products",
 			"localField":   "product_id",
@@ -184,51 +339,38 @@ func (m VariantModel) GetTotalPrice(order *Order) (int, error) {
 		}}},
 		{{Key: "$unwind", Value: bson.M{"path": "$product"}}},
 		{{Key: "$project", Value: bson.M{
-			"price":      "$product.price", // Get price from the product
-			"variant_id": "$_id",           // Keep variant ID
-			"sizes":      "$sizes",         // Include sizes
+			"product_id": 1,
+			"name":       "$product.name",
+			"price":      "$product.price",
+			"weight":     "$product.weight",
+			"tax_class":  "$product.tax_class",
+			"color":      1,
+			"img":        1,
+			"sizes":      1,
 		}}},
 	}
 
 	cursor, err := m.coll.Aggregate(ctx, pipeline)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-
 	defer cursor.Close(ctx)
 
-	type tempProduct struct {
-		Price     int                `bson:"price"`
-		VariantId primitive.ObjectID `bson:"variant_id"`
-		Sizes     []SizesAndStock    `bson:"sizes"`
-	}
-
-	var products []tempProduct
-
-	if err := cursor.All(ctx, &products); err != nil {
-		return 0, err
+	var variants []CatalogVariant
+	if err := cursor.All(ctx, &variants); err != nil {
+		return nil, err
 	}
-
-	if err := cursor.Err(); err != nil {
-		return 0, err
+	for _, cv := range variants {
+		catalog[cv.VariantId] = cv
 	}
-	fmt.Println(products)
-	var total int = 0
+	return catalog, nil
+}
 
-	for _, orderProducts := range order.Products {
-		for _, product := range products {
-			if product.VariantId == orderProducts.Variant {
-				for _, size := range product.Sizes {
-					if size.Size == orderProducts.Size && size.Stock >= orderProducts.Quantity {
-						total += size.Stock * product.Price * orderProducts.Quantity
-					}
-				}
-			}
+func (v *Variant) GetSize(size string) *SizesAndStock {
+	for i := range v.Sizes {
+		if v.Sizes[i].Size == size {
+			return &v.Sizes[i]
 		}
 	}
-
-	if total == 0 {
-		return 0, errors.New("invalid order")
-	}
-	return total, nil
+	return nil
 }
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// webhookEventTTL is how long processed events are remembered. Stripe stops retrying
+// an event after 3 days.
+const webhookEventTTL = 30 * 24 * time.Hour
+
+// WebhookEvent is a webhook event that has been processed, keyed by the ID the
+// provider gave it, so that later deliveries of the same event are ignored.
+type WebhookEvent struct {
+	ID         string    `bson:"_id"`
+	Type       string    `bson:"type"`
+	ReceivedAt time.Time `bson:"received_at"`
+}
+
+type WebhookEventModel struct {
+	coll *mongo.Collection
+}
+
+func (m WebhookEventModel) createIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "received_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(webhookEventTTL.Seconds())),
+	})
+	return err
+}
+
+// IsProcessed reports whether the event has been processed already.
+func (m WebhookEventModel) IsProcessed(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	count, err := m.coll.CountDocuments(ctx, bson.M{"_id": id}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// MarkProcessed records that the event has been processed. It is only called once the
+// event has been handled, so an event is never lost, but concurrent deliveries of the
+// same event may both be handled.
+func (m WebhookEventModel) MarkProcessed(id, eventType string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.coll.InsertOne(ctx, WebhookEvent{ID: id, Type: eventType, ReceivedAt: time.Now()})
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/GiorgosMarga/ecom_go/internal/validator"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type WishlistItem struct {
+	ID        primitive.ObjectID `json:"id" bson:"id"`
+	VariantId primitive.ObjectID `json:"variant_id" bson:"variant_id"`
+	Size      string             `json:"size" bson:"size"`
+	AddedAt   time.Time          `json:"added_at" bson:"added_at"`
+
+	// the fields below are filled from the catalog when the list is read
+	Name      string `json:"name" bson:"-"`
+	Color     string `json:"color" bson:"-"`
+	Img       string `json:"img,omitempty" bson:"-"`
+	Price     int    `json:"price" bson:"-"`
+	Available bool   `json:"available" bson:"-"`
+	InStock   bool   `json:"in_stock" bson:"-"`
+}
+
+type Wishlist struct {
+	ID     primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserId primitive.ObjectID `json:"-" bson:"user_id"`
+	Name   string             `json:"name" bson:"name"`
+	Items  []WishlistItem     `json:"items" bson:"items"`
+	// lists with a share token can be read by anyone who knows it
+	ShareToken string    `json:"share_token,omitempty" bson:"share_token,omitempty"`
+	CreatedAt  time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+type WishlistModel struct {
+	coll *mongo.Collection
+}
+
+type WishlistPayload struct {
+	Name   *string `json:"name"`
+	Shared *bool   `json:"shared"`
+}
+
+type WishlistItemPayload struct {
+	VariantId primitive.ObjectID `json:"variant_id"`
+	Size      string             `json:"size"`
+}
+
+type MoveToCartPayload struct {
+	Quantity int `json:"quantity"`
+}
+
+type MoveToWishlistPayload struct {
+	WishlistId primitive.ObjectID `json:"wishlist_id"`
+}
+
+func ValidateWishlist(v *validator.Validator, w Wishlist) {
+	v.Validate(validator.CheckLength(w.Name, 1, 100), "name", "length must be between 1 and 100 characters")
+}
+
+func ValidateWishlistItem(v *validator.Validator, item WishlistItemPayload, catalog map[primitive.ObjectID]CatalogVariant) {
+	v.Validate(!item.VariantId.IsZero(), "variant_id", "must be provided")
+
+	cv, ok := catalog[item.VariantId]
+	if !ok {
+		v.AddError("variant_id", "unknown variant")
+		return
+	}
+	v.Validate(cv.GetSize(item.Size) != nil, "size", "unknown size")
+}
+
+func (w *Wishlist) VariantIds() []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, 0, len(w.Items))
+	for _, item := range w.Items {
+		ids = append(ids, item.VariantId)
+	}
+	return ids
+}
+
+func (w *Wishlist) GetItem(id primitive.ObjectID) *WishlistItem {
+	for i := range w.Items {
+		if w.Items[i].ID == id {
+			return &w.Items[i]
+		}
+	}
+	return nil
+}
+
+// Fill sets the current price and availability of the items from the catalog.
+func (w *Wishlist) Fill(catalog map[primitive.ObjectID]CatalogVariant) {
+	for i := range w.Items {
+		item := &w.Items[i]
+		cv, ok := catalog[item.VariantId]
+		if !ok {
+			item.Available = false
+			continue
+		}
+		item.Name = cv.Name
+		item.Color = cv.Color
+		item.Price = cv.Price
+		if len(cv.Img) > 0 {
+			item.Img = cv.Img[0]
+		}
+		size := cv.GetSize(item.Size)
+		item.Available = size != nil
+		item.InStock = size != nil && size.Stock > 0
+	}
+}
+
+func (m WishlistModel) createIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{
+			Keys: bson.D{{Key: "share_token", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"share_token": bson.M{"$exists": true}}),
+		},
+	})
+	return err
+}
+
+func (m WishlistModel) Insert(w *Wishlist) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	w.ID = primitive.NewObjectID()
+	w.CreatedAt = time.Now()
+	w.UpdatedAt = time.Now()
+	if w.Items == nil {
+		w.Items = make([]WishlistItem, 0)
+	}
+
+	_, err := m.coll.InsertOne(ctx, w)
+	return err
+}
+
+func (m WishlistModel) Get(id primitive.ObjectID) (*Wishlist, error) {
+	return m.getOne(bson.M{"_id": id})
+}
+
+func (m WishlistModel) GetByShareToken(token string) (*Wishlist, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	return m.getOne(bson.M{"share_token": token})
+}
+
+func (m WishlistModel) getOne(filter bson.M) (*Wishlist, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	w := &Wishlist{}
+	if err := m.coll.FindOne(ctx, filter).Decode(w); err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (m WishlistModel) GetForUser(userId primitive.ObjectID) ([]Wishlist, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := m.coll.Find(ctx, bson.M{"user_id": userId}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	wishlists := make([]Wishlist, 0)
+	if err := cursor.All(ctx, &wishlists); err != nil {
+		return nil, err
+	}
+	return wishlists, nil
+}
+
+// Update saves the name and the share token of the list. Items are changed
+// through AddItem and RemoveItem.
+func (m WishlistModel) Update(w *Wishlist) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	w.UpdatedAt = time.Now()
+	set := bson.M{"name": w.Name, "updated_at": w.UpdatedAt}
+	update := bson.M{"$set": set}
+	if w.ShareToken != "" {
+		set["share_token"] = w.ShareToken
+	} else {
+		update["$unset"] = bson.M{"share_token": ""}
+	}
+
+	res, err := m.coll.UpdateOne(ctx, bson.M{"_id": w.ID}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m WishlistModel) Delete(id, userId primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.coll.DeleteOne(ctx, bson.M{"_id": id, "user_id": userId})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// AddItem adds the item to the list unless the same variant and size is already in it.
+func (m WishlistModel) AddItem(id primitive.ObjectID, item WishlistItem) (*Wishlist, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	match := bson.M{"variant_id": item.VariantId, "size": item.Size}
+	filter := bson.M{"_id": id, "items": bson.M{"$not": bson.M{"$elemMatch": match}}}
+	update := bson.M{
+		"$push": bson.M{"items": item},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	w := &Wishlist{}
+	err := m.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(w)
+	if err == nil {
+		return w, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	// either the list doesn't exist or it already contains the item
+	return m.Get(id)
+}
+
+func (m WishlistModel) RemoveItem(id, lineId primitive.ObjectID) (*Wishlist, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": id, "items.id": lineId}
+	update := bson.M{
+		"$pull": bson.M{"items": bson.M{"id": lineId}},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	w := &Wishlist{}
+	if err := m.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(w); err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+	return w, nil
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 
 	"golang.org/x/crypto/bcrypt"
@@ -25,3 +27,12 @@ func CheckPasswordHash(password, hash string) error {
 	}
 	return nil
 }
+
+// RandomToken returns a hex encoded, cryptographically secure random token of n bytes.
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}